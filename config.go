@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gorag_engine "github.com/lapuglisi/gorag/v2/engine"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configRedacted string = "REDACTED"
+)
+
+// AppTool: an HTTP tool of the config file, its parameters written as YAML
+type AppTool struct {
+	gorag_engine.EngineHttpTool `yaml:",inline"`
+	Parameters                  map[string]any `yaml:"parameters,omitempty"`
+}
+
+// loadConfigFile reads a YAML (or JSON) config file over opts: only the
+// keys present in the file change opts. Keys are named after the flags;
+// unknown keys are rejected.
+func loadConfigFile(path string, opts *AppOptions) (err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+	default:
+		return fmt.Errorf("config '%s': unsupported format, want .yaml, .yml or .json", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err = decoder.Decode(opts); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config '%s': %w", path, err)
+	}
+
+	if err = opts.validateConfig(); err != nil {
+		return fmt.Errorf("config '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// validateConfig checks the values of a config file which flags cannot set
+func (opts *AppOptions) validateConfig() error {
+	switch {
+	case opts.QdrantLimit < 0 || opts.EmbedCacheSize < 0 || opts.AnswerCacheSize < 0:
+		return fmt.Errorf("'qdrant-limit', 'embed-cache-size' and 'answer-cache-size' must be positive")
+	case opts.EmbedTimeout < 0 || opts.LlamaTimeout < 0 || opts.TokenizeTimeout < 0:
+		return fmt.Errorf("'embed-timeout', 'llama-timeout' and 'tokenize-timeout' must be positive")
+	case opts.AnswerCacheSimilarity < 0 || opts.AnswerCacheSimilarity > 1:
+		return fmt.Errorf("'answer-cache-similarity' must be between 0 and 1")
+	case opts.Threshold < 0 || opts.Threshold > 1:
+		return fmt.Errorf("'threshold' must be between 0 and 1")
+	case opts.AgentMaxSteps < 0:
+		return fmt.Errorf("'agent-max-steps' must be positive")
+	case len(opts.Models) > 0 && opts.ModelRegistry != nil:
+		return fmt.Errorf("'models' and 'model-registry' are mutually exclusive")
+	case len(opts.Tools) > 0 && len(opts.HttpTools) > 0:
+		return fmt.Errorf("'tools' and 'http-tools' are mutually exclusive")
+	case len(opts.KeysFile) > 0 && len(opts.ApiKeys) > 0:
+		return fmt.Errorf("'keys-file' and 'api-keys' are mutually exclusive")
+	}
+
+	if err := gorag_engine.ValidateEngineApiKeys(opts.ApiKeys); err != nil {
+		return fmt.Errorf("'api-keys': %w", err)
+	}
+
+	if opts.ModelRegistry != nil {
+		if err := opts.ModelRegistry.Validate(); err != nil {
+			return fmt.Errorf("'model-registry': %w", err)
+		}
+	}
+
+	if _, err := opts.getHttpTools(); err != nil {
+		return fmt.Errorf("'http-tools': %w", err)
+	}
+
+	return nil
+}
+
+// getHttpTools converts the tools of the config file to engine tools
+func (opts *AppOptions) getHttpTools() (tools []gorag_engine.EngineHttpTool, err error) {
+	for _, t := range opts.HttpTools {
+		tool := t.EngineHttpTool
+		if t.Parameters != nil {
+			if tool.Parameters, err = json.Marshal(t.Parameters); err != nil {
+				return nil, fmt.Errorf("tool '%s': %w", tool.Name, err)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	if err = gorag_engine.ValidateEngineHttpTools(tools); err != nil {
+		return nil, err
+	}
+
+	return tools, nil
+}
+
+// getEngineSettings builds the reloadable engine settings of opts, reading
+// the model registry, tools, keys and JWKS files
+func (opts *AppOptions) getEngineSettings() (settings gorag_engine.EngineSettings, err error) {
+	settings.LlamaServer = opts.LlamaServer
+	settings.EmbedServer = opts.EmbedServer
+	settings.QdrantLimit = opts.QdrantLimit
+	settings.Threshold = float32(opts.Threshold)
+	settings.Prompts = opts.Prompts
+	settings.AgentMaxSteps = int(opts.AgentMaxSteps)
+
+	settings.ClientOptions = gorag_engine.NewLlamaClientOptions()
+	settings.ClientOptions.EmbedTimeout = opts.EmbedTimeout
+	settings.ClientOptions.CompletionTimeout = opts.LlamaTimeout
+	settings.ClientOptions.TokenizeTimeout = opts.TokenizeTimeout
+	settings.ClientOptions.MaxRetries = int(opts.LlamaRetries)
+	settings.ClientOptions.RetryBackoff = opts.LlamaBackoff
+	settings.ClientOptions.Balance = opts.LlamaBalance
+	settings.ClientOptions.BreakerFailures = int(opts.BreakerFailures)
+	settings.ClientOptions.BreakerCooldown = opts.BreakerCooldown
+	settings.ClientOptions.HealthInterval = opts.HealthInterval
+	settings.ClientOptions.EmbedBatchSize = int(opts.EmbedBatchSize)
+	settings.ClientOptions.EmbedConcurrency = int(opts.EmbedConcurrency)
+
+	settings.EmbedPrefixes, err = gorag_engine.GetEmbedPrefixes(opts.EmbedPrefix)
+	if err != nil {
+		return settings, err
+	}
+
+	if len(opts.EmbedQueryPrefix) > 0 {
+		settings.EmbedPrefixes.Query = opts.EmbedQueryPrefix
+	}
+
+	if len(opts.EmbedDocumentPrefix) > 0 {
+		settings.EmbedPrefixes.Document = opts.EmbedDocumentPrefix
+	}
+
+	if len(opts.Models) > 0 {
+		if settings.Models, err = gorag_engine.LoadEngineModelRegistry(opts.Models); err != nil {
+			return settings, err
+		}
+	} else {
+		settings.Models = opts.ModelRegistry
+	}
+
+	if len(opts.Tools) > 0 {
+		if settings.HttpTools, err = gorag_engine.LoadEngineHttpTools(opts.Tools); err != nil {
+			return settings, err
+		}
+	} else if settings.HttpTools, err = opts.getHttpTools(); err != nil {
+		return settings, err
+	}
+
+	if len(opts.KeysFile) > 0 {
+		if settings.ApiKeys, err = gorag_engine.LoadEngineApiKeys(opts.KeysFile); err != nil {
+			return settings, err
+		}
+	} else {
+		settings.ApiKeys = opts.ApiKeys
+	}
+
+	if len(opts.Jwks) > 0 {
+		if settings.Jwt, err = opts.getJwtOptions(); err != nil {
+			return settings, err
+		}
+	}
+
+	settings.Limits = gorag_engine.NewEngineSamplingLimits()
+	settings.Limits.MinTemperature = float32(opts.MinTemperature)
+	settings.Limits.MaxTemperature = float32(opts.MaxTemperature)
+	settings.Limits.MaxTopK = int(max(opts.MaxTopK, 0))
+	settings.Limits.MaxPredict = int(max(opts.MaxPredict, 0))
+	settings.Limits.MaxTokens = int(max(opts.MaxTokens, 0))
+
+	return settings, nil
+}
+
+// getJwtOptions builds the JWT validation options of opts, reading the
+// JWKS when it is a file
+func (opts *AppOptions) getJwtOptions() (options *gorag_engine.EngineJwtOptions, err error) {
+	jwt := gorag_engine.NewEngineJwtOptions()
+	jwt.Jwks = opts.Jwks
+	jwt.Issuer = opts.JwtIssuer
+	jwt.Audience = opts.JwtAudience
+
+	if len(opts.JwtClaims.Tenant) > 0 {
+		jwt.Claims.Tenant = opts.JwtClaims.Tenant
+	}
+
+	if len(opts.JwtClaims.Collections) > 0 {
+		jwt.Claims.Collections = opts.JwtClaims.Collections
+	}
+
+	if len(opts.JwtClaims.Scope) > 0 {
+		jwt.Claims.Scope = opts.JwtClaims.Scope
+	}
+
+	if len(opts.JwtClaims.Groups) > 0 {
+		jwt.Claims.Groups = opts.JwtClaims.Groups
+	}
+
+	if opts.JwtScopes != nil {
+		jwt.DefaultScopes = opts.JwtScopes
+	}
+
+	if err = jwt.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &jwt, nil
+}
+
+// reloadSettings reads flags, env and the config file again. The listen
+// address, qdrant and the caches only change on restart.
+func reloadSettings() (settings gorag_engine.EngineSettings, err error) {
+	var opts AppOptions
+
+	if err = setupEnvironment(&opts, os.Args[1:]); err != nil {
+		return settings, err
+	}
+
+	return opts.getEngineSettings()
+}
+
+// redacted returns a copy of opts without credentials: API keys of the
+// servers and header values of the tools
+func (opts AppOptions) redacted() AppOptions {
+	opts.EmbedServer = redactServers(opts.EmbedServer)
+	opts.LlamaServer = redactServers(opts.LlamaServer)
+
+	if opts.ModelRegistry != nil {
+		registry := *opts.ModelRegistry
+		registry.Models = make(map[string]gorag_engine.EngineModel, len(opts.ModelRegistry.Models))
+		for name, model := range opts.ModelRegistry.Models {
+			model.Servers = redactServers(model.Servers)
+			registry.Models[name] = model
+		}
+		opts.ModelRegistry = &registry
+	}
+
+	tools := make([]AppTool, len(opts.HttpTools))
+	for i, tool := range opts.HttpTools {
+		tool.Url = redactServers(tool.Url)
+
+		headers := make(map[string]string, len(tool.Headers))
+		for name := range tool.Headers {
+			headers[name] = configRedacted
+		}
+		tool.Headers = headers
+
+		tools[i] = tool
+	}
+	opts.HttpTools = tools
+
+	return opts
+}
+
+// redactServers hides the credentials of comma separated server specs
+func redactServers(specs string) string {
+	if len(specs) == 0 {
+		return specs
+	}
+
+	servers := strings.Split(specs, ",")
+	for i, spec := range servers {
+		spec = strings.TrimSpace(spec)
+
+		provider, rest, found := strings.Cut(spec, "+")
+		if !found || strings.Contains(provider, "://") {
+			provider, rest = "", spec
+		}
+
+		u, err := url.Parse(rest)
+		if err != nil {
+			servers[i] = configRedacted
+			continue
+		}
+
+		if u.User != nil {
+			u.User = url.User(configRedacted)
+		}
+
+		if len(provider) > 0 {
+			servers[i] = provider + "+" + u.String()
+		} else {
+			servers[i] = u.String()
+		}
+	}
+
+	return strings.Join(servers, ",")
+}
+
+// runConfigCommand runs 'gorag config <command> [flags]'
+func runConfigCommand(args []string) (err error) {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: gorag config print [flags]")
+	}
+
+	// Keep stdout clean for the configuration
+	log.SetOutput(io.Discard)
+
+	var options AppOptions
+	if err = setupEnvironment(&options, args[1:]); err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+
+	return encoder.Encode(options.redacted())
+}
@@ -0,0 +1,122 @@
+package gorag_engine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// EngineIdentity: who a request runs for, from its API key or its JWT
+type EngineIdentity struct {
+	KeyId   string
+	Subject string
+	// Tenant restricts retrieval to the points of the tenant; identities
+	// without one, API keys, only see points of no tenant
+	Tenant string
+	// Collections: the collections that may be searched, any when empty
+	Collections []string
+	// Groups: the document groups the subject belongs to
+	Groups []string
+	Scopes []string
+}
+
+// engineIdentityContext: the context key of the identity of a request
+type engineIdentityContext struct{}
+
+func (i EngineIdentity) String() string {
+	if len(i.KeyId) > 0 {
+		return fmt.Sprintf("key '%s'", i.KeyId)
+	}
+
+	if len(i.Tenant) > 0 {
+		return fmt.Sprintf("subject '%s' (tenant '%s')", i.Subject, i.Tenant)
+	}
+
+	return fmt.Sprintf("subject '%s'", i.Subject)
+}
+
+// HasScope tells whether the identity may call endpoints of scope
+func (i EngineIdentity) HasScope(scope string) bool {
+	return slices.Contains(i.Scopes, scope)
+}
+
+// WithIdentity returns a context under which Search, Complete and Ingest
+// are restricted to what identity may access, as HTTP requests are
+func WithIdentity(ctx context.Context, identity EngineIdentity) context.Context {
+	return context.WithValue(ctx, engineIdentityContext{}, identity)
+}
+
+// GetRequestIdentity returns the identity a request was authorized with
+func GetRequestIdentity(ctx context.Context) (identity EngineIdentity, found bool) {
+	identity, found = ctx.Value(engineIdentityContext{}).(EngineIdentity)
+	return identity, found
+}
+
+// getAccessFilter returns the conditions every search of collection must
+// add for the identity of ctx, or an error when it may not search it.
+// Requests without identity, when the API is open, see every point.
+func getAccessFilter(ctx context.Context, collection string) (conditions []*qdrant.Condition, err error) {
+	identity, found := GetRequestIdentity(ctx)
+	if !found {
+		return nil, nil
+	}
+
+	if len(identity.Collections) > 0 && !slices.Contains(identity.Collections, collection) {
+		return nil, &LlamaError{
+			Kind:    ErrForbidden,
+			Message: fmt.Sprintf("%s may not access collection '%s'", identity, collection),
+		}
+	}
+
+	conditions = append(conditions, getTenantCondition(identity))
+
+	// Points are visible to their owner, to their groups, and to the whole
+	// tenant when they have neither
+	visible := []*qdrant.Condition{
+		qdrant.NewFilterAsCondition(&qdrant.Filter{
+			Must: []*qdrant.Condition{qdrant.NewIsEmpty("owner"), qdrant.NewIsEmpty("groups")},
+		}),
+	}
+
+	if len(identity.Subject) > 0 {
+		visible = append(visible, qdrant.NewMatch("owner", identity.Subject))
+	}
+
+	if len(identity.Groups) > 0 {
+		visible = append(visible, qdrant.NewMatchKeywords("groups", identity.Groups...))
+	}
+
+	conditions = append(conditions, qdrant.NewFilterAsCondition(&qdrant.Filter{Should: visible}))
+
+	return conditions, nil
+}
+
+// getTenantCondition matches the points of the tenant of identity, or the
+// points of no tenant when it has none
+func getTenantCondition(identity EngineIdentity) *qdrant.Condition {
+	if len(identity.Tenant) == 0 {
+		return qdrant.NewIsEmpty("tenant")
+	}
+
+	return qdrant.NewMatch("tenant", identity.Tenant)
+}
+
+// getAccessScope: what answers cached for the identity of ctx depend on
+func getAccessScope(ctx context.Context) string {
+	identity, found := GetRequestIdentity(ctx)
+	if !found {
+		return ""
+	}
+
+	collections := slices.Clone(identity.Collections)
+	slices.Sort(collections)
+
+	groups := slices.Clone(identity.Groups)
+	slices.Sort(groups)
+
+	return fmt.Sprintf("tenant=%s,collections=%s,owner=%s,groups=%s", identity.Tenant,
+		strings.Join(collections, ","), identity.Subject, strings.Join(groups, ","))
+}
@@ -0,0 +1,77 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// getTenantOf returns the tenant matched by conditions, and whether the
+// points of no tenant are matched instead
+func getTenantOf(t *testing.T, conditions []*qdrant.Condition) (tenant string, empty bool) {
+	for _, condition := range conditions {
+		if field := condition.GetField(); field != nil && field.GetKey() == "tenant" {
+			return field.GetMatch().GetKeyword(), false
+		}
+
+		if condition.GetIsEmpty().GetKey() == "tenant" {
+			return "", true
+		}
+	}
+
+	t.Fatalf("no tenant condition in %v", conditions)
+	return "", false
+}
+
+func TestAccessFilterTenant(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity EngineIdentity
+		tenant   string
+		empty    bool
+	}{
+		{"subject", EngineIdentity{Subject: "alice", Tenant: "acme"}, "acme", false},
+		{"api key", EngineIdentity{KeyId: "k1"}, "", true},
+		{"subject without tenant", EngineIdentity{Subject: "alice"}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conditions, err := getAccessFilter(WithIdentity(context.Background(), test.identity), "docs")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tenant, empty := getTenantOf(t, conditions)
+			if tenant != test.tenant || empty != test.empty {
+				t.Fatalf("got tenant '%s' (empty %v), want '%s' (empty %v)", tenant, empty, test.tenant, test.empty)
+			}
+		})
+	}
+}
+
+func TestAccessFilterCollections(t *testing.T) {
+	ctx := WithIdentity(context.Background(), EngineIdentity{
+		Subject:     "alice",
+		Tenant:      "acme",
+		Collections: []string{"docs"},
+	})
+
+	if _, err := getAccessFilter(ctx, "docs"); err != nil {
+		t.Fatalf("allowed collection: %s", err)
+	}
+
+	if _, err := getAccessFilter(ctx, "other"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("got %v, want ErrForbidden", err)
+	}
+}
+
+// Open API: requests without identity are not filtered
+func TestAccessFilterWithoutIdentity(t *testing.T) {
+	conditions, err := getAccessFilter(context.Background(), "docs")
+	if err != nil || conditions != nil {
+		t.Fatalf("got %v, %v, want no conditions", conditions, err)
+	}
+}
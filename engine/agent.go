@@ -0,0 +1,247 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+const (
+	EngineDefaultAgentSteps int = 5
+
+	LlamaAgentSystemPrompt string = "You are a very helpfull assistant with access to a knowledge base " +
+		"through tools. Use them when the question needs information you do not have, " +
+		"and answer directly otherwise.\n" +
+		"Make sure to answer the question in the original language."
+)
+
+// agentState: what an agent run gathered so far
+type agentState struct {
+	collection string
+	threshold  float32
+	points     []qdrantPoint
+	seen       map[string]bool
+	steps      []EngineToolEvent
+	usage      EngineCompletionUsage
+	model      string
+	reason     string
+}
+
+func (s *agentState) addPoints(points []qdrantPoint) {
+	for _, point := range points {
+		if !s.seen[point.Id] {
+			s.seen[point.Id] = true
+			s.points = append(s.points, point)
+		}
+	}
+}
+
+// getAgentMaxSteps returns the steps requested, within the server limit
+func (e *GoRagEngine) getAgentMaxSteps(er *EngineCompletionRequest) int {
+	steps := e.agentMaxSteps
+	if er.MaxSteps > 0 && (steps <= 0 || er.MaxSteps < steps) {
+		steps = er.MaxSteps
+	}
+
+	return max(steps, 0)
+}
+
+// runAgent lets the model call tools until it answers, or until the step
+// limit is reached, in which case it has to answer without tools. Tool
+// calls made past the limit end the answer, with finish reason "length".
+func (e *GoRagEngine) runAgent(
+	ctx context.Context,
+	er *EngineCompletionRequest,
+	collection string,
+	callback EngineEventCallback) (state *agentState, content string, err error) {
+
+	state = &agentState{
+		collection: collection,
+		threshold:  er.Threshold,
+		seen:       make(map[string]bool),
+	}
+
+	messages := []llamaCompletionMessage{
+		{Role: LlamaRoleSystem, Content: e.prompts.Agent},
+		{Role: LlamaRoleUser, Content: er.Prompt},
+	}
+
+	tools := e.getTools()
+	maxSteps := e.getAgentMaxSteps(er)
+
+	for step := 0; ; step++ {
+		var answer strings.Builder
+		var calls []LlamaToolCall
+
+		lcr := e.newLlamaCompletionRequest(er, messages).WithStream(true)
+		if step < maxSteps {
+			lcr.WithTools(tools)
+		}
+
+		err = e.LlamaClient.GetCompletions(ctx, lcr, func(chunk *LlamaCompletionStream) error {
+			state.model = chunk.Model
+			if reason := chunk.FinishReason(); len(reason) > 0 {
+				state.reason = reason
+			}
+
+			if chunk.Usage != nil {
+				state.usage.PromptTokens += chunk.Usage.PromptTokens
+				state.usage.CompletionTokens += chunk.Usage.CompletionTokens
+				state.usage.TotalTokens += chunk.Usage.TotalTokens
+			}
+
+			calls = mergeToolCallDeltas(calls, chunk.ToolCalls())
+
+			if token := chunk.Content(); len(token) > 0 {
+				answer.WriteString(token)
+				return callback(EngineEventToken, EngineTokenEvent{Content: token})
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return state, "", err
+		}
+
+		if len(calls) == 0 {
+			return state, answer.String(), nil
+		}
+
+		// Some servers keep calling tools they were not offered, once
+		// earlier messages hold tool calls: the answer stops there
+		if step >= maxSteps {
+			log.Printf("[GoRagEngine::runAgent] step limit reached, %d tool calls ignored\n", len(calls))
+			state.reason = "length"
+			return state, answer.String(), nil
+		}
+
+		log.Printf("[GoRagEngine::runAgent] step %d: %d tool calls\n", step+1, len(calls))
+
+		messages = append(messages, llamaCompletionMessage{
+			Role:      LlamaRoleAssistant,
+			Content:   answer.String(),
+			ToolCalls: calls,
+		})
+
+		for _, call := range calls {
+			event := EngineToolEvent{
+				Id:   call.Id,
+				Name: call.Function.Name,
+			}
+
+			if json.Valid([]byte(call.Function.Arguments)) {
+				event.Arguments = json.RawMessage(call.Function.Arguments)
+			}
+
+			if err = callback(EngineEventToolCall, event); err != nil {
+				return state, "", err
+			}
+
+			result, toolErr := e.callTool(ctx, call, state)
+			if toolErr != nil {
+				event.Error = toolErr.Error()
+				result = "error: " + toolErr.Error()
+			} else {
+				event.Content = result
+			}
+
+			if ctx.Err() != nil {
+				return state, "", ctx.Err()
+			}
+
+			state.steps = append(state.steps, event)
+			if err = callback(EngineEventToolResult, event); err != nil {
+				return state, "", err
+			}
+
+			messages = append(messages, llamaCompletionMessage{
+				Role:       LlamaRoleTool,
+				Content:    result,
+				ToolCallId: call.Id,
+			})
+		}
+	}
+}
+
+// mergeToolCallDeltas adds the streamed parts of tool calls to calls, by index
+func mergeToolCallDeltas(calls []LlamaToolCall, deltas []LlamaToolCall) []LlamaToolCall {
+	for _, delta := range deltas {
+		for delta.Index >= len(calls) {
+			calls = append(calls, LlamaToolCall{Index: len(calls), Type: "function"})
+		}
+
+		call := &calls[delta.Index]
+		if len(delta.Id) > 0 {
+			call.Id = delta.Id
+		}
+
+		if len(delta.Function.Name) > 0 {
+			call.Function.Name = delta.Function.Name
+		}
+
+		call.Function.Arguments += delta.Function.Arguments
+	}
+
+	return calls
+}
+
+// completeAgent answers er in agent mode: no retrieval up front, the
+// model searches the knowledge base through tools when it needs to.
+func (e *GoRagEngine) completeAgent(
+	ctx context.Context,
+	er *EngineCompletionRequest,
+	callback EngineEventCallback) (ecr *EngineCompletionResponse, err error) {
+
+	collection := er.Collection
+	if len(collection) == 0 {
+		if collection, err = e.getCollection(ctx, er.Prompt); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = getAccessFilter(ctx, collection); err != nil {
+		return nil, err
+	}
+
+	er, err = e.resolveCompletionRequest(er, collection)
+	if err != nil {
+		return nil, newBadRequestError(err)
+	}
+
+	send := callback
+	if send == nil {
+		send = func(string, any) error { return nil }
+	}
+
+	state, content, err := e.runAgent(ctx, er, collection, send)
+	if err != nil {
+		return nil, err
+	}
+
+	ecr = &EngineCompletionResponse{
+		Status: EngineResponseJson{
+			Status:  "success",
+			Message: "completion retrieved",
+		},
+		Content:      content,
+		FinishReason: state.reason,
+		Model:        state.model,
+		Usage:        state.usage,
+		Sources:      e.getSourcesFromPoints(state.points),
+		Steps:        state.steps,
+	}
+
+	if callback != nil {
+		// Sources are only known once the model is done searching
+		callback(EngineEventSources, EngineSourcesEvent{Sources: ecr.Sources})
+		callback(EngineEventUsage, EngineUsageEvent{Usage: ecr.Usage})
+		callback(EngineEventDone, EngineDoneEvent{
+			FinishReason: ecr.FinishReason,
+			Model:        ecr.Model,
+		})
+	}
+
+	return ecr, nil
+}
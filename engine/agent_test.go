@@ -0,0 +1,187 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// testToolCallChunks: the chunks of a search tool call, its arguments split
+// across deltas
+var testToolCallChunks = []string{
+	`{"model":"chat.gguf","choices":[{"delta":{"tool_calls":[{"index":0,"id":"c1","type":"function",` +
+		`"function":{"name":"` + EngineToolSearch + `","arguments":"{\"query\":"}}]}}]}`,
+	`{"model":"chat.gguf","choices":[{"delta":{"tool_calls":[{"index":0,` +
+		`"function":{"arguments":"\"gorag stores its vectors\"}"}}]},"finish_reason":"tool_calls"}]}`,
+}
+
+var testAnswerChunks = []string{
+	`{"model":"chat.gguf","choices":[{"delta":{"content":"in qdrant"},"finish_reason":"stop"}]}`,
+}
+
+func TestAgentLoop(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSteps    int
+		streams     [][]string
+		completions int
+		content     string
+		reason      string
+		steps       int
+		sources     []string
+	}{
+		{
+			name:        "direct answer",
+			streams:     [][]string{testAnswerChunks},
+			completions: 1,
+			content:     "in qdrant",
+			reason:      "stop",
+		},
+		{
+			name:        "search then answer",
+			streams:     [][]string{testToolCallChunks, testAnswerChunks},
+			completions: 2,
+			content:     "in qdrant",
+			reason:      "stop",
+			steps:       1,
+			sources:     []string{"guide"},
+		},
+		{
+			name:        "tool calls past the limit",
+			maxSteps:    1,
+			streams:     [][]string{testToolCallChunks, testToolCallChunks, testToolCallChunks},
+			completions: 2,
+			reason:      "length",
+			steps:       1,
+			sources:     []string{"guide"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+			ingestTestDocuments(t, e, map[string]string{"guide": "gorag stores its vectors in qdrant"})
+
+			llama.streams = tt.streams
+
+			body, _ := json.Marshal(map[string]any{
+				"prompt":    "where does gorag store its vectors",
+				"agent":     true,
+				"stream":    false,
+				"max_steps": tt.maxSteps,
+			})
+
+			resp := postTestJson(e, "/api/v1/completion", string(body))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200: %s", resp.Code, resp.Body)
+			}
+
+			var ecr EngineCompletionResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &ecr); err != nil {
+				t.Fatal(err)
+			}
+
+			if ecr.Content != tt.content || ecr.FinishReason != tt.reason || len(ecr.Steps) != tt.steps {
+				t.Fatalf("got '%s', finish reason '%s' and %d steps", ecr.Content, ecr.FinishReason, len(ecr.Steps))
+			}
+
+			var sources []string
+			for _, source := range ecr.Sources {
+				sources = append(sources, source.Document)
+			}
+
+			if !slices.Equal(sources, tt.sources) {
+				t.Fatalf("got sources %v, want %v", sources, tt.sources)
+			}
+
+			llama.mu.Lock()
+			completions := llama.completions
+			llama.mu.Unlock()
+
+			if len(completions) != tt.completions {
+				t.Fatalf("got %d completions, want %d", len(completions), tt.completions)
+			}
+
+			// Tools are offered until the last step, their results given back
+			for i, payload := range completions {
+				if _, found := payload["tools"]; found != (tt.maxSteps == 0 || i < tt.maxSteps) {
+					t.Fatalf("completion %d: tools offered %v", i, found)
+				}
+			}
+
+			if tt.steps > 0 {
+				messages, _ := completions[1]["messages"].([]any)
+				last, _ := messages[len(messages)-1].(map[string]any)
+
+				if last["role"] != LlamaRoleTool || last["tool_call_id"] != "c1" {
+					t.Fatalf("got last message %v, want the search result", last)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeToolCallDeltas(t *testing.T) {
+	delta := func(index int, id string, name string, arguments string) LlamaToolCall {
+		call := LlamaToolCall{Index: index, Id: id}
+		call.Function.Name = name
+		call.Function.Arguments = arguments
+		return call
+	}
+
+	call := func(index int, id string, name string, arguments string) LlamaToolCall {
+		c := delta(index, id, name, arguments)
+		c.Type = "function"
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		deltas [][]LlamaToolCall
+		want   []LlamaToolCall
+	}{
+		{
+			name:   "single delta",
+			deltas: [][]LlamaToolCall{{delta(0, "a", "search", `{"query":"x"}`)}},
+			want:   []LlamaToolCall{call(0, "a", "search", `{"query":"x"}`)},
+		},
+		{
+			name: "arguments split",
+			deltas: [][]LlamaToolCall{
+				{delta(0, "a", "search", `{"qu`)},
+				{delta(0, "", "", `ery":`)},
+				{delta(0, "", "", `"x"}`)},
+			},
+			want: []LlamaToolCall{call(0, "a", "search", `{"query":"x"}`)},
+		},
+		{
+			name: "interleaved calls",
+			deltas: [][]LlamaToolCall{
+				{delta(0, "a", "search", `{`), delta(1, "b", "get_document", `{`)},
+				{delta(1, "", "", `}`)},
+				{delta(0, "", "", `}`)},
+			},
+			want: []LlamaToolCall{call(0, "a", "search", `{}`), call(1, "b", "get_document", `{}`)},
+		},
+		{
+			name:   "index out of order",
+			deltas: [][]LlamaToolCall{{delta(1, "b", "search", `{}`)}},
+			want:   []LlamaToolCall{call(0, "", "", ""), call(1, "b", "search", `{}`)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []LlamaToolCall
+			for _, deltas := range tt.deltas {
+				calls = mergeToolCallDeltas(calls, deltas)
+			}
+
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Fatalf("got %+v, want %+v", calls, tt.want)
+			}
+		})
+	}
+}
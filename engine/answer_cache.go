@@ -0,0 +1,202 @@
+package gorag_engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AnswerCacheDefaultSize       int           = 0
+	AnswerCacheDefaultSimilarity float64       = 0.95
+	AnswerCacheDefaultTTL        time.Duration = 24 * time.Hour
+)
+
+// AnswerCacheStats: counters sent by /admin/answer-cache
+type AnswerCacheStats struct {
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// answerCacheScope: answers are only reused for prompts sharing all of these
+type answerCacheScope struct {
+	Collection string
+	Model      string
+	Filters    string
+	Template   string
+}
+
+// answerCacheKey identifies the prompt of a completion request
+type answerCacheKey struct {
+	Scope     answerCacheScope
+	Embedding []float32
+}
+
+type answerCacheEntry struct {
+	key      answerCacheKey
+	answer   EngineCompletionResponse
+	created  time.Time
+	lastUsed time.Time
+}
+
+// AnswerCache: a semantic cache of completion answers. A prompt hits the
+// cache when its embedding is at least similarity (cosine) close to the
+// one of a cached prompt within the same scope.
+type AnswerCache struct {
+	size       int
+	similarity float64
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	entries []*answerCacheEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func NewAnswerCache(size int, similarity float64, ttl time.Duration) *AnswerCache {
+	return &AnswerCache{
+		size:       size,
+		similarity: similarity,
+		ttl:        ttl,
+		entries:    make([]*answerCacheEntry, 0, size),
+	}
+}
+
+// getTemplateHash identifies the prompts used to build llama messages
+func getTemplateHash(prompts ...string) string {
+	h := sha256.New()
+	for _, prompt := range prompts {
+		fmt.Fprintf(h, "%d:%s", len(prompt), prompt)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func getCosineSimilarity(a []float32, b []float32) float64 {
+	var dot, na, nb float64
+
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// Get returns the cached answer closest to key, if similar enough
+func (c *AnswerCache) Get(key answerCacheKey) (answer *EngineCompletionResponse, found bool) {
+	var best *answerCacheEntry
+	var bestSimilarity float64
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	kept := c.entries[:0]
+
+	for _, entry := range c.entries {
+		if c.ttl > 0 && now.Sub(entry.created) > c.ttl {
+			continue
+		}
+		kept = append(kept, entry)
+
+		if entry.key.Scope != key.Scope {
+			continue
+		}
+
+		similarity := getCosineSimilarity(entry.key.Embedding, key.Embedding)
+		if similarity >= c.similarity && similarity > bestSimilarity {
+			best = entry
+			bestSimilarity = similarity
+		}
+	}
+	c.entries = kept
+
+	if best == nil {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	log.Printf("[AnswerCache] hit with similarity %.4f\n", bestSimilarity)
+
+	best.lastUsed = now
+	c.hits.Add(1)
+
+	result := best.answer
+	return &result, true
+}
+
+// Put stores answer, evicting the least recently used entry when full
+func (c *AnswerCache) Put(key answerCacheKey, answer EngineCompletionResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.size {
+		oldest := 0
+		for i, entry := range c.entries {
+			if entry.lastUsed.Before(c.entries[oldest].lastUsed) {
+				oldest = i
+			}
+		}
+
+		c.entries = append(c.entries[:oldest], c.entries[oldest+1:]...)
+	}
+
+	now := time.Now()
+	c.entries = append(c.entries, &answerCacheEntry{
+		key:      key,
+		answer:   answer,
+		created:  now,
+		lastUsed: now,
+	})
+}
+
+// Invalidate drops every answer built from collection, or all of them
+// when collection is empty. Meant to be called when documents are re-indexed.
+func (c *AnswerCache) Invalidate(collection string) (removed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kept := c.entries[:0]
+	for _, entry := range c.entries {
+		if len(collection) == 0 || entry.key.Scope.Collection == collection {
+			removed++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	c.entries = kept
+
+	log.Printf("[AnswerCache] invalidated %d answers for collection '%s'\n", removed, collection)
+
+	return removed
+}
+
+func (c *AnswerCache) Stats() AnswerCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return AnswerCacheStats{
+		Entries: len(c.entries),
+		Size:    c.size,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
@@ -0,0 +1,92 @@
+package gorag_engine
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestAnswerKey(collection string, filters string, embedding ...float32) answerCacheKey {
+	return answerCacheKey{
+		Scope:     answerCacheScope{Collection: collection, Model: "m", Filters: filters, Template: "t"},
+		Embedding: embedding,
+	}
+}
+
+func TestAnswerCacheSimilarity(t *testing.T) {
+	c := NewAnswerCache(8, 0.95, time.Hour)
+	c.Put(newTestAnswerKey("docs", "", 1, 0, 0), EngineCompletionResponse{Content: "cached"})
+
+	tests := []struct {
+		name  string
+		key   answerCacheKey
+		found bool
+	}{
+		{"same prompt", newTestAnswerKey("docs", "", 1, 0, 0), true},
+		{"close prompt", newTestAnswerKey("docs", "", 1, 0.1, 0), true},
+		{"distant prompt", newTestAnswerKey("docs", "", 1, 1, 0), false},
+		{"other collection", newTestAnswerKey("other", "", 1, 0, 0), false},
+		{"other access scope", newTestAnswerKey("docs", "tenant=acme", 1, 0, 0), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			answer, found := c.Get(test.key)
+			if found != test.found {
+				t.Fatalf("found %v, want %v", found, test.found)
+			}
+
+			if found && answer.Content != "cached" {
+				t.Fatalf("got answer '%s'", answer.Content)
+			}
+		})
+	}
+}
+
+func TestAnswerCacheInvalidate(t *testing.T) {
+	c := NewAnswerCache(8, 0.95, time.Hour)
+	c.Put(newTestAnswerKey("docs", "", 1, 0), EngineCompletionResponse{})
+	c.Put(newTestAnswerKey("docs", "tenant=acme", 1, 0), EngineCompletionResponse{})
+	c.Put(newTestAnswerKey("other", "", 1, 0), EngineCompletionResponse{})
+
+	if removed := c.Invalidate("docs"); removed != 2 {
+		t.Fatalf("removed %d answers, want 2", removed)
+	}
+
+	if _, found := c.Get(newTestAnswerKey("other", "", 1, 0)); !found {
+		t.Fatalf("answer of another collection invalidated")
+	}
+
+	if removed := c.Invalidate(""); removed != 1 || c.Stats().Entries != 0 {
+		t.Fatalf("invalidating every collection left answers behind")
+	}
+}
+
+func TestAnswerCacheEviction(t *testing.T) {
+	c := NewAnswerCache(2, 0.95, time.Hour)
+	c.Put(newTestAnswerKey("a", "", 1), EngineCompletionResponse{})
+	time.Sleep(time.Millisecond)
+	c.Put(newTestAnswerKey("b", "", 1), EngineCompletionResponse{})
+	time.Sleep(time.Millisecond)
+
+	c.Get(newTestAnswerKey("a", "", 1))
+	c.Put(newTestAnswerKey("c", "", 1), EngineCompletionResponse{})
+
+	if _, found := c.Get(newTestAnswerKey("b", "", 1)); found {
+		t.Fatalf("least recently used answer kept")
+	}
+
+	if _, found := c.Get(newTestAnswerKey("a", "", 1)); !found {
+		t.Fatalf("recently used answer evicted")
+	}
+}
+
+func TestAnswerCacheExpiry(t *testing.T) {
+	c := NewAnswerCache(8, 0.95, time.Millisecond)
+	c.Put(newTestAnswerKey("docs", "", 1), EngineCompletionResponse{})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.Get(newTestAnswerKey("docs", "", 1)); found {
+		t.Fatalf("expired answer returned")
+	}
+}
@@ -0,0 +1,174 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// EngineSearchRequest: a retrieval without completion
+type EngineSearchRequest struct {
+	Query string `json:"query"`
+	// Threshold defaults to the one of the engine
+	Threshold float32 `json:"threshold,omitempty"`
+	// Limit caps the sources returned, within the qdrant limit
+	Limit int `json:"limit,omitempty"`
+	// Collection: the collection searched, the one of the embed model by default
+	Collection string `json:"collection,omitempty"`
+}
+
+// EngineSearchResponse: the sources found for an EngineSearchRequest
+type EngineSearchResponse struct {
+	Status     EngineResponseJson `json:"result"`
+	Collection string             `json:"collection"`
+	Model      string             `json:"model"`
+	Sources    []EngineSource     `json:"sources"`
+}
+
+// Handler returns the HTTP API of the engine, for programs embedding it to
+// mount, e.g. under a prefix with http.StripPrefix. Health checks of the
+// upstreams start with it.
+func (e *GoRagEngine) Handler() http.Handler {
+	// Not while a reload swaps the engine, which would miss them
+	e.live.mu.Lock()
+	defer e.live.mu.Unlock()
+
+	if current := e.current(); current.LlamaClient != nil {
+		current.LlamaClient.StartHealthChecks()
+	}
+
+	return e
+}
+
+// Search returns the sources closest to sr.Query
+func (e *GoRagEngine) Search(ctx context.Context, sr EngineSearchRequest) (*EngineSearchResponse, error) {
+	return e.current().search(ctx, sr)
+}
+
+// Complete answers er at once, with the context retrieved for its prompt.
+// Errors are LlamaError's, or come from qdrant.
+func (e *GoRagEngine) Complete(ctx context.Context, er *EngineCompletionRequest) (*EngineCompletionResponse, error) {
+	return e.current().completeRequest(ctx, er, nil)
+}
+
+// CompleteStream answers er, sending its events to callback as they come.
+// A callback error stops the answer; the whole answer is returned once done.
+func (e *GoRagEngine) CompleteStream(
+	ctx context.Context,
+	er *EngineCompletionRequest,
+	callback EngineEventCallback) (*EngineCompletionResponse, error) {
+
+	if callback == nil {
+		return nil, newBadRequestError(fmt.Errorf("no callback provided"))
+	}
+
+	return e.current().completeRequest(ctx, er, callback)
+}
+
+// completeRequest validates a request of the Go API, then answers it the
+// way an HTTP request with the same fields would be
+func (e *GoRagEngine) completeRequest(
+	ctx context.Context,
+	er *EngineCompletionRequest,
+	callback EngineEventCallback) (*EngineCompletionResponse, error) {
+
+	if er == nil || len(er.Prompt) == 0 {
+		return nil, newBadRequestError(fmt.Errorf("no valid input provided"))
+	}
+
+	// Fields left zero, or to the values of NewEngineCompletionRequest,
+	// fall back to the defaults of the model, then of the engine
+	request := *er
+	request.set = maps.Clone(er.set)
+	if err := request.trackSetFields(); err != nil {
+		return nil, newBadRequestError(err)
+	}
+	request.Stream = callback != nil
+
+	if err := request.Validate(); err != nil {
+		return nil, newBadRequestError(err)
+	}
+
+	return e.complete(ctx, &request, callback)
+}
+
+func (e *GoRagEngine) search(ctx context.Context, sr EngineSearchRequest) (result *EngineSearchResponse, err error) {
+	switch {
+	case len(strings.TrimSpace(sr.Query)) == 0:
+		return nil, newBadRequestError(fmt.Errorf("no valid input provided"))
+	case sr.Threshold < 0 || sr.Threshold > 1:
+		return nil, newBadRequestError(fmt.Errorf("threshold must be between 0 and 1"))
+	case sr.Limit < 0:
+		return nil, newBadRequestError(fmt.Errorf("limit must be positive"))
+	}
+
+	threshold := sr.Threshold
+	if threshold == 0 {
+		threshold = e.threshold
+	}
+
+	embeds, err := e.getEmbeddings(ctx, EmbedKindQuery, []string{sr.Query})
+	if err != nil {
+		return nil, err
+	}
+
+	collection := sr.Collection
+	if len(collection) == 0 {
+		collection = e.getCollectionFromModel(embeds.Model)
+	}
+
+	points, err := e.searchQdrantPoints(ctx, collection, embeds, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if sr.Limit > 0 && len(points) > sr.Limit {
+		points = points[:sr.Limit]
+	}
+
+	return &EngineSearchResponse{
+		Status: EngineResponseJson{
+			Status:  "success",
+			Message: "sources retrieved",
+		},
+		Collection: collection,
+		Model:      embeds.Model,
+		Sources:    e.getSourcesFromPoints(points),
+	}, nil
+}
+
+func (e *GoRagEngine) handleSearch(resp http.ResponseWriter, req *http.Request) {
+	var sr EngineSearchRequest
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		e.sendBadRequest("could not read request data", resp)
+		return
+	}
+
+	if err = json.Unmarshal(data, &sr); err != nil {
+		e.sendBadRequest(err.Error(), resp)
+		return
+	}
+
+	result, err := e.search(req.Context(), sr)
+	if err != nil {
+		log.Printf("[handleSearch] search error: %s\n", err.Error())
+		e.sendUpstreamError(err, resp)
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
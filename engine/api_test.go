@@ -0,0 +1,157 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestSearchCollection(t *testing.T) {
+	e, _, q := newTestEngine(t)
+	ingestTestDocuments(t, e, map[string]string{"guide": "qdrant stores the vectors of gorag"})
+
+	// Another collection, of the same embed model
+	q.mu.Lock()
+	q.collections["archive"] = maps.Clone(q.collections[testCollection])
+	q.mu.Unlock()
+
+	restricted := EngineIdentity{KeyId: "k1", Collections: []string{testCollection}}
+
+	tests := []struct {
+		name       string
+		identity   *EngineIdentity
+		collection string
+		want       string
+		forbidden  bool
+	}{
+		{"default", nil, "", testCollection, false},
+		{"requested", nil, "archive", "archive", false},
+		{"allowed", &restricted, testCollection, testCollection, false},
+		{"not allowed", &restricted, "archive", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.identity != nil {
+				ctx = WithIdentity(ctx, *tt.identity)
+			}
+
+			sr, err := e.Search(ctx, EngineSearchRequest{Query: "qdrant stores the vectors", Collection: tt.collection})
+			if tt.forbidden {
+				if !errors.Is(err, ErrForbidden) {
+					t.Fatalf("got %v, want a forbidden error", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sr.Collection != tt.want || len(sr.Sources) != 1 {
+				t.Fatalf("got %d sources from '%s', want 1 from '%s'", len(sr.Sources), sr.Collection, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompleteCollectionModel(t *testing.T) {
+	e, llama, _ := newTestEngine(t)
+	e.WithModels(&EngineModelRegistry{
+		Models: map[string]EngineModel{
+			"small": {Servers: llama.url},
+			"big":   {Servers: llama.url},
+		},
+		Default:     "small",
+		Collections: map[string]string{"archive": "big"},
+	})
+
+	tests := []struct {
+		name       string
+		collection string
+		want       string
+	}{
+		{"default", "", "small"},
+		{"collection default", "archive", "big"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er := NewEngineCompletionRequest()
+			er.Prompt = "hello"
+			er.Collection = tt.collection
+
+			if _, err := e.Complete(context.Background(), er); err != nil {
+				t.Fatal(err)
+			}
+
+			if model := llama.lastCompletion()["model"]; model != tt.want {
+				t.Fatalf("got model %v, want %s", model, tt.want)
+			}
+		})
+	}
+
+	ctx := WithIdentity(context.Background(), EngineIdentity{KeyId: "k1", Collections: []string{testCollection}})
+
+	er := NewEngineCompletionRequest()
+	er.Prompt = "hello"
+	er.Collection = "archive"
+
+	if _, err := e.Complete(ctx, er); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("got %v, want a forbidden error", err)
+	}
+}
+
+// Requests of the Go API only override the defaults of the model and the
+// engine with the fields they set
+func TestCompleteRequestDefaults(t *testing.T) {
+	e, llama, _ := newTestEngine(t)
+	ingestTestDocuments(t, e, map[string]string{"guide": "qdrant stores the vectors of gorag"})
+
+	temperature := float32(0.5)
+	e.WithThreshold(0.1).WithModels(&EngineModelRegistry{
+		Models:  map[string]EngineModel{"small": {Servers: llama.url, Temperature: &temperature}},
+		Default: "small",
+	})
+
+	hot := float32(0.9)
+
+	tests := []struct {
+		name        string
+		request     *EngineCompletionRequest
+		temperature float32
+		cachePrompt bool
+	}{
+		{"defaults", NewEngineCompletionRequest(), 0.5, true},
+		{"literal", &EngineCompletionRequest{Temperature: &hot}, 0.9, true},
+		{"set to the engine default", NewEngineCompletionRequest().WithTemperature(LlamaDefaultTemperature), LlamaDefaultTemperature, true},
+		{"prompt cache disabled", NewEngineCompletionRequest().WithCachePrompt(false), 0.5, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.Prompt = "where are the vectors"
+
+			ecr, err := e.Complete(context.Background(), tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Found with the threshold of the engine only
+			if len(ecr.Sources) != 1 {
+				t.Fatalf("got %d sources, want 1", len(ecr.Sources))
+			}
+
+			payload := llama.lastCompletion()
+			if got, _ := payload["temperature"].(float64); float32(got) != tt.temperature {
+				t.Fatalf("got temperature %v, want %v", payload["temperature"], tt.temperature)
+			}
+
+			if got, _ := payload["cache_prompt"].(bool); got != tt.cachePrompt {
+				t.Fatalf("got cache_prompt %v, want %v", payload["cache_prompt"], tt.cachePrompt)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package gorag_engine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be given
+const (
+	EngineScopeSearch   string = "search"
+	EngineScopeComplete string = "complete"
+	EngineScopeIngest   string = "ingest"
+	EngineScopeAdmin    string = "admin"
+
+	// API keys read gorag_<id>_<secret>
+	EngineApiKeyPrefix string = "gorag_"
+)
+
+var engineScopes = []string{EngineScopeSearch, EngineScopeComplete, EngineScopeIngest, EngineScopeAdmin}
+
+// EngineApiKey: a bearer key allowed to call the API within its scopes.
+// Only the hash of the key is kept; the key itself is shown once, when minted.
+type EngineApiKey struct {
+	Id      string    `json:"id" yaml:"id"`
+	Name    string    `json:"name,omitempty" yaml:"name,omitempty"`
+	Hash    string    `json:"hash" yaml:"hash"`
+	Scopes  []string  `json:"scopes" yaml:"scopes"`
+	Created time.Time `json:"created,omitzero" yaml:"created,omitempty"`
+}
+
+// NewEngineApiKey mints a key with scopes, returning it along with the
+// secret to give to the client
+func NewEngineApiKey(name string, scopes []string) (key EngineApiKey, secret string, err error) {
+	id := make([]byte, 6)
+	random := make([]byte, 32)
+
+	if _, err = rand.Read(id); err != nil {
+		return key, "", err
+	}
+
+	if _, err = rand.Read(random); err != nil {
+		return key, "", err
+	}
+
+	key = EngineApiKey{
+		Id:      hex.EncodeToString(id),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+
+	secret = EngineApiKeyPrefix + key.Id + "_" + hex.EncodeToString(random)
+	key.Hash = hashApiKey(secret)
+
+	return key, secret, key.Validate()
+}
+
+// hashApiKey: keys are random enough for a plain hash to do
+func hashApiKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// getApiKeyId returns the id part of a key, to find its hash
+func getApiKeyId(secret string) (id string, ok bool) {
+	rest, found := strings.CutPrefix(secret, EngineApiKeyPrefix)
+	if !found {
+		return "", false
+	}
+
+	id, _, found = strings.Cut(rest, "_")
+	return id, found && len(id) > 0
+}
+
+// Validate makes sure the key has an id, a hash and known scopes
+func (k *EngineApiKey) Validate() error {
+	switch {
+	case len(k.Id) == 0 || strings.Contains(k.Id, "_"):
+		return fmt.Errorf("api key '%s': invalid id", k.Id)
+	case !strings.HasPrefix(k.Hash, "sha256:"):
+		return fmt.Errorf("api key '%s': hash must be sha256:<hex>", k.Id)
+	case len(k.Scopes) == 0:
+		return fmt.Errorf("api key '%s': no scopes", k.Id)
+	}
+
+	for _, scope := range k.Scopes {
+		if !slices.Contains(engineScopes, scope) {
+			return fmt.Errorf("api key '%s': unknown scope '%s', want one of %s",
+				k.Id, scope, strings.Join(engineScopes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// ValidateEngineApiKeys validates keys, and rejects ids used twice
+func ValidateEngineApiKeys(keys []EngineApiKey) error {
+	ids := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if err := key.Validate(); err != nil {
+			return err
+		}
+
+		if ids[key.Id] {
+			return fmt.Errorf("api key '%s' is given twice", key.Id)
+		}
+		ids[key.Id] = true
+	}
+
+	return nil
+}
+
+// LoadEngineApiKeys reads a JSON key file, as written by SaveEngineApiKeys
+func LoadEngineApiKeys(path string) (keys []EngineApiKey, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid key file '%s': %w", path, err)
+	}
+
+	if err = ValidateEngineApiKeys(keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SaveEngineApiKeys writes keys to path, replacing it at once so a
+// reload never reads half a file
+func SaveEngineApiKeys(path string, keys []EngineApiKey) (err error) {
+	if keys == nil {
+		keys = []EngineApiKey{}
+	}
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gorag-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// WithApiKeys sets the keys allowed to call the API. Without keys nor
+// JWTs, the API is open to anyone.
+func (e *GoRagEngine) WithApiKeys(keys []EngineApiKey) *GoRagEngine {
+	e.apiKeys = make(map[string]EngineApiKey, len(keys))
+	for _, key := range keys {
+		e.apiKeys[key.Id] = key
+	}
+
+	return e
+}
+
+// WithJwt accepts JWTs validated with options as bearer tokens; nil only
+// accepts API keys. A JWKS file is read at once, an URL on first use.
+func (e *GoRagEngine) WithJwt(options *EngineJwtOptions) *GoRagEngine {
+	e.jwt = nil
+	if options != nil {
+		e.jwt = newEngineJwtValidator(*options)
+	}
+
+	return e
+}
+
+// authenticate finds the identity of the bearer token of req: an API key,
+// or a JWT when those are accepted
+func (e *GoRagEngine) authenticate(req *http.Request) (identity EngineIdentity, err error) {
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return identity, fmt.Errorf("missing bearer token")
+	}
+
+	token = strings.TrimSpace(token)
+	if e.jwt != nil && !strings.HasPrefix(token, EngineApiKeyPrefix) {
+		if identity, err = e.jwt.Validate(req.Context(), token); err != nil {
+			return identity, fmt.Errorf("invalid token: %w", err)
+		}
+		return identity, nil
+	}
+
+	id, ok := getApiKeyId(token)
+	if !ok {
+		return identity, fmt.Errorf("malformed api key")
+	}
+
+	key, found := e.apiKeys[id]
+	if !found || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashApiKey(token))) != 1 {
+		return identity, fmt.Errorf("invalid api key '%s'", id)
+	}
+
+	return EngineIdentity{KeyId: key.Id, Scopes: key.Scopes}, nil
+}
+
+// authorize lets requests reach handler when their identity has scope.
+// The identity is kept in the request context, and logged.
+func authorize(scope string, handler engineHandler) engineHandler {
+	return func(e *GoRagEngine, resp http.ResponseWriter, req *http.Request) {
+		if len(e.apiKeys) == 0 && e.jwt == nil {
+			handler(e, resp, req)
+			return
+		}
+
+		identity, err := e.authenticate(req)
+		if err != nil {
+			log.Printf("[authorize] %s %s: %s\n", req.Method, req.URL.Path, err.Error())
+			resp.Header().Set("WWW-Authenticate", `Bearer realm="gorag"`)
+			e.sendAuthError(http.StatusUnauthorized, EngineErrorCodeUnauthorized, err.Error(), resp, req)
+			return
+		}
+
+		if !identity.HasScope(scope) {
+			log.Printf("[authorize] %s: %s %s needs scope '%s'\n", identity, req.Method, req.URL.Path, scope)
+			e.sendAuthError(http.StatusForbidden, EngineErrorCodeForbidden,
+				fmt.Sprintf("%s lacks scope '%s'", identity, scope), resp, req)
+			return
+		}
+
+		log.Printf("[authorize] %s: %s %s\n", identity, req.Method, req.URL.Path)
+
+		handler(e, resp, req.WithContext(WithIdentity(req.Context(), identity)))
+	}
+}
+
+// sendAuthError answers authentication errors, as OpenAI errors on the facade
+func (e *GoRagEngine) sendAuthError(status int, code string, message string, resp http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		e.sendOpenAIError(status, message, resp)
+		return
+	}
+
+	e.sendResponseErrorStatus(status, code, message, resp)
+}
@@ -0,0 +1,140 @@
+package gorag_engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAuthEngine(t *testing.T) (e *GoRagEngine, secret string, jwt testJwtKey) {
+	key, secret, err := NewEngineApiKey("test", []string{EngineScopeSearch})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwt = newTestRsaKey(t, "rs", "")
+
+	e = NewEngine().WithApiKeys([]EngineApiKey{key})
+	e.jwt = newTestJwtValidator(t, jwt)
+
+	return e, secret, jwt
+}
+
+func newTestAuthRequest(path string, authorization string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return req
+}
+
+func TestAuthenticate(t *testing.T) {
+	e, secret, jwt := newTestAuthEngine(t)
+	id, _ := getApiKeyId(secret)
+
+	wrong := []byte(secret)
+	wrong[len(wrong)-1] ^= 1
+
+	tests := []struct {
+		name          string
+		authorization string
+		keyId         string
+		subject       string
+		valid         bool
+	}{
+		{"api key", "Bearer " + secret, id, "", true},
+		{"wrong secret", "Bearer " + string(wrong), "", "", false},
+		{"unknown key", "Bearer gorag_000000000000_00", "", "", false},
+		{"malformed key", "Bearer gorag_", "", "", false},
+		{"jwt", "Bearer " + jwt.sign(t, "RS256", newTestClaims(nil)), "", "alice", true},
+		{"expired jwt", "Bearer " + jwt.sign(t, "RS256", newTestClaims(map[string]any{"exp": 1})), "", "", false},
+		{"no bearer", "Basic " + secret, "", "", false},
+		{"no authorization", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := e.authenticate(newTestAuthRequest("/search", test.authorization))
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("accepted as %s", identity)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if identity.KeyId != test.keyId || identity.Subject != test.subject {
+				t.Fatalf("authenticated as %s", identity)
+			}
+		})
+	}
+}
+
+// Keys removed by a reload no longer authenticate
+func TestAuthenticateRevokedKey(t *testing.T) {
+	e, secret, _ := newTestAuthEngine(t)
+	e.WithApiKeys(nil)
+
+	if _, err := e.authenticate(newTestAuthRequest("/search", "Bearer "+secret)); err == nil {
+		t.Fatalf("revoked key accepted")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	e, secret, _ := newTestAuthEngine(t)
+
+	next := func(e *GoRagEngine, resp http.ResponseWriter, req *http.Request) {
+		if _, found := GetRequestIdentity(req.Context()); !found {
+			t.Errorf("no identity in the request context")
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name          string
+		scope         string
+		authorization string
+		status        int
+	}{
+		{"allowed", EngineScopeSearch, "Bearer " + secret, http.StatusNoContent},
+		{"missing scope", EngineScopeIngest, "Bearer " + secret, http.StatusForbidden},
+		{"unauthenticated", EngineScopeSearch, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			authorize(test.scope, next)(e, resp, newTestAuthRequest("/search", test.authorization))
+
+			if resp.Code != test.status {
+				t.Fatalf("got status %d, want %d", resp.Code, test.status)
+			}
+		})
+	}
+}
+
+// Without keys nor JWTs the API is open, and requests carry no identity
+func TestAuthorizeOpenApi(t *testing.T) {
+	e := NewEngine()
+
+	resp := httptest.NewRecorder()
+	authorize(EngineScopeAdmin, func(e *GoRagEngine, resp http.ResponseWriter, req *http.Request) {
+		if _, found := GetRequestIdentity(req.Context()); found {
+			t.Errorf("identity set on an open API")
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	})(e, resp, newTestAuthRequest("/admin/reload", ""))
+
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.Code)
+	}
+
+	if _, found := GetRequestIdentity(context.Background()); found {
+		t.Fatalf("identity found in an empty context")
+	}
+}
@@ -0,0 +1,218 @@
+package gorag_engine
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EmbedCacheDefaultSize int           = 0
+	EmbedCacheDefaultTTL  time.Duration = time.Hour
+)
+
+// EmbedCacheStats: counters sent by /admin/embed-cache
+type EmbedCacheStats struct {
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+type embedCacheEntry struct {
+	Key       string    `json:"key"`
+	Embedding []float32 `json:"embedding"`
+	Expires   time.Time `json:"expires"`
+}
+
+// EmbeddingCache: a LRU cache of embeddings, keyed by embed model, kind
+// and normalized input. Entries expire after ttl (zero means never).
+type EmbeddingCache struct {
+	size int
+	ttl  time.Duration
+	path string
+
+	mu      sync.Mutex
+	entries *list.List
+	items   map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// NewEmbeddingCache creates a cache holding up to size entries. When path
+// is not empty, entries are loaded from and saved to that file.
+func NewEmbeddingCache(size int, ttl time.Duration, path string) *EmbeddingCache {
+	c := &EmbeddingCache{
+		size:    size,
+		ttl:     ttl,
+		path:    path,
+		entries: list.New(),
+		items:   make(map[string]*list.Element),
+	}
+
+	if len(path) > 0 {
+		if err := c.load(); err != nil {
+			log.Printf("[EmbeddingCache] could not load '%s': %s\n", path, err.Error())
+		}
+	}
+
+	return c
+}
+
+func getEmbedCacheKey(model string, kind string, input string) string {
+	return model + "\x00" + kind + "\x00" + strings.Join(strings.Fields(input), " ")
+}
+
+// Get returns the embedding of input computed by model for kind
+func (c *EmbeddingCache) Get(model string, kind string, input string) (embedding []float32, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.items[getEmbedCacheKey(model, kind, input)]
+	if !found {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*embedCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.Expires) {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.entries.MoveToFront(elem)
+	c.hits.Add(1)
+
+	return entry.Embedding, true
+}
+
+// Put keeps the embedding of input computed by model for kind
+func (c *EmbeddingCache) Put(model string, kind string, input string, embedding []float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.add(&embedCacheEntry{
+		Key:       getEmbedCacheKey(model, kind, input),
+		Embedding: embedding,
+		Expires:   time.Now().Add(c.ttl),
+	})
+}
+
+// Model returns the embed model of the most recently used entry, so a
+// cache loaded from its file is usable before the embedder answered
+func (c *EmbeddingCache) Model() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries.Front()
+	if elem == nil {
+		return ""
+	}
+
+	model, _, _ := strings.Cut(elem.Value.(*embedCacheEntry).Key, "\x00")
+	return model
+}
+
+func (c *EmbeddingCache) Stats() EmbedCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return EmbedCacheStats{
+		Entries: c.entries.Len(),
+		Size:    c.size,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
+
+// Save writes the cache to its file, if any
+func (c *EmbeddingCache) Save() error {
+	if len(c.path) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	var data struct {
+		Entries []*embedCacheEntry `json:"entries"`
+	}
+
+	for elem := c.entries.Back(); elem != nil; elem = elem.Prev() {
+		data.Entries = append(data.Entries, elem.Value.(*embedCacheEntry))
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash never leaves a truncated cache behind
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+func (c *EmbeddingCache) load() error {
+	var data struct {
+		Entries []*embedCacheEntry `json:"entries"`
+	}
+
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range data.Entries {
+		if c.ttl <= 0 || time.Now().Before(entry.Expires) {
+			c.add(entry)
+		}
+	}
+
+	log.Printf("[EmbeddingCache] loaded %d entries from '%s'\n", c.entries.Len(), c.path)
+
+	return nil
+}
+
+// add must be called with c.mu held
+func (c *EmbeddingCache) add(entry *embedCacheEntry) {
+	if elem, found := c.items[entry.Key]; found {
+		elem.Value = entry
+		c.entries.MoveToFront(elem)
+		return
+	}
+
+	c.items[entry.Key] = c.entries.PushFront(entry)
+
+	for c.entries.Len() > c.size {
+		c.remove(c.entries.Back())
+	}
+}
+
+// remove must be called with c.mu held
+func (c *EmbeddingCache) remove(elem *list.Element) {
+	c.entries.Remove(elem)
+	delete(c.items, elem.Value.(*embedCacheEntry).Key)
+}
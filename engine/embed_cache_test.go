@@ -0,0 +1,151 @@
+package gorag_engine
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEmbeddingCacheKeys(t *testing.T) {
+	c := NewEmbeddingCache(8, time.Hour, "")
+	c.Put("nomic", "query", "what  is\tgorag", []float32{1, 2})
+
+	tests := []struct {
+		name  string
+		model string
+		kind  string
+		input string
+		found bool
+	}{
+		{"same input", "nomic", "query", "what  is\tgorag", true},
+		{"normalized spaces", "nomic", "query", " what is gorag ", true},
+		{"other model", "bge", "query", "what is gorag", false},
+		{"other kind", "nomic", "document", "what is gorag", false},
+		{"other input", "nomic", "query", "what is qdrant", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, found := c.Get(test.model, test.kind, test.input); found != test.found {
+				t.Fatalf("found %v, want %v", found, test.found)
+			}
+		})
+	}
+}
+
+func TestEmbeddingCacheEviction(t *testing.T) {
+	c := NewEmbeddingCache(2, time.Hour, "")
+	c.Put("m", "query", "a", []float32{1})
+	c.Put("m", "query", "b", []float32{2})
+
+	// a is now the most recently used, b goes first
+	c.Get("m", "query", "a")
+	c.Put("m", "query", "c", []float32{3})
+
+	if _, found := c.Get("m", "query", "b"); found {
+		t.Fatalf("least recently used entry kept")
+	}
+
+	for _, input := range []string{"a", "c"} {
+		if _, found := c.Get("m", "query", input); !found {
+			t.Fatalf("entry '%s' evicted", input)
+		}
+	}
+
+	if stats := c.Stats(); stats.Entries != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestEmbeddingCacheExpiry(t *testing.T) {
+	c := NewEmbeddingCache(8, time.Millisecond, "")
+	c.Put("m", "query", "a", []float32{1})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := c.Get("m", "query", "a"); found {
+		t.Fatalf("expired entry returned")
+	}
+
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Fatalf("expired entry kept")
+	}
+}
+
+func TestEmbeddingCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embeddings.json")
+
+	c := NewEmbeddingCache(8, time.Hour, path)
+	c.Put("m", "query", "a", []float32{1, 2})
+	c.Put("m", "document", "b", []float32{3, 4})
+
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewEmbeddingCache(8, time.Hour, path)
+
+	embedding, found := loaded.Get("m", "query", "a")
+	if !found || !slices.Equal(embedding, []float32{1, 2}) {
+		t.Fatalf("got %v (found %v) after reload", embedding, found)
+	}
+
+	if _, found = loaded.Get("m", "query", "b"); found {
+		t.Fatalf("document embedding returned for a query")
+	}
+
+	// Smaller caches only load the most recently used entries
+	if stats := NewEmbeddingCache(1, time.Hour, path).Stats(); stats.Entries != 1 {
+		t.Fatalf("loaded %d entries in a cache of 1", stats.Entries)
+	}
+}
+
+// A cache loaded from its file answers before the embedder told its model
+func TestGetEmbeddingsPersistedCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "embeddings.json")
+
+	e, _, _ := newTestEngine(t)
+	e.WithEmbedCache(8, time.Hour, path)
+
+	if _, err := e.getEmbeddings(context.Background(), "query", []string{"what is gorag"}); err != nil {
+		t.Fatal(err)
+	}
+	e.Finalize()
+
+	restarted, llama, _ := newTestEngine(t)
+	restarted.WithEmbedCache(8, time.Hour, path)
+
+	if model := restarted.Embedder.Model(); len(model) > 0 {
+		t.Fatalf("embedder already knows model '%s'", model)
+	}
+
+	embeds, err := restarted.getEmbeddings(context.Background(), "query", []string{"what is gorag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if embeds.Model != testEmbedModel {
+		t.Fatalf("got model '%s', want '%s'", embeds.Model, testEmbedModel)
+	}
+
+	if len(llama.embedded) > 0 {
+		t.Fatalf("embedder asked for %v", llama.embedded)
+	}
+}
+
+func TestEmbeddingCacheModel(t *testing.T) {
+	c := NewEmbeddingCache(8, time.Hour, "")
+	if model := c.Model(); len(model) > 0 {
+		t.Fatalf("empty cache of model '%s'", model)
+	}
+
+	c.Put("nomic", "query", "a", []float32{1})
+	c.Put("bge", "query", "b", []float32{2})
+	c.Get("nomic", "query", "a")
+
+	if model := c.Model(); model != "nomic" {
+		t.Fatalf("got model '%s', want the most recently used 'nomic'", model)
+	}
+}
@@ -0,0 +1,129 @@
+package gorag_engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Kinds of embedded texts: instruction tuned models (e5, bge...) expect
+// queries and documents to be prefixed differently.
+const (
+	EmbedKindQuery    string = "query"
+	EmbedKindDocument string = "document"
+)
+
+// Prefix presets for EmbedPrefixes
+const (
+	EmbedPrefixPresetNone string = "none"
+	EmbedPrefixPresetE5   string = "e5"
+	EmbedPrefixPresetBge  string = "bge"
+)
+
+// Embedder: computes the embeddings of inputs, in input order
+type Embedder interface {
+	Embed(ctx context.Context, inputs []string) (embeddings [][]float32, err error)
+	// Model and Dimension may only be known after the first call
+	Model() string
+	Dimension() int
+}
+
+// EmbedPrefixes: prepended to inputs according to their kind
+type EmbedPrefixes struct {
+	Query    string
+	Document string
+}
+
+// GetEmbedPrefixes returns the prefixes of a preset ("none", "e5" or "bge")
+func GetEmbedPrefixes(preset string) (prefixes EmbedPrefixes, err error) {
+	switch preset {
+	case "", EmbedPrefixPresetNone:
+		return EmbedPrefixes{}, nil
+	case EmbedPrefixPresetE5:
+		return EmbedPrefixes{Query: "query: ", Document: "passage: "}, nil
+	case EmbedPrefixPresetBge:
+		// bge only instructs queries
+		return EmbedPrefixes{Query: "Represent this sentence for searching relevant passages: "}, nil
+	}
+
+	return EmbedPrefixes{}, fmt.Errorf("unknown embed prefix preset '%s'", preset)
+}
+
+// Apply returns inputs prefixed for kind; an empty kind leaves them as is
+func (p EmbedPrefixes) Apply(kind string, inputs []string) []string {
+	var prefix string
+
+	switch kind {
+	case EmbedKindQuery:
+		prefix = p.Query
+	case EmbedKindDocument:
+		prefix = p.Document
+	}
+
+	if len(prefix) == 0 {
+		return inputs
+	}
+
+	result := make([]string, len(inputs))
+	for i, input := range inputs {
+		result[i] = prefix + input
+	}
+
+	return result
+}
+
+// LlamaEmbedder: an Embedder using the embedding servers of a LlamaEngine,
+// whichever their provider (llama.cpp, Ollama or OpenAI compatible).
+type LlamaEmbedder struct {
+	client *LlamaEngine
+
+	mu        sync.Mutex
+	model     string
+	dimension int
+}
+
+func NewLlamaEmbedder(client *LlamaEngine) *LlamaEmbedder {
+	return &LlamaEmbedder{
+		client: client,
+	}
+}
+
+func (l *LlamaEmbedder) Embed(ctx context.Context, inputs []string) (embeddings [][]float32, err error) {
+	embeds, err := l.client.GetEmbeddings(ctx, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(embeds.Model) > 0 {
+		l.model = embeds.Model
+	}
+
+	if len(embeds.Embeddings) > 0 {
+		l.dimension = len(embeds.Embeddings[0])
+	}
+
+	return embeds.Embeddings, nil
+}
+
+// Model returns the model the servers answered with, else the one named
+// by their specification
+func (l *LlamaEmbedder) Model() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.model) == 0 {
+		return l.client.EmbedServers.Model()
+	}
+
+	return l.model
+}
+
+func (l *LlamaEmbedder) Dimension() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.dimension
+}
@@ -1,58 +1,317 @@
 package gorag_engine
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/qdrant/go-client/qdrant"
 )
 
 const (
 	QdrantDefaultThreshold float32 = 0.7
+
+	// Time given to in-flight requests, streams included, to finish on shutdown
+	EngineDefaultDrainTimeout time.Duration = 30 * time.Second
+
+	EngineRequestIdHeader string = "X-Request-Id"
 )
 
 // Llama json specs
 type EmbedRequestJson struct {
-	Input string `json:"input"`
+	Input EmbedInputJson `json:"input"`
+	// Kind is "document" (default) or "query", selecting the embed prefix
+	Kind string `json:"kind,omitempty"`
+}
+
+// EmbedInputJson accepts either a single string or an array of strings
+type EmbedInputJson []string
+
+func (i *EmbedInputJson) UnmarshalJSON(data []byte) error {
+	var single string
+
+	if err := json.Unmarshal(data, &single); err == nil {
+		*i = EmbedInputJson{single}
+		return nil
+	}
+
+	var inputs []string
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return fmt.Errorf("'input' must be a string or an array of strings")
+	}
+
+	*i = EmbedInputJson(inputs)
+
+	return nil
+}
+
+// IsValid tells whether there is at least one input and none is empty
+func (i EmbedInputJson) IsValid() bool {
+	for _, input := range i {
+		if len(strings.TrimSpace(input)) == 0 {
+			return false
+		}
+	}
+
+	return len(i) > 0
 }
 
 type EmbedResponseJson struct {
 	Status     EngineResponseJson `json:"result"`
+	Model      string             `json:"model,omitempty"`
+	Dimension  int                `json:"dimension,omitempty"`
 	Embeddings [][]float32        `json:"embeddings"`
 }
 
 type EngineResponseJson struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	Code      string `json:"code,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
 }
 
 type EngineCompletionRequest struct {
-	Prompt      string  `json:"prompt"`
-	Temperature float32 `json:"temperature"`
+	Prompt string `json:"prompt"`
+	// Model: a model of the registry, defaults to the one of the collection
+	Model string `json:"model,omitempty"`
+	// Collection: the collection searched, the one of the embed model by default
+	Collection  string  `json:"collection,omitempty"`
 	Stream      bool    `json:"stream,omitempty"`
-	TopK        int     `json:"top_k,omitempty"`
-	TopP        float32 `json:"top_p,omitempty"`
-	Predict     int     `json:"n_predict,omitempty"`
 	CachePrompt bool    `json:"cache_prompt,omitempty"`
-	MaxTokens   int     `json:"max_tokens,omitempty"`
 	Threshold   float32 `json:"threshold,omitempty"`
+	// Sampling, see the Llama* constants for defaults. Fields left to zero,
+	// or nil, take the defaults.
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopK             int      `json:"top_k,omitempty"`
+	TopP             float32  `json:"top_p,omitempty"`
+	MinP             float32  `json:"min_p,omitempty"`
+	TypicalP         float32  `json:"typical_p,omitempty"`
+	Predict          int      `json:"n_predict,omitempty"`
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	NKeep            int      `json:"n_keep,omitempty"`
+	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Grammar          string   `json:"grammar,omitempty"`
+	// JsonSchema constrains the answer to JSON following the schema.
+	// Answers are validated against it when stream is false.
+	JsonSchema json.RawMessage `json:"json_schema,omitempty"`
+	// Agent lets the model call tools (search included) for up to MaxSteps steps
+	Agent    bool `json:"agent,omitempty"`
+	MaxSteps int  `json:"max_steps,omitempty"`
+	// Mirostat is disabled unless set to 1 or 2
+	Mirostat    int     `json:"mirostat,omitempty"`
+	MirostatTau float32 `json:"mirostat_tau,omitempty"`
+	MirostatEta float32 `json:"mirostat_eta,omitempty"`
+
+	// set: the fields, by json name, the request sets rather than leaving
+	// them to the defaults of the engine and of the model
+	set map[string]bool
+}
+
+// UnmarshalJSON records the fields the request names
+func (er *EngineCompletionRequest) UnmarshalJSON(data []byte) error {
+	type plain EngineCompletionRequest
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, (*plain)(er)); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	// null leaves a field to its default, as if not named
+	for name, value := range fields {
+		if string(value) != "null" {
+			er.markSet(name)
+		}
+	}
+
+	return nil
+}
+
+func (er *EngineCompletionRequest) markSet(name string) {
+	if er.set == nil {
+		er.set = make(map[string]bool)
+	}
+	er.set[name] = true
+}
+
+// WithThreshold sets the score threshold, even to the engine default
+func (er *EngineCompletionRequest) WithThreshold(threshold float32) *EngineCompletionRequest {
+	er.Threshold = threshold
+	er.markSet("threshold")
+	return er
+}
+
+// WithTemperature sets the temperature, even to the engine default
+func (er *EngineCompletionRequest) WithTemperature(temperature float32) *EngineCompletionRequest {
+	er.Temperature = &temperature
+	er.markSet("temperature")
+	return er
+}
+
+// WithTopK sets top_k, even to the engine default
+func (er *EngineCompletionRequest) WithTopK(topk int) *EngineCompletionRequest {
+	er.TopK = topk
+	er.markSet("top_k")
+	return er
+}
+
+// WithTopP sets top_p, even to the engine default
+func (er *EngineCompletionRequest) WithTopP(topp float32) *EngineCompletionRequest {
+	er.TopP = topp
+	er.markSet("top_p")
+	return er
+}
+
+// WithPredict sets n_predict, even to the engine default
+func (er *EngineCompletionRequest) WithPredict(predict int) *EngineCompletionRequest {
+	er.Predict = predict
+	er.markSet("n_predict")
+	return er
+}
+
+// WithCachePrompt enables or disables prompt caching, which setting
+// CachePrompt to false does not
+func (er *EngineCompletionRequest) WithCachePrompt(cache bool) *EngineCompletionRequest {
+	er.CachePrompt = cache
+	er.markSet("cache_prompt")
+	return er
+}
+
+// trackSetFields marks as set the fields of a request built in Go that are
+// neither zero nor left to the values of NewEngineCompletionRequest
+func (er *EngineCompletionRequest) trackSetFields() error {
+	fields, err := getJsonFields(er)
+	if err != nil {
+		return err
+	}
+
+	defaults, err := getJsonFields(NewEngineCompletionRequest())
+	if err != nil {
+		return err
+	}
+
+	for name, value := range fields {
+		if !bytes.Equal(value, defaults[name]) {
+			er.markSet(name)
+		}
+	}
+
+	return nil
+}
+
+// getJsonFields returns the fields v is marshaled with, by name
+func getJsonFields(v any) (fields map[string]json.RawMessage, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// withDefaults returns a copy of er, the fields it does not set being
+// those of defaults
+func (er *EngineCompletionRequest) withDefaults(defaults *EngineCompletionRequest) *EngineCompletionRequest {
+	result := *er
+
+	setDefault(er.set["cache_prompt"], &result.CachePrompt, defaults.CachePrompt)
+	setDefault(er.set["threshold"], &result.Threshold, defaults.Threshold)
+	setDefault(er.set["temperature"], &result.Temperature, defaults.Temperature)
+	setDefault(er.set["top_k"], &result.TopK, defaults.TopK)
+	setDefault(er.set["top_p"], &result.TopP, defaults.TopP)
+	setDefault(er.set["min_p"], &result.MinP, defaults.MinP)
+	setDefault(er.set["typical_p"], &result.TypicalP, defaults.TypicalP)
+	setDefault(er.set["n_predict"], &result.Predict, defaults.Predict)
+	setDefault(er.set["max_tokens"], &result.MaxTokens, defaults.MaxTokens)
+	setDefault(er.set["n_keep"], &result.NKeep, defaults.NKeep)
+	setDefault(er.set["repeat_penalty"], &result.RepeatPenalty, defaults.RepeatPenalty)
+	setDefault(er.set["repeat_last_n"], &result.RepeatLastN, defaults.RepeatLastN)
+	setDefault(er.set["mirostat"], &result.Mirostat, defaults.Mirostat)
+	setDefault(er.set["mirostat_tau"], &result.MirostatTau, defaults.MirostatTau)
+	setDefault(er.set["mirostat_eta"], &result.MirostatEta, defaults.MirostatEta)
+
+	return &result
+}
+
+func setDefault[T any](set bool, field *T, value T) {
+	if !set {
+		*field = value
+	}
+}
+
+type EngineCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type EngineSource struct {
+	Id       string  `json:"id"`
+	Score    float32 `json:"score"`
+	Source   string  `json:"source"`
+	Document string  `json:"document,omitempty"`
+}
+
+// EngineUpstreamsJson: state of every llama server, sent by /admin/upstreams
+type EngineUpstreamsJson struct {
+	Llama  []LlamaUpstreamStatus            `json:"llama"`
+	Embed  []LlamaUpstreamStatus            `json:"embed"`
+	Models map[string][]LlamaUpstreamStatus `json:"models,omitempty"`
+}
+
+// EngineCompletionResponse: the answer sent when stream is false
+type EngineCompletionResponse struct {
+	Status       EngineResponseJson    `json:"result"`
+	Content      string                `json:"content"`
+	FinishReason string                `json:"finish_reason"`
+	Model        string                `json:"model"`
+	Usage        EngineCompletionUsage `json:"usage"`
+	Sources      []EngineSource        `json:"sources"`
+	Cached       bool                  `json:"cached,omitempty"`
+	// Output: the parsed answer, when a JSON schema was given
+	Output json.RawMessage `json:"output,omitempty"`
+	// Steps: the tool calls made in agent mode
+	Steps []EngineToolEvent `json:"steps,omitempty"`
 }
 
 func NewEngineCompletionRequest() *EngineCompletionRequest {
+	temperature := LlamaDefaultTemperature
+
 	return &EngineCompletionRequest{
-		Temperature: LlamaDefaultTemperature,
-		Stream:      true,
-		TopK:        LlamaDefaultTopK,
-		TopP:        LlamaDefaultTopP,
-		Predict:     LlamaDefaultNPredict,
-		CachePrompt: true,
-		Threshold:   QdrantDefaultThreshold,
+		Temperature:   &temperature,
+		Stream:        true,
+		TopK:          LlamaDefaultTopK,
+		TopP:          LlamaDefaultTopP,
+		MinP:          LlamaDefaultMinP,
+		TypicalP:      LlamaDefaultTypicalP,
+		Predict:       LlamaDefaultNPredict,
+		NKeep:         LlamaDefaultNKeep,
+		RepeatPenalty: LlamaDefaultRepeatPenalty,
+		RepeatLastN:   LlamaDefaultRepeatLastN,
+		Mirostat:      LlamaMirostatMode,
+		MirostatTau:   GoRagMirostatTau,
+		MirostatEta:   GoRagMirostatEta,
+		CachePrompt:   true,
+		Threshold:     QdrantDefaultThreshold,
 	}
 }
 
@@ -67,12 +326,34 @@ type EngineOptions struct {
 	LlamaServer string
 }
 
+// qdrantPoint: a single point retrieved from qdrant
+type qdrantPoint struct {
+	Id       string
+	Score    float32
+	Source   string
+	Document string
+}
+
 type GoRagEngine struct {
 	ServerUrl    string
 	QdrantClient *qdrant.Client
 	LlamaClient  *LlamaEngine
+	Embedder     Embedder
 	// privates
-	qdrantLimit int64
+	qdrantLimit   int64
+	threshold     float32
+	embedPrefixes EmbedPrefixes
+	models        *EngineModelRegistry
+	limits        EngineSamplingLimits
+	agentMaxSteps int
+	httpTools     []EngineHttpTool
+	prompts       EnginePrompts
+	embedCache    *EmbeddingCache
+	answerCache   *AnswerCache
+	apiKeys       map[string]EngineApiKey
+	jwt           *engineJwtValidator
+	live          *engineLive
+	drainTimeout  time.Duration
 }
 
 func init() {
@@ -80,10 +361,16 @@ func init() {
 
 func NewEngine() (e *GoRagEngine) {
 	return &GoRagEngine{
-		QdrantClient: nil,
-		ServerUrl:    "",
-		LlamaClient:  nil,
-		qdrantLimit:  -1,
+		QdrantClient:  nil,
+		ServerUrl:     "",
+		LlamaClient:   nil,
+		qdrantLimit:   -1,
+		threshold:     QdrantDefaultThreshold,
+		limits:        NewEngineSamplingLimits(),
+		agentMaxSteps: EngineDefaultAgentSteps,
+		prompts:       NewEnginePrompts(),
+		live:          &engineLive{},
+		drainTimeout:  EngineDefaultDrainTimeout,
 	}
 }
 
@@ -125,7 +412,7 @@ func (e *GoRagEngine) WithLlamaServer(url string) *GoRagEngine {
 		e.LlamaClient = NewLlamaEngine("", "")
 	}
 
-	e.LlamaClient.LlamaServer = url
+	e.LlamaClient.WithLlamaServer(url)
 
 	return e
 }
@@ -135,7 +422,93 @@ func (e *GoRagEngine) WithEmbedServer(url string) *GoRagEngine {
 		e.LlamaClient = NewLlamaEngine("", "")
 	}
 
-	e.LlamaClient.EmbedServer = url
+	e.LlamaClient.WithEmbedServer(url)
+
+	if e.Embedder == nil {
+		e.Embedder = NewLlamaEmbedder(e.LlamaClient)
+	}
+
+	return e
+}
+
+// WithEmbedder replaces the embedding servers of LlamaClient as the source of embeddings
+func (e *GoRagEngine) WithEmbedder(embedder Embedder) *GoRagEngine {
+	e.Embedder = embedder
+	return e
+}
+
+// WithEmbedPrefixes sets the prefixes of queries and documents, for
+// instruction tuned embedding models
+func (e *GoRagEngine) WithEmbedPrefixes(prefixes EmbedPrefixes) *GoRagEngine {
+	e.embedPrefixes = prefixes
+	return e
+}
+
+func (e *GoRagEngine) WithLlamaClientOptions(options LlamaClientOptions) *GoRagEngine {
+	if e.LlamaClient == nil {
+		e.LlamaClient = NewLlamaEngine("", "")
+	}
+
+	e.LlamaClient.WithClientOptions(options)
+
+	return e
+}
+
+// WithSamplingLimits sets the clamps applied to client sampling parameters
+func (e *GoRagEngine) WithSamplingLimits(limits EngineSamplingLimits) *GoRagEngine {
+	e.limits = limits
+	return e
+}
+
+// WithAgent sets the highest number of steps of agent mode, and the user
+// tools offered besides the built in ones
+func (e *GoRagEngine) WithAgent(maxSteps int, tools []EngineHttpTool) *GoRagEngine {
+	e.agentMaxSteps = maxSteps
+	e.httpTools = tools
+	return e
+}
+
+// WithPrompts sets the prompt templates, empty ones keep the built in prompts
+func (e *GoRagEngine) WithPrompts(prompts EnginePrompts) *GoRagEngine {
+	e.prompts = prompts.Merge(NewEnginePrompts())
+	return e
+}
+
+// WithModels registers the generation models requests may ask for
+func (e *GoRagEngine) WithModels(registry *EngineModelRegistry) *GoRagEngine {
+	if e.LlamaClient == nil {
+		e.LlamaClient = NewLlamaEngine("", "")
+	}
+
+	e.models = registry
+	if registry == nil {
+		return e
+	}
+
+	for _, name := range registry.Names() {
+		log.Printf("[GoRagEngine] model '%s': %s\n", name, registry.Models[name].Servers)
+		e.LlamaClient.WithModelServer(name, registry.Models[name].Servers)
+	}
+
+	return e
+}
+
+// WithEmbedCache enables the embedding cache; a size of 0 disables it
+func (e *GoRagEngine) WithEmbedCache(size int, ttl time.Duration, path string) *GoRagEngine {
+	e.embedCache = nil
+	if size > 0 {
+		e.embedCache = NewEmbeddingCache(size, ttl, path)
+	}
+
+	return e
+}
+
+// WithAnswerCache enables the semantic answer cache; a size of 0 disables it
+func (e *GoRagEngine) WithAnswerCache(size int, similarity float64, ttl time.Duration) *GoRagEngine {
+	e.answerCache = nil
+	if size > 0 {
+		e.answerCache = NewAnswerCache(size, similarity, ttl)
+	}
 
 	return e
 }
@@ -145,6 +518,12 @@ func (e *GoRagEngine) WithListenUrl(url string) *GoRagEngine {
 	return e
 }
 
+// WithDrainTimeout sets how long Shutdown waits for in-flight requests
+func (e *GoRagEngine) WithDrainTimeout(timeout time.Duration) *GoRagEngine {
+	e.drainTimeout = timeout
+	return e
+}
+
 // ------------------------------------------------------------------------
 // ------------------------------------------------------------------------
 
@@ -171,26 +550,159 @@ func (e *GoRagEngine) Setup(options EngineOptions) (err error) {
 	}
 
 	e.LlamaClient = NewLlamaEngine(options.EmbedServer, options.LlamaServer)
+	e.Embedder = NewLlamaEmbedder(e.LlamaClient)
 	e.ServerUrl = options.ServerUri
 
 	return nil
 }
 
 func (e *GoRagEngine) ListenAndServe() (err error) {
-	http.HandleFunc("/api/embedding", e.handleEmbedding)
-	http.HandleFunc("/api/completion", e.handleCompletion)
+	server := &http.Server{
+		Addr:    e.ServerUrl,
+		Handler: e.Handler(),
+	}
+	e.live.server.Store(server)
+
+	if current := e.current(); len(current.apiKeys) == 0 && current.jwt == nil {
+		log.Printf("[GoRagEngine::ListenAndServe] no api keys nor jwks configured, the API is open\n")
+	}
 
 	fmt.Printf("[gorag] Listening on '%s'...\n", e.ServerUrl)
 
-	return http.ListenAndServe(e.ServerUrl, nil)
+	// Shutdown makes ListenAndServe return at once, not once drained
+	if err = server.ListenAndServe(); errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
 }
 
+// Shutdown stops accepting connections, then waits for in-flight requests,
+// streamed answers included, to finish. Those still running after the drain
+// timeout, or once ctx is done, are cut.
+func (e *GoRagEngine) Shutdown(ctx context.Context) (err error) {
+	server := e.live.server.Load()
+	if server == nil {
+		return nil
+	}
+
+	if e.drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.drainTimeout)
+		defer cancel()
+	}
+
+	log.Printf("[GoRagEngine::Shutdown] draining for at most %s\n", e.drainTimeout)
+
+	if err = server.Shutdown(ctx); err != nil {
+		log.Printf("[GoRagEngine::Shutdown] drain interrupted: %s\n", err.Error())
+		return server.Close()
+	}
+
+	log.Printf("[GoRagEngine::Shutdown] drained\n")
+
+	return nil
+}
+
+// Finalize releases the clients, once the server is shut down: upstreams
+// first, then the embed cache they filled, then qdrant.
 func (e *GoRagEngine) Finalize() {
+	e = e.current()
+
+	if e.LlamaClient != nil {
+		e.LlamaClient.Close()
+	}
+
+	if e.embedCache != nil {
+		if err := e.embedCache.Save(); err != nil {
+			log.Printf("[GoRagEngine::Finalize] could not save embed cache: %s\n", err.Error())
+		}
+	}
+
 	if e.QdrantClient != nil {
-		e.QdrantClient.Close()
+		if err := e.QdrantClient.Close(); err != nil {
+			log.Printf("[GoRagEngine::Finalize] could not close qdrant client: %s\n", err.Error())
+		}
 	}
 }
 
+// getEmbeddings prefixes inputs according to kind, then goes through the
+// embedding cache, when enabled, and only asks the embedder for the inputs
+// it does not know about.
+func (e *GoRagEngine) getEmbeddings(
+	ctx context.Context,
+	kind string,
+	inputs []string) (embeds *llamaEmbeddings, err error) {
+	var missing []string = make([]string, 0, len(inputs))
+	var missingIdx []int = make([]int, 0, len(inputs))
+
+	if e.Embedder == nil {
+		return nil, &LlamaError{Kind: ErrUpstreamUnavailable, Message: "no embedder configured"}
+	}
+
+	inputs = e.embedPrefixes.Apply(kind, inputs)
+	embeds = &llamaEmbeddings{
+		Embeddings: make([][]float32, len(inputs)),
+	}
+
+	// Until the embedder answered, or when its model is not configured,
+	// the model of the cached entries is assumed: should the embedder
+	// report another one, everything is embedded again below
+	model := e.Embedder.Model()
+	if len(model) == 0 && e.embedCache != nil {
+		model = e.embedCache.Model()
+	}
+
+	for i, input := range inputs {
+		if e.embedCache != nil && len(model) > 0 {
+			if embedding, found := e.embedCache.Get(model, kind, input); found {
+				embeds.Embeddings[i] = embedding
+				continue
+			}
+		}
+
+		missing = append(missing, input)
+		missingIdx = append(missingIdx, i)
+	}
+
+	embeds.Model = model
+	if len(missing) == 0 {
+		return embeds, nil
+	}
+
+	fetched, err := e.Embedder.Embed(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	embeds.Model = e.Embedder.Model()
+	if len(missing) < len(inputs) && embeds.Model != model {
+		// The embed model changed meanwhile: cached vectors are of the
+		// previous one, and must not be mixed with the new ones
+		log.Printf("[GoRagEngine::getEmbeddings] embed model changed from '%s' to '%s'\n", model, embeds.Model)
+
+		missing, missingIdx = inputs, make([]int, len(inputs))
+		for i := range missingIdx {
+			missingIdx[i] = i
+		}
+
+		if fetched, err = e.Embedder.Embed(ctx, missing); err != nil {
+			return nil, err
+		}
+		embeds.Model = e.Embedder.Model()
+	}
+
+	for i, embedding := range fetched {
+		embeds.Embeddings[missingIdx[i]] = embedding
+
+		if e.embedCache != nil {
+			e.embedCache.Put(embeds.Model, kind, missing[i], embedding)
+		}
+	}
+
+	return embeds, nil
+}
+
 func (e *GoRagEngine) getCollectionFromModel(model string) string {
 
 	extpos := strings.LastIndex(model, ".")
@@ -208,13 +720,47 @@ func (e *GoRagEngine) getCollectionFromModel(model string) string {
 }
 
 // Private methods / http handlers
+
+// withRequestId makes sure every response carries a X-Request-Id header,
+// reusing the one sent by the client when present.
+func (e *GoRagEngine) withRequestId(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(EngineRequestIdHeader)
+		if len(requestId) == 0 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			requestId = hex.EncodeToString(b)
+		}
+
+		resp.Header().Set(EngineRequestIdHeader, requestId)
+		handler(resp, req)
+	}
+}
+
 func (e *GoRagEngine) sendResponseError(err string, resp http.ResponseWriter) {
+	e.sendResponseErrorStatus(http.StatusInternalServerError, EngineErrorCodeInternal, err, resp)
+}
+
+// sendBadRequest answers validation errors
+func (e *GoRagEngine) sendBadRequest(err string, resp http.ResponseWriter) {
+	e.sendResponseErrorStatus(http.StatusBadRequest, EngineErrorCodeInvalidRequest, err, resp)
+}
+
+// sendUpstreamError answers with the status code matching an upstream error
+func (e *GoRagEngine) sendUpstreamError(err error, resp http.ResponseWriter) {
+	e.sendResponseErrorStatus(getErrorHttpStatus(err), getErrorCode(err), err.Error(), resp)
+}
+
+func (e *GoRagEngine) sendResponseErrorStatus(status int, code string, err string, resp http.ResponseWriter) {
 	var v EngineResponseJson = EngineResponseJson{
-		Status:  "error",
-		Message: err,
+		Status:    "error",
+		Message:   err,
+		Code:      code,
+		RequestId: resp.Header().Get(EngineRequestIdHeader),
 	}
 
-	resp.WriteHeader(http.StatusInternalServerError)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
 
 	if b, err := json.Marshal(v); err == nil {
 		resp.Write(b)
@@ -223,14 +769,10 @@ func (e *GoRagEngine) sendResponseError(err string, resp http.ResponseWriter) {
 
 func (e *GoRagEngine) handleEmbedding(resp http.ResponseWriter, req *http.Request) {
 	var embedJson EmbedRequestJson
-	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusNotFound)
-		return
-	}
 
 	reqBytes, err := io.ReadAll(req.Body)
 	if err != nil {
-		e.sendResponseError("could not read request data", resp)
+		e.sendBadRequest("could not read request data", resp)
 		return
 	}
 
@@ -238,15 +780,29 @@ func (e *GoRagEngine) handleEmbedding(resp http.ResponseWriter, req *http.Reques
 
 	err = json.Unmarshal(reqBytes, &embedJson)
 	if err != nil {
-		e.sendResponseError(err.Error(), resp)
+		e.sendBadRequest(err.Error(), resp)
+		return
+	}
+
+	if !embedJson.Input.IsValid() {
+		e.sendBadRequest("no valid input provided", resp)
+		return
+	}
+
+	switch embedJson.Kind {
+	case "":
+		embedJson.Kind = EmbedKindDocument
+	case EmbedKindDocument, EmbedKindQuery:
+	default:
+		e.sendBadRequest("'kind' must be 'document' or 'query'", resp)
 		return
 	}
 
 	log.Printf("[handleEmbedding] got json '%v'\n", embedJson)
 
-	embeds, err := e.LlamaClient.GetEmbeddings(embedJson.Input)
+	embeds, err := e.getEmbeddings(req.Context(), embedJson.Kind, embedJson.Input)
 	if err != nil {
-		e.sendResponseError(err.Error(), resp)
+		e.sendUpstreamError(err, resp)
 		return
 	}
 
@@ -258,6 +814,7 @@ func (e *GoRagEngine) handleEmbedding(resp http.ResponseWriter, req *http.Reques
 			Status:  "success",
 			Message: "embeddings retrieved",
 		},
+		Model:      embeds.Model,
 		Embeddings: make([][]float32, embedsLen),
 	}
 
@@ -265,118 +822,511 @@ func (e *GoRagEngine) handleEmbedding(resp http.ResponseWriter, req *http.Reques
 		erj.Embeddings[i] = embed
 	}
 
+	if embedsLen > 0 {
+		erj.Dimension = len(embeds.Embeddings[0])
+	}
+
 	erjBytes, err := json.Marshal(erj)
 	if err != nil {
 		e.sendResponseError(err.Error(), resp)
 		return
 	}
 
-	resp.Header().Add("Content-Type", "application/json")
+	resp.Header().Set("Content-Type", "application/json")
 	written, err := resp.Write(erjBytes)
 	if err != nil {
-		e.sendResponseError(err.Error(), resp)
+		log.Printf("[handleEmbedding] error while writing response: %s\n", err.Error())
 		return
 	}
 
 	log.Printf("/api/embeddings: sent %d bytes to client\n", written)
 }
 
+func (e *GoRagEngine) handleAdminUpstreams(resp http.ResponseWriter, req *http.Request) {
+	status := EngineUpstreamsJson{
+		Llama: e.LlamaClient.LlamaServers.Status(),
+		Embed: e.LlamaClient.EmbedServers.Status(),
+	}
+
+	if len(e.LlamaClient.ModelServers) > 0 {
+		status.Models = make(map[string][]LlamaUpstreamStatus)
+		for name, pool := range e.LlamaClient.ModelServers {
+			status.Models[name] = pool.Status()
+		}
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+func (e *GoRagEngine) handleAdminEmbedCache(resp http.ResponseWriter, req *http.Request) {
+	var stats EmbedCacheStats
+	if e.embedCache != nil {
+		stats = e.embedCache.Stats()
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+func (e *GoRagEngine) handleAdminAnswerCache(resp http.ResponseWriter, req *http.Request) {
+	var stats AnswerCacheStats
+	if e.answerCache != nil {
+		stats = e.answerCache.Stats()
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
+// handleAdminAnswerCacheInvalidate is meant to be called by indexing
+// pipelines once a collection was re-indexed.
+func (e *GoRagEngine) handleAdminAnswerCacheInvalidate(resp http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Collection string `json:"collection"`
+	}
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		e.sendBadRequest("could not read request data", resp)
+		return
+	}
+
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &v); err != nil {
+			e.sendBadRequest(err.Error(), resp)
+			return
+		}
+	}
+
+	var removed int
+	if e.answerCache != nil {
+		removed = e.answerCache.Invalidate(v.Collection)
+	}
+
+	b, err := json.Marshal(EngineResponseJson{
+		Status:  "success",
+		Message: fmt.Sprintf("%d answers invalidated", removed),
+	})
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
+
 func (e *GoRagEngine) handleCompletion(resp http.ResponseWriter, req *http.Request) {
 	var er *EngineCompletionRequest = NewEngineCompletionRequest()
-	var lcr *llamaCompletionRequest
 
-	resp.Header().Add("Access-Control-Allow-Headers", "authorization, content-type")
-	resp.WriteHeader(http.StatusOK)
+	er.Threshold = e.threshold
 
 	data, err := io.ReadAll(req.Body)
 	if err != nil {
-		e.sendResponseError(err.Error(), resp)
+		e.sendBadRequest("could not read request data", resp)
 		return
 	}
 
 	if err = json.Unmarshal(data, &er); err != nil {
-		e.sendResponseError(err.Error(), resp)
+		e.sendBadRequest(err.Error(), resp)
 		return
 	}
 
 	if len(er.Prompt) == 0 {
-		e.sendResponseError("no valid input provided", resp)
+		e.sendBadRequest("no valid input provided", resp)
 		return
 	}
 
-	// Get points from qdrant
-	points, err := e.getQdrantPoints(er.Prompt, er.Threshold)
+	if err = er.Validate(); err != nil {
+		e.sendBadRequest(err.Error(), resp)
+		return
+	}
+
+	if !er.Stream {
+		ecr, err := e.complete(req.Context(), er, nil)
+		if err != nil {
+			log.Printf("[handleCompletion] completion error: %s\n", err.Error())
+			e.sendUpstreamError(err, resp)
+			return
+		}
+
+		ecrBytes, err := json.Marshal(ecr)
+		if err != nil {
+			e.sendResponseError(err.Error(), resp)
+			return
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		written, err := resp.Write(ecrBytes)
+		if err != nil {
+			log.Printf("[handleCompletion] error while writing response: %s\n", err.Error())
+			return
+		}
+
+		log.Printf("/api/completion: sent %d bytes to client\n", written)
+		return
+	}
+
+	events, err := newEngineEventWriter(resp)
 	if err != nil {
 		e.sendResponseError(err.Error(), resp)
 		return
 	}
 
+	if _, err = e.complete(req.Context(), er, events.Send); err != nil {
+		log.Printf("[handleCompletion] completion error: %s\n", err.Error())
+
+		if !events.Started() {
+			e.sendUpstreamError(err, resp)
+			return
+		}
+
+		events.Send(EngineEventError, EngineErrorEvent{
+			Code:    getErrorCode(err),
+			Status:  getErrorHttpStatus(err),
+			Message: err.Error(),
+		})
+	}
+}
+
+// complete answers er. Without a callback, the whole answer is returned at
+// once; otherwise its events are sent to callback as they come, the answer
+// being returned once done.
+func (e *GoRagEngine) complete(
+	ctx context.Context,
+	er *EngineCompletionRequest,
+	callback EngineEventCallback) (ecr *EngineCompletionResponse, err error) {
+
+	// The model decides which tools to call, retrieval included
+	if er.Agent {
+		return e.completeAgent(ctx, er, callback)
+	}
+
+	embeds, err := e.getEmbeddings(ctx, EmbedKindQuery, []string{er.Prompt})
+	if err != nil {
+		return nil, err
+	}
+
+	collection := er.Collection
+	if len(collection) == 0 {
+		collection = e.getCollectionFromModel(embeds.Model)
+	}
+
+	if _, err = getAccessFilter(ctx, collection); err != nil {
+		return nil, err
+	}
+
+	er, err = e.resolveCompletionRequest(er, collection)
+	if err != nil {
+		return nil, newBadRequestError(err)
+	}
+
+	// Maybe a close enough question was already answered
+	var cacheKey *answerCacheKey
+	if e.answerCache != nil && len(embeds.Embeddings) > 0 {
+		cacheKey = &answerCacheKey{
+			Scope:     e.getAnswerCacheScope(ctx, collection, er),
+			Embedding: embeds.Embeddings[0],
+		}
+
+		if answer, found := e.answerCache.Get(*cacheKey); found {
+			return e.replayCachedAnswer(answer, callback)
+		}
+	}
+
+	// Get points from qdrant
+	points, err := e.searchQdrantPoints(ctx, collection, embeds, er.Threshold)
+	if err != nil {
+		return nil, err
+	}
+
 	var messages []llamaCompletionMessage = make([]llamaCompletionMessage, 0)
-	messages = LlamaAppendRequestMessage(messages, LlamaRoleSystem, LlamaRagSystemPrompt)
+	messages = LlamaAppendRequestMessage(messages, LlamaRoleSystem, e.prompts.System)
 
 	if len(points) > 0 {
-		var context string = strings.Join(points, "\n")
+		var context string = e.getContextFromPoints(points)
 
 		// Create a efficient prompt to send the context along with the user's query
 		messages = LlamaAppendRequestMessage(messages, LlamaRoleUser, er.Prompt)
-		messages = LlamaAppendRequestMessage(messages, LlamaRoleAssistant, LlamaRagAssistantPrompt)
+		messages = LlamaAppendRequestMessage(messages, LlamaRoleAssistant, e.prompts.Assistant)
 		messages = LlamaAppendRequestMessage(messages, LlamaRoleUser, fmt.Sprintf("Context: %s", context))
 	} else {
 		messages = LlamaAppendRequestMessage(messages, LlamaRoleUser, er.Prompt)
 	}
 
-	// Configure extra parameters for llamaCompletionRequest
+	if len(er.JsonSchema) > 0 {
+		messages = LlamaAppendRequestMessage(messages, LlamaRoleSystem,
+			fmt.Sprintf("%s\n%s", e.prompts.JsonSchema, string(er.JsonSchema)))
+	}
+
+	lcr := e.newLlamaCompletionRequest(er, messages)
+
+	log.Printf("[GoRagEngine::complete] getting completion for: %+v\n", lcr)
+
+	var content strings.Builder
+	var started bool
+
+	ecr = &EngineCompletionResponse{
+		Status: EngineResponseJson{
+			Status:  "success",
+			Message: "completion retrieved",
+		},
+		Sources: e.getSourcesFromPoints(points),
+	}
+
+	err = e.LlamaClient.GetCompletions(ctx, lcr, func(chunk *LlamaCompletionStream) error {
+		if callback != nil && !started {
+			started = true
+			if err := callback(EngineEventSources, EngineSourcesEvent{Sources: ecr.Sources}); err != nil {
+				return err
+			}
+		}
+
+		ecr.Model = chunk.Model
+		if reason := chunk.FinishReason(); len(reason) > 0 {
+			ecr.FinishReason = reason
+		}
+
+		if token := chunk.Content(); len(token) > 0 {
+			content.WriteString(token)
+			if callback != nil {
+				if err := callback(EngineEventToken, EngineTokenEvent{Content: token}); err != nil {
+					return err
+				}
+			}
+		}
+
+		if chunk.Usage != nil {
+			ecr.Usage = EngineCompletionUsage(*chunk.Usage)
+			if callback != nil {
+				return callback(EngineEventUsage, EngineUsageEvent{Usage: ecr.Usage})
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ecr.Content = content.String()
+
+	// Grammars make the answer follow the schema, unless it was cut short.
+	// Streamed answers were already sent, they are left to the client.
+	if len(lcr.JsonSchema) > 0 && callback == nil {
+		schema, err := parseJsonSchema(lcr.JsonSchema)
+		if err == nil {
+			_, err = schema.ValidateJson(ecr.Content)
+		}
+
+		if err != nil {
+			log.Printf("[GoRagEngine::complete] invalid structured answer: %s\n", err.Error())
+			return nil, &LlamaError{Kind: ErrInvalidOutput, Message: err.Error()}
+		}
+
+		ecr.Output = json.RawMessage(ecr.Content)
+	}
+
+	if callback != nil {
+		callback(EngineEventDone, EngineDoneEvent{
+			FinishReason: ecr.FinishReason,
+			Model:        ecr.Model,
+		})
+	}
+
+	if cacheKey != nil {
+		e.answerCache.Put(*cacheKey, *ecr)
+	}
+
+	return ecr, nil
+}
+
+// replayCachedAnswer returns an answer from the answer cache, sending it
+// to callback, when set, as the events of a stream.
+func (e *GoRagEngine) replayCachedAnswer(
+	answer *EngineCompletionResponse,
+	callback EngineEventCallback) (*EngineCompletionResponse, error) {
+
+	answer.Cached = true
+
+	if callback == nil {
+		return answer, nil
+	}
+
+	if err := callback(EngineEventSources, EngineSourcesEvent{Sources: answer.Sources}); err != nil {
+		return nil, err
+	}
+
+	for _, token := range strings.SplitAfter(answer.Content, " ") {
+		if err := callback(EngineEventToken, EngineTokenEvent{Content: token}); err != nil {
+			return nil, err
+		}
+	}
+
+	callback(EngineEventUsage, EngineUsageEvent{Usage: answer.Usage})
+	callback(EngineEventDone, EngineDoneEvent{
+		FinishReason: answer.FinishReason,
+		Model:        answer.Model,
+		Cached:       true,
+	})
+
+	return answer, nil
+}
+
+// resolveCompletionRequest picks the model of er, then lets the fields er
+// sets override the defaults of that model and of the engine.
+func (e *GoRagEngine) resolveCompletionRequest(
+	er *EngineCompletionRequest,
+	collection string) (result *EngineCompletionRequest, err error) {
+
+	model, err := e.models.Resolve(er.Model, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := e.models.NewCompletionRequest(model)
+	defaults.Threshold = e.threshold
+
+	result = er.withDefaults(defaults)
+	result.Model = model
+
+	if err = result.Validate(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// newLlamaCompletionRequest configures the llama request of er, within the sampling limits
+func (e *GoRagEngine) newLlamaCompletionRequest(
+	er *EngineCompletionRequest,
+	messages []llamaCompletionMessage) (lcr *llamaCompletionRequest) {
+
+	temperature := LlamaDefaultTemperature
+	if er.Temperature != nil {
+		temperature = *er.Temperature
+	}
+
+	seed := LlamaDefaultSeed
+	if er.Seed != nil {
+		seed = *er.Seed
+	}
+
 	lcr = NewCompletionRequest().
+		WithModel(er.Model).
 		WithMessages(messages).
 		WithTopK(er.TopK).
 		WithTopP(er.TopP).
+		WithMinP(er.MinP).
+		WithTypicalP(er.TypicalP).
 		WithNPredict(er.Predict).
+		WithNKeep(er.NKeep).
 		WithStream(er.Stream).
-		WithTemperature(er.Temperature).
+		WithTemperature(temperature).
+		WithRepeatPenalty(er.RepeatPenalty, er.RepeatLastN).
+		WithPenalties(er.PresencePenalty, er.FrequencyPenalty).
+		WithMirostat(er.Mirostat, er.MirostatTau, er.MirostatEta).
+		WithSeed(seed).
+		WithStop(er.Stop).
+		WithGrammar(er.Grammar).
+		WithJsonSchema(er.JsonSchema).
 		WithCachePrompt(er.CachePrompt).
 		WithMaxTokens(er.MaxTokens)
 
-	log.Printf("[handleCompletion] getting completion for: %+v\n", lcr)
+	e.limits.Clamp(lcr)
 
-	flusher, ok := resp.(http.Flusher)
-	if !ok {
-		e.sendResponseError("response cannot send Server Side Events", resp)
-		return
+	return lcr
+}
+
+// getAnswerCacheScope: answers are only shared between requests searching
+// the same collection, with the same filters, access restrictions included,
+// prompt template, grammar or schema and model.
+func (e *GoRagEngine) getAnswerCacheScope(
+	ctx context.Context,
+	collection string,
+	er *EngineCompletionRequest) answerCacheScope {
+
+	filters := fmt.Sprintf("threshold=%.4f,limit=%d,%s", er.Threshold, e.qdrantLimit, getAccessScope(ctx))
+
+	return answerCacheScope{
+		Collection: collection,
+		Model:      er.Model,
+		Filters:    filters,
+		Template:   getTemplateHash(e.prompts.System, e.prompts.Assistant, er.Grammar, string(er.JsonSchema)),
 	}
+}
 
-	// Make sure our response write adds the correct headers for text/event-stream
-	resp.Header().Add("content-type", "text/event-stream")
-	resp.Header().Add("cache-control", "no-cache")
-	resp.Header().Add("connection", "keep-alive")
-	resp.Header().Add("transfer-encoding", "chunked")
-	resp.Header().Add("keep-alive", "timeout=5, max=100")
+func getPointIdString(id *qdrant.PointId) string {
+	if uuid := id.GetUuid(); len(uuid) > 0 {
+		return uuid
+	}
 
-	err = e.LlamaClient.GetCompletions(lcr, func(data string) error {
-		_, err = fmt.Fprint(resp, data)
-		flusher.Flush()
+	return strconv.FormatUint(id.GetNum(), 10)
+}
 
-		if err != nil {
-			log.Printf("handleCompletion: error while writing response: %s\n", err.Error())
-			return err
+func (e *GoRagEngine) getSourcesFromPoints(points []qdrantPoint) []EngineSource {
+	var sources []EngineSource = make([]EngineSource, len(points))
+
+	for i, point := range points {
+		sources[i] = EngineSource{
+			Id:       point.Id,
+			Score:    point.Score,
+			Source:   point.Source,
+			Document: point.Document,
 		}
+	}
 
-		return nil
-	})
+	return sources
 }
 
-func (e *GoRagEngine) getQdrantPoints(input string, threshold float32) (data []string, err error) {
-	data = make([]string, 0)
+// getContextFromPoints joins the retrieved points into the context sent to llama
+func (e *GoRagEngine) getContextFromPoints(points []qdrantPoint) string {
+	var inputs []string = make([]string, len(points))
 
-	log.Printf("[getQdrantPoints] getting embeds from llama.\n")
+	for i, point := range points {
+		inputs[i] = point.Source
+		if len(point.Document) > 0 {
+			inputs[i] = fmt.Sprintf("%s\n\n(References: %s)", point.Source, point.Document)
+		}
+	}
+
+	return strings.Join(inputs, "\n")
+}
+
+// searchQdrantPoints looks for the points of collection closest to embeds
+func (e *GoRagEngine) searchQdrantPoints(
+	ctx context.Context,
+	collection string,
+	embeds *llamaEmbeddings,
+	threshold float32) (data []qdrantPoint, err error) {
+	data = make([]qdrantPoint, 0)
 
-	embeds, err := e.LlamaClient.GetEmbeddings(input)
+	// Whatever the caller may not see never leaves qdrant
+	access, err := getAccessFilter(ctx, collection)
 	if err != nil {
-		log.Printf("[getQdrantPoints] embeds error: %s\n", err.Error())
 		return nil, err
 	}
 
-	collection := e.getCollectionFromModel(embeds.Model)
-
 	log.Printf("[getQdrantPoints] using collection: '%s'\n", collection)
 	log.Printf("[getQdrantPoints] using qdrant limit: %d\n", e.qdrantLimit)
 	log.Printf("[getQdrantPoints] using score threshold: %.2f\n", threshold)
@@ -391,8 +1341,12 @@ func (e *GoRagEngine) getQdrantPoints(input string, threshold float32) (data []s
 			WithPayload:    qdrant.NewWithPayloadEnable(true),
 		}
 
+		if len(access) > 0 {
+			queryPoints.Filter = &qdrant.Filter{Must: access}
+		}
+
 		if e.qdrantLimit > 0 {
-			log.Printf("[getQdrantPoints] limiting qdrant search to %u results.\n", e.qdrantLimit)
+			log.Printf("[getQdrantPoints] limiting qdrant search to %d results.\n", e.qdrantLimit)
 			limit := uint64(e.qdrantLimit)
 			queryPoints.Limit = &limit
 		}
@@ -401,10 +1355,15 @@ func (e *GoRagEngine) getQdrantPoints(input string, threshold float32) (data []s
 			queryPoints.ScoreThreshold = qdrant.PtrOf(threshold)
 		}
 
-		sp, err := e.QdrantClient.Query(context.Background(), queryPoints)
+		sp, err := e.QdrantClient.Query(ctx, queryPoints)
 
 		if err != nil {
 			log.Printf("[getQdrantPoints] qdrant error: %s\n", err.Error())
+
+			// Client went away (or deadline hit): no point in going on
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			continue
 		}
 
@@ -429,12 +1388,17 @@ func (e *GoRagEngine) getQdrantPoints(input string, threshold float32) (data []s
 				continue
 			}
 
-			input := source.GetStringValue()
+			qp := qdrantPoint{
+				Id:     getPointIdString(point.Id),
+				Score:  point.Score,
+				Source: source.GetStringValue(),
+			}
+
 			if document != nil {
-				input = fmt.Sprintf("%s\n\n(References: %s)", input, document.GetStringValue())
+				qp.Document = document.GetStringValue()
 			}
 
-			data = append(data, input)
+			data = append(data, qp)
 		}
 	}
 
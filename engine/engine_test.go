@@ -0,0 +1,471 @@
+package gorag_engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEmbedModel: the model of testLlama embeddings, stored in testCollection
+const (
+	testEmbedModel string = "nomic-embed.gguf"
+	testCollection string = "nomic-embed"
+)
+
+// testLlama: a fake llama.cpp server, embedding texts with testEmbedding
+// and answering completions with canned chunks
+type testLlama struct {
+	url string
+
+	mu sync.Mutex
+	// stream: the data of the chunks of streamed answers, [DONE] excluded
+	stream []string
+	// streams: answers used in turn, before stream, by streamed requests
+	streams [][]string
+	// completion: the body of answers not streamed
+	completion string
+	// completions: the payloads of the completion requests received
+	completions []map[string]any
+	// embedded: the inputs of the embedding requests received
+	embedded [][]string
+}
+
+func newTestLlama() *testLlama {
+	return &testLlama{
+		stream: []string{
+			`{"model":"chat.gguf","choices":[{"delta":{"content":"hel"}}]}`,
+			`{"model":"chat.gguf","choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+			`{"model":"chat.gguf","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		},
+		completion: `{"model":"chat.gguf","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hello"}}],` +
+			`"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+	}
+}
+
+func (l *testLlama) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var payload map[string]any
+
+	data, _ := io.ReadAll(req.Body)
+	json.Unmarshal(data, &payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/v1/embeddings":
+		var er struct {
+			Input []string `json:"input"`
+		}
+		json.Unmarshal(data, &er)
+		l.embedded = append(l.embedded, er.Input)
+
+		type embedding struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		}
+
+		embeddings := make([]embedding, len(er.Input))
+		for i, input := range er.Input {
+			embeddings[i] = embedding{Index: i, Embedding: testEmbedding(input)}
+		}
+
+		json.NewEncoder(resp).Encode(map[string]any{"model": testEmbedModel, "data": embeddings})
+
+	case "/v1/chat/completions":
+		l.completions = append(l.completions, payload)
+
+		if stream, _ := payload["stream"].(bool); !stream {
+			resp.Write([]byte(l.completion))
+			return
+		}
+
+		chunks := l.stream
+		if len(l.streams) > 0 {
+			chunks, l.streams = l.streams[0], l.streams[1:]
+		}
+
+		resp.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(resp, "data: %s\n\n", chunk)
+		}
+		fmt.Fprintf(resp, "data: [DONE]\n\n")
+
+	case "/health":
+		resp.Write([]byte(`{"status":"ok"}`))
+
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// lastCompletion returns the payload of the last completion request
+func (l *testLlama) lastCompletion() map[string]any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.completions) == 0 {
+		return nil
+	}
+
+	return l.completions[len(l.completions)-1]
+}
+
+// newTestEngine returns an engine using a testLlama for completions and
+// embeddings, and a testQdrant
+func newTestEngine(t *testing.T) (*GoRagEngine, *testLlama, *testQdrant) {
+	llama := newTestLlama()
+
+	server := httptest.NewServer(llama)
+	t.Cleanup(server.Close)
+	llama.url = server.URL
+
+	q, client := newTestQdrant(t)
+
+	options := NewLlamaClientOptions()
+	options.HealthInterval = 0
+	options.MaxRetries = 0
+
+	e := NewEngine().
+		WithLlamaClientOptions(options).
+		WithLlamaServer(server.URL).
+		WithEmbedServer(server.URL)
+	e.QdrantClient = client
+	t.Cleanup(e.Finalize)
+
+	return e, llama, q
+}
+
+// ingestTestDocuments stores documents of text through e, as given
+func ingestTestDocuments(t *testing.T, e *GoRagEngine, texts map[string]string) {
+	var ir EngineIngestRequest
+	for name, text := range texts {
+		ir.Documents = append(ir.Documents, EngineDocument{Name: name, Text: text})
+	}
+
+	if _, err := e.Ingest(context.Background(), ir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEvent: an event read from a text/event-stream
+type testEvent struct {
+	Name string
+	Data string
+}
+
+// readTestEvents reads the named events of an SSE body
+func readTestEvents(t *testing.T, body io.Reader) (events []testEvent) {
+	var event testEvent
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = strings.TrimPrefix(line, "data: ")
+		case len(line) == 0 && len(event.Name) > 0:
+			events = append(events, event)
+			event = testEvent{}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+// postTestJson posts body to path of e, and returns the recorded response
+func postTestJson(e *GoRagEngine, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestCompletionStreamError(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunk   string
+		code    string
+		status  int
+		message string
+	}{
+		{
+			name:    "context too long",
+			chunk:   `{"error":{"code":400,"type":"exceed_context_size_error","message":"request exceeds the context size"}}`,
+			code:    EngineErrorCodeContextTooLong,
+			status:  http.StatusRequestEntityTooLarge,
+			message: "context size",
+		},
+		{
+			name:    "server error",
+			chunk:   `{"error":{"code":500,"message":"out of memory"}}`,
+			code:    EngineErrorCodeUpstreamUnavailable,
+			status:  http.StatusBadGateway,
+			message: "out of memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+			llama.stream = []string{
+				`{"model":"chat.gguf","choices":[{"delta":{"content":"hel"}}]}`,
+				tt.chunk,
+			}
+
+			resp := postTestJson(e, "/api/v1/completion", `{"prompt":"hello","stream":true}`)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200: %s", resp.Code, resp.Body)
+			}
+
+			events := readTestEvents(t, resp.Body)
+			if len(events) == 0 || events[len(events)-1].Name != EngineEventError {
+				t.Fatalf("got events %v, want an error last", events)
+			}
+
+			var ee EngineErrorEvent
+			if err := json.Unmarshal([]byte(events[len(events)-1].Data), &ee); err != nil {
+				t.Fatal(err)
+			}
+
+			if ee.Code != tt.code || ee.Status != tt.status || !strings.Contains(ee.Message, tt.message) {
+				t.Fatalf("got %+v, want code %s, status %d and '%s'", ee, tt.code, tt.status, tt.message)
+			}
+		})
+	}
+}
+
+func TestCompletionJson(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		sources []string
+	}{
+		{"with sources", "gorag stores its vectors", []string{"guide"}},
+		{"without sources", "bake a cake", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _, _ := newTestEngine(t)
+			ingestTestDocuments(t, e, map[string]string{"guide": "gorag stores its vectors in qdrant"})
+
+			// The upstream answer is streamed, then put together
+			resp := postTestJson(e, "/api/v1/completion", `{"prompt":"`+tt.prompt+`","stream":false}`)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200: %s", resp.Code, resp.Body)
+			}
+
+			if contentType := resp.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Fatalf("got content type '%s'", contentType)
+			}
+
+			var ecr EngineCompletionResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &ecr); err != nil {
+				t.Fatal(err)
+			}
+
+			if ecr.Content != "hello" || ecr.FinishReason != "stop" || ecr.Model != "chat.gguf" {
+				t.Fatalf("got %+v", ecr)
+			}
+
+			if ecr.Usage != (EngineCompletionUsage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}) {
+				t.Fatalf("got usage %+v", ecr.Usage)
+			}
+
+			var sources []string
+			for _, source := range ecr.Sources {
+				sources = append(sources, source.Document)
+			}
+
+			if !slices.Equal(sources, tt.sources) {
+				t.Fatalf("got sources %v, want %v", sources, tt.sources)
+			}
+		})
+	}
+}
+
+func TestCompletionEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []string
+		events []string
+		tokens []string
+		done   EngineDoneEvent
+	}{
+		{
+			name:   "tokens then usage",
+			events: []string{EngineEventSources, EngineEventToken, EngineEventToken, EngineEventUsage, EngineEventDone},
+			tokens: []string{"hel", "lo"},
+			done:   EngineDoneEvent{FinishReason: "stop", Model: "chat.gguf"},
+		},
+		{
+			name: "empty deltas",
+			stream: []string{
+				`{"model":"chat.gguf","choices":[{"delta":{"role":"assistant"}}]}`,
+				`{"model":"chat.gguf","choices":[{"delta":{"content":"hello"}}]}`,
+				`{"model":"chat.gguf","choices":[{"delta":{},"finish_reason":"length"}]}`,
+			},
+			events: []string{EngineEventSources, EngineEventToken, EngineEventDone},
+			tokens: []string{"hello"},
+			done:   EngineDoneEvent{FinishReason: "length", Model: "chat.gguf"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+			if tt.stream != nil {
+				llama.stream = tt.stream
+			}
+
+			resp := postTestJson(e, "/api/v1/completion", `{"prompt":"hello"}`)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("got status %d, want 200: %s", resp.Code, resp.Body)
+			}
+
+			if contentType := resp.Header().Get("Content-Type"); contentType != "text/event-stream" {
+				t.Fatalf("got content type '%s'", contentType)
+			}
+
+			var names, tokens []string
+			var done EngineDoneEvent
+
+			for _, event := range readTestEvents(t, resp.Body) {
+				names = append(names, event.Name)
+
+				switch event.Name {
+				case EngineEventToken:
+					var token EngineTokenEvent
+					json.Unmarshal([]byte(event.Data), &token)
+					tokens = append(tokens, token.Content)
+				case EngineEventDone:
+					json.Unmarshal([]byte(event.Data), &done)
+				}
+			}
+
+			if !slices.Equal(names, tt.events) {
+				t.Fatalf("got events %v, want %v", names, tt.events)
+			}
+
+			if !slices.Equal(tokens, tt.tokens) {
+				t.Fatalf("got tokens %q, want %q", tokens, tt.tokens)
+			}
+
+			if done != tt.done {
+				t.Fatalf("got done %+v, want %+v", done, tt.done)
+			}
+		})
+	}
+}
+
+// Shutdown lets streamed answers finish within the drain timeout, and cuts
+// the ones taking longer
+func TestShutdownDrainsStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		drain   time.Duration
+		release time.Duration
+		done    bool
+	}{
+		{"drained", 5 * time.Second, 50 * time.Millisecond, true},
+		{"drain timeout", 50 * time.Millisecond, time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _, _ := newTestEngine(t)
+			e.WithDrainTimeout(tt.drain)
+
+			// Sends a token, then the rest of the answer once released
+			release := make(chan struct{})
+			slow := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				resp.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprintf(resp, "data: %s\n\n", `{"model":"chat.gguf","choices":[{"delta":{"content":"hel"}}]}`)
+				resp.(http.Flusher).Flush()
+
+				select {
+				case <-release:
+				case <-req.Context().Done():
+					return
+				}
+
+				fmt.Fprintf(resp, "data: %s\n\n", `{"model":"chat.gguf","choices":[{"delta":{"content":"lo"},"finish_reason":"stop"}]}`)
+				fmt.Fprintf(resp, "data: [DONE]\n\n")
+			}))
+			defer slow.Close()
+			e.WithLlamaServer(slow.URL)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.ServerUrl = listener.Addr().String()
+			listener.Close()
+
+			served := make(chan error, 1)
+			go func() { served <- e.ListenAndServe() }()
+
+			var resp *http.Response
+			for range 100 {
+				resp, err = http.Post("http://"+e.ServerUrl+"/api/v1/completion", "application/json",
+					strings.NewReader(`{"prompt":"hello"}`))
+				if err == nil {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// The stream started: sources, then the first token
+			reader := bufio.NewReader(resp.Body)
+			for line := ""; !strings.Contains(line, "hel"); {
+				if line, err = reader.ReadString('\n'); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- e.Shutdown(context.Background()) }()
+
+			time.Sleep(20 * time.Millisecond)
+			if _, err = http.Get("http://" + e.ServerUrl + "/api/v1/admin/upstreams"); err == nil {
+				t.Fatalf("new request served while shutting down")
+			}
+
+			time.AfterFunc(tt.release, func() { close(release) })
+
+			rest, _ := io.ReadAll(reader)
+			if done := strings.Contains(string(rest), "event: "+EngineEventDone); done != tt.done {
+				t.Fatalf("stream done %v, want %v: %s", done, tt.done, rest)
+			}
+
+			if err = <-served; err != nil {
+				t.Fatalf("ListenAndServe: %s", err)
+			}
+			<-shutdown
+		})
+	}
+}
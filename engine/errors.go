@@ -0,0 +1,207 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Error codes sent to clients in EngineResponseJson
+const (
+	EngineErrorCodeInvalidRequest      string = "invalid_request"
+	EngineErrorCodeContextTooLong      string = "context_too_long"
+	EngineErrorCodeModelLoading        string = "model_loading"
+	EngineErrorCodeUpstreamUnavailable string = "upstream_unavailable"
+	EngineErrorCodeUpstreamTimeout     string = "upstream_timeout"
+	EngineErrorCodeUpstreamBusy        string = "upstream_busy"
+	EngineErrorCodeInvalidOutput       string = "invalid_output"
+	EngineErrorCodeMethodNotAllowed    string = "method_not_allowed"
+	EngineErrorCodeUnauthorized        string = "unauthorized"
+	EngineErrorCodeForbidden           string = "forbidden"
+	EngineErrorCodeInternal            string = "internal_error"
+)
+
+// Errors returned by LlamaEngine. Use errors.Is to test against them.
+var (
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrUpstreamTimeout     = errors.New("upstream timeout")
+	ErrUpstreamBusy        = errors.New("upstream busy")
+	ErrBadRequest          = errors.New("bad request")
+	ErrContextTooLong      = errors.New("context too long")
+	ErrModelLoading        = errors.New("model loading")
+	ErrInvalidOutput       = errors.New("invalid output")
+	ErrForbidden           = errors.New("forbidden")
+)
+
+// LlamaError: an error reported by (or while talking to) a llama server
+type LlamaError struct {
+	Kind       error
+	StatusCode int
+	Message    string
+}
+
+func (e *LlamaError) Error() string {
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("%s (%d): %s", e.Kind.Error(), e.StatusCode, e.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Kind.Error(), e.Message)
+}
+
+func (e *LlamaError) Unwrap() error {
+	return e.Kind
+}
+
+// HttpStatus returns the status code gorag should answer with
+func (e *LlamaError) HttpStatus() int {
+	switch e.Kind {
+	case ErrBadRequest:
+		return http.StatusBadRequest
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrContextTooLong:
+		return http.StatusRequestEntityTooLarge
+	case ErrModelLoading, ErrUpstreamBusy:
+		return http.StatusServiceUnavailable
+	case ErrUpstreamTimeout:
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// Code returns the error code sent in error responses
+func (e *LlamaError) Code() string {
+	switch e.Kind {
+	case ErrBadRequest:
+		return EngineErrorCodeInvalidRequest
+	case ErrContextTooLong:
+		return EngineErrorCodeContextTooLong
+	case ErrModelLoading:
+		return EngineErrorCodeModelLoading
+	case ErrUpstreamTimeout:
+		return EngineErrorCodeUpstreamTimeout
+	case ErrUpstreamBusy:
+		return EngineErrorCodeUpstreamBusy
+	case ErrInvalidOutput:
+		return EngineErrorCodeInvalidOutput
+	case ErrForbidden:
+		return EngineErrorCodeForbidden
+	}
+
+	return EngineErrorCodeUpstreamUnavailable
+}
+
+func newLlamaUnavailableError(err error) *LlamaError {
+	var ne net.Error
+
+	le := &LlamaError{
+		Kind:    ErrUpstreamUnavailable,
+		Message: err.Error(),
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		le.Kind = ErrUpstreamTimeout
+	}
+
+	return le
+}
+
+// newBadRequestError wraps an invalid request, for it to be answered with 400
+func newBadRequestError(err error) *LlamaError {
+	return &LlamaError{
+		Kind:    ErrBadRequest,
+		Message: err.Error(),
+	}
+}
+
+// newLlamaError classifies an llama.cpp error, either from a non 200
+// response or from an "error" object found in a stream chunk.
+func newLlamaError(status int, lce *LlamaCompletionError) *LlamaError {
+	le := &LlamaError{
+		Kind:       ErrUpstreamUnavailable,
+		StatusCode: status,
+		Message:    http.StatusText(status),
+	}
+
+	if lce != nil {
+		le.Message = lce.Message
+		if lce.Code > 0 && status == 0 {
+			le.StatusCode = lce.Code
+		}
+	}
+
+	message := strings.ToLower(le.Message)
+
+	switch {
+	case lce != nil && lce.Type == "exceed_context_size_error",
+		strings.Contains(message, "context size"),
+		strings.Contains(message, "context length"):
+		le.Kind = ErrContextTooLong
+	case strings.Contains(message, "loading model"):
+		le.Kind = ErrModelLoading
+	case le.StatusCode == http.StatusTooManyRequests:
+		le.Kind = ErrUpstreamBusy
+	case le.StatusCode == http.StatusUnauthorized, le.StatusCode == http.StatusForbidden:
+		// Credentials of the server are gorag's business, not the client's
+		le.Kind = ErrUpstreamUnavailable
+	case le.StatusCode >= 400 && le.StatusCode < 500:
+		le.Kind = ErrBadRequest
+	}
+
+	return le
+}
+
+// newLlamaErrorFromBody builds a LlamaError from a non 200 response body
+func newLlamaErrorFromBody(status int, body []byte) *LlamaError {
+	var v struct {
+		Error *LlamaCompletionError `json:"error"`
+	}
+
+	// Ollama sends errors as {"error": "message"}
+	var o struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &o); err == nil && len(o.Error) > 0 {
+		return newLlamaError(status, &LlamaCompletionError{Message: o.Error})
+	}
+
+	if err := json.Unmarshal(body, &v); err != nil || v.Error == nil {
+		if len(body) == 0 {
+			return newLlamaError(status, nil)
+		}
+
+		v.Error = &LlamaCompletionError{
+			Message: strings.TrimSpace(string(body)),
+		}
+	}
+
+	return newLlamaError(status, v.Error)
+}
+
+// getErrorHttpStatus maps any error returned by the engine to a status code
+func getErrorHttpStatus(err error) int {
+	var le *LlamaError
+
+	if errors.As(err, &le) {
+		return le.HttpStatus()
+	}
+
+	return http.StatusInternalServerError
+}
+
+// getErrorCode maps any error returned by the engine to an error code
+func getErrorCode(err error) string {
+	var le *LlamaError
+
+	if errors.As(err, &le) {
+		return le.Code()
+	}
+
+	return EngineErrorCodeInternal
+}
@@ -0,0 +1,86 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLlamaErrorFromBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		kind   error
+		http   int
+		code   string
+	}{
+		{"llama.cpp bad request", 400, `{"error":{"code":400,"message":"invalid grammar","type":"invalid_request_error"}}`,
+			ErrBadRequest, http.StatusBadRequest, EngineErrorCodeInvalidRequest},
+		{"context size", 400, `{"error":{"code":400,"message":"too long","type":"exceed_context_size_error"}}`,
+			ErrContextTooLong, http.StatusRequestEntityTooLarge, EngineErrorCodeContextTooLong},
+		{"ollama context length", 400, `{"error":"input exceeds context length"}`,
+			ErrContextTooLong, http.StatusRequestEntityTooLarge, EngineErrorCodeContextTooLong},
+		{"model loading", 503, `{"error":{"code":503,"message":"Loading model"}}`,
+			ErrModelLoading, http.StatusServiceUnavailable, EngineErrorCodeModelLoading},
+		{"rate limited", 429, `{"error":{"message":"rate limit reached"}}`,
+			ErrUpstreamBusy, http.StatusServiceUnavailable, EngineErrorCodeUpstreamBusy},
+		{"bad upstream key", 401, `{"error":{"message":"invalid api key"}}`,
+			ErrUpstreamUnavailable, http.StatusBadGateway, EngineErrorCodeUpstreamUnavailable},
+		{"upstream forbidden", 403, `forbidden`,
+			ErrUpstreamUnavailable, http.StatusBadGateway, EngineErrorCodeUpstreamUnavailable},
+		{"server error", 500, ``,
+			ErrUpstreamUnavailable, http.StatusBadGateway, EngineErrorCodeUpstreamUnavailable},
+		{"plain text", 502, `bad gateway`,
+			ErrUpstreamUnavailable, http.StatusBadGateway, EngineErrorCodeUpstreamUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := newLlamaErrorFromBody(test.status, []byte(test.body))
+
+			if !errors.Is(err, test.kind) {
+				t.Fatalf("got kind %v, want %v", err.Kind, test.kind)
+			}
+
+			if status := getErrorHttpStatus(err); status != test.http {
+				t.Fatalf("got status %d, want %d", status, test.http)
+			}
+
+			if code := getErrorCode(err); code != test.code {
+				t.Fatalf("got code %s, want %s", code, test.code)
+			}
+		})
+	}
+}
+
+func TestErrorHttpStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		http int
+		code string
+	}{
+		{"bad request", newBadRequestError(fmt.Errorf("no prompt")), http.StatusBadRequest, EngineErrorCodeInvalidRequest},
+		{"forbidden", &LlamaError{Kind: ErrForbidden}, http.StatusForbidden, EngineErrorCodeForbidden},
+		{"timeout", newLlamaUnavailableError(context.DeadlineExceeded), http.StatusGatewayTimeout, EngineErrorCodeUpstreamTimeout},
+		{"unavailable", newLlamaUnavailableError(fmt.Errorf("refused")), http.StatusBadGateway, EngineErrorCodeUpstreamUnavailable},
+		{"invalid output", &LlamaError{Kind: ErrInvalidOutput}, http.StatusBadGateway, EngineErrorCodeInvalidOutput},
+		{"wrapped", fmt.Errorf("search: %w", &LlamaError{Kind: ErrForbidden}), http.StatusForbidden, EngineErrorCodeForbidden},
+		{"other", fmt.Errorf("qdrant: down"), http.StatusInternalServerError, EngineErrorCodeInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := getErrorHttpStatus(test.err); status != test.http {
+				t.Fatalf("got status %d, want %d", status, test.http)
+			}
+
+			if code := getErrorCode(test.err); code != test.code {
+				t.Fatalf("got code %s, want %s", code, test.code)
+			}
+		})
+	}
+}
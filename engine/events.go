@@ -0,0 +1,128 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Server Side Events sent by /api/completion
+const (
+	EngineEventToken   string = "token"
+	EngineEventSources string = "sources"
+	EngineEventUsage   string = "usage"
+	EngineEventError   string = "error"
+	EngineEventDone    string = "done"
+	// Agent mode only
+	EngineEventToolCall   string = "tool_call"
+	EngineEventToolResult string = "tool_result"
+)
+
+type EngineTokenEvent struct {
+	Content string `json:"content"`
+}
+
+type EngineSourcesEvent struct {
+	Sources []EngineSource `json:"sources"`
+}
+
+type EngineUsageEvent struct {
+	Usage EngineCompletionUsage `json:"usage"`
+}
+
+// EngineErrorEvent: Code is the one of JSON error responses, Status the
+// HTTP status the error would have been answered with
+type EngineErrorEvent struct {
+	Code    string `json:"code"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// EngineToolEvent: a tool call of the model (tool_call), then its outcome (tool_result)
+type EngineToolEvent struct {
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type EngineDoneEvent struct {
+	FinishReason string `json:"finish_reason"`
+	Model        string `json:"model"`
+	Cached       bool   `json:"cached,omitempty"`
+}
+
+// EngineEventCallback receives the events of a streamed answer, named after
+// the EngineEvent* constants, with the payloads sent to HTTP clients
+type EngineEventCallback func(event string, data any) error
+
+// engineEventWriter writes named events to a text/event-stream response.
+// Nothing is written to the client until the first event is sent, so
+// handlers can still answer with a regular error before that.
+type engineEventWriter struct {
+	resp    http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func newEngineEventWriter(resp http.ResponseWriter) (w *engineEventWriter, err error) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response cannot send Server Side Events")
+	}
+
+	return &engineEventWriter{
+		resp:    resp,
+		flusher: flusher,
+	}, nil
+}
+
+// Started reports whether the stream was already sent to the client
+func (w *engineEventWriter) Started() bool {
+	return w.started
+}
+
+func (w *engineEventWriter) start() {
+	if w.started {
+		return
+	}
+
+	// Make sure our response write adds the correct headers for text/event-stream
+	w.resp.Header().Set("Content-Type", "text/event-stream")
+	w.resp.Header().Set("Cache-Control", "no-cache")
+	w.resp.Header().Set("Connection", "keep-alive")
+	w.resp.WriteHeader(http.StatusOK)
+
+	w.started = true
+}
+
+func (w *engineEventWriter) Send(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.start()
+
+	if _, err = fmt.Fprintf(w.resp, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+
+	w.flusher.Flush()
+
+	return nil
+}
+
+// SendData writes an unnamed event, as used by OpenAI compatible streams
+func (w *engineEventWriter) SendData(data string) error {
+	w.start()
+
+	if _, err := fmt.Fprintf(w.resp, "data: %s\n\n", data); err != nil {
+		return err
+	}
+
+	w.flusher.Flush()
+
+	return nil
+}
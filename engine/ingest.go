@@ -0,0 +1,444 @@
+package gorag_engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+const (
+	// EngineDefaultChunkSize: the size, in characters, of the chunks documents are split in
+	EngineDefaultChunkSize int = 1000
+)
+
+// EngineDocument: a document to ingest, either as a text to split in
+// chunks or as chunks already split by the caller
+type EngineDocument struct {
+	Name   string   `json:"name"`
+	Text   string   `json:"text,omitempty"`
+	Chunks []string `json:"chunks,omitempty"`
+	// Owner and Groups may see the document; without either, the whole
+	// tenant can. Owner defaults to the subject ingesting it; API keys
+	// may set neither.
+	Owner  string   `json:"owner,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// EngineIngestRequest: documents to store in the collection of the embed
+// model. Documents already stored under the same name are replaced.
+type EngineIngestRequest struct {
+	Documents []EngineDocument `json:"documents"`
+	// ChunkSize defaults to EngineDefaultChunkSize
+	ChunkSize int `json:"chunk_size,omitempty"`
+}
+
+// EngineIngestResponse: what an EngineIngestRequest stored
+type EngineIngestResponse struct {
+	Status     EngineResponseJson `json:"result"`
+	Collection string             `json:"collection"`
+	Model      string             `json:"model"`
+	Documents  int                `json:"documents"`
+	Chunks     int                `json:"chunks"`
+}
+
+// Ingest embeds the documents of ir, then stores them in qdrant, along with
+// their ACL. The collection is created on first use. Documents belong to
+// the tenant of the identity of ctx, if any.
+func (e *GoRagEngine) Ingest(ctx context.Context, ir EngineIngestRequest) (*EngineIngestResponse, error) {
+	return e.current().ingest(ctx, ir)
+}
+
+// Validate rejects documents without a name or content
+func (ir *EngineIngestRequest) Validate() error {
+	if len(ir.Documents) == 0 {
+		return fmt.Errorf("no documents provided")
+	}
+
+	if ir.ChunkSize < 0 {
+		return fmt.Errorf("chunk_size must be positive")
+	}
+
+	names := make(map[string]bool, len(ir.Documents))
+	for i, document := range ir.Documents {
+		switch {
+		case len(strings.TrimSpace(document.Name)) == 0:
+			return fmt.Errorf("document %d has no name", i)
+		case names[document.Name]:
+			return fmt.Errorf("document '%s' is given twice", document.Name)
+		case len(strings.TrimSpace(document.Text)) == 0 && len(document.Chunks) == 0:
+			return fmt.Errorf("document '%s' has no content", document.Name)
+		case len(document.Text) > 0 && len(document.Chunks) > 0:
+			return fmt.Errorf("document '%s': 'text' and 'chunks' are mutually exclusive", document.Name)
+		case slices.Contains(document.Groups, ""):
+			return fmt.Errorf("document '%s' has an empty group", document.Name)
+		}
+		names[document.Name] = true
+	}
+
+	return nil
+}
+
+func (e *GoRagEngine) ingest(ctx context.Context, ir EngineIngestRequest) (result *EngineIngestResponse, err error) {
+	if err = ir.Validate(); err != nil {
+		return nil, newBadRequestError(err)
+	}
+
+	if e.QdrantClient == nil {
+		return nil, fmt.Errorf("qdrant: no client configured")
+	}
+
+	size := ir.ChunkSize
+	if size == 0 {
+		size = EngineDefaultChunkSize
+	}
+
+	identity, found := GetRequestIdentity(ctx)
+
+	// Without identity, when the API is open, documents are stored as given
+	documents := slices.Clone(ir.Documents)
+	if found {
+		for i, document := range documents {
+			if documents[i], err = getDocumentAcl(identity, document); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var inputs []string
+	var owners []int
+	for i, document := range documents {
+		chunks := document.Chunks
+		if len(chunks) == 0 {
+			chunks = splitDocument(document.Text, size)
+		}
+
+		for _, chunk := range chunks {
+			if len(strings.TrimSpace(chunk)) == 0 {
+				continue
+			}
+			inputs = append(inputs, chunk)
+			owners = append(owners, i)
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil, newBadRequestError(fmt.Errorf("documents have no content"))
+	}
+
+	embeds, err := e.getEmbeddings(ctx, EmbedKindDocument, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(embeds.Embeddings) != len(inputs) || len(embeds.Embeddings[0]) == 0 {
+		return nil, &LlamaError{Kind: ErrInvalidOutput, Message: "embeddings do not match the chunks sent"}
+	}
+
+	collection := e.getCollectionFromModel(embeds.Model)
+
+	if _, err = getAccessFilter(ctx, collection); err != nil {
+		return nil, err
+	}
+
+	if err = e.ensureCollection(ctx, collection, len(embeds.Embeddings[0])); err != nil {
+		return nil, err
+	}
+
+	// Documents ingested again overwrite the points of their chunks, the
+	// ids being derived from them: the previous chunks are kept until the
+	// new ones are stored, only those past the new count being deleted then
+	points := make([]*qdrant.PointStruct, len(inputs))
+	index := make(map[int]int, len(ir.Documents))
+	for i, input := range inputs {
+		document := documents[owners[i]]
+
+		payload := map[string]any{
+			"source":   input,
+			"document": document.Name,
+			"chunk":    index[owners[i]],
+		}
+
+		if len(identity.Tenant) > 0 {
+			payload["tenant"] = identity.Tenant
+		}
+
+		if len(document.Owner) > 0 {
+			payload["owner"] = document.Owner
+		}
+
+		if len(document.Groups) > 0 {
+			groups := make([]any, len(document.Groups))
+			for j, group := range document.Groups {
+				groups[j] = group
+			}
+			payload["groups"] = groups
+		}
+
+		scope := document.Owner
+		if len(identity.Tenant) > 0 {
+			scope = identity.Tenant + "/" + scope
+		}
+
+		points[i] = &qdrant.PointStruct{
+			Id:      qdrant.NewIDUUID(getChunkId(scope, document.Name, index[owners[i]])),
+			Vectors: qdrant.NewVectors(embeds.Embeddings[i]...),
+			Payload: qdrant.NewValueMap(payload),
+		}
+		index[owners[i]]++
+	}
+
+	_, err = e.QdrantClient.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: collection,
+		Wait:           qdrant.PtrOf(true),
+		Points:         points,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("qdrant: %w", err)
+	}
+
+	// Answers built from the previous chunks are stale from now on
+	defer e.invalidateAnswers(collection)
+
+	for i, document := range documents {
+		stale := getDocumentFilter(identity, document)
+		stale.Must = append(stale.Must, qdrant.NewRange("chunk", &qdrant.Range{Gte: qdrant.PtrOf(float64(index[i]))}))
+
+		_, err = e.QdrantClient.Delete(ctx, &qdrant.DeletePoints{
+			CollectionName: collection,
+			Wait:           qdrant.PtrOf(true),
+			Points:         qdrant.NewPointsSelectorFilter(stale),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("qdrant: %w", err)
+		}
+	}
+
+	log.Printf("[GoRagEngine::ingest] stored %d chunks of %d documents in '%s'\n",
+		len(points), len(ir.Documents), collection)
+
+	return &EngineIngestResponse{
+		Status: EngineResponseJson{
+			Status:  "success",
+			Message: "documents ingested",
+		},
+		Collection: collection,
+		Model:      embeds.Model,
+		Documents:  len(ir.Documents),
+		Chunks:     len(points),
+	}, nil
+}
+
+// getDocumentFilter matches the chunks of document stored by the tenant of
+// identity, for the owner of document, and only those: callers without a
+// tenant only match chunks of no tenant, documents without an owner
+// chunks of no owner.
+func getDocumentFilter(identity EngineIdentity, document EngineDocument) *qdrant.Filter {
+	conditions := []*qdrant.Condition{
+		qdrant.NewMatch("document", document.Name),
+		getTenantCondition(identity),
+	}
+
+	if len(document.Owner) > 0 {
+		conditions = append(conditions, qdrant.NewMatch("owner", document.Owner))
+	} else {
+		conditions = append(conditions, qdrant.NewIsEmpty("owner"))
+	}
+
+	return &qdrant.Filter{Must: conditions}
+}
+
+// invalidateAnswers drops the cached answers of collection, if answers are cached
+func (e *GoRagEngine) invalidateAnswers(collection string) {
+	if e.answerCache != nil {
+		e.answerCache.Invalidate(collection)
+	}
+}
+
+// getDocumentAcl sets who may see document. Subjects only ingest documents
+// of their own, shared with groups they belong to; API keys, which search
+// without a subject, only unowned documents, and tokens without a subject
+// not at all.
+func getDocumentAcl(identity EngineIdentity, document EngineDocument) (EngineDocument, error) {
+	if len(identity.KeyId) > 0 {
+		if len(document.Owner) > 0 || len(document.Groups) > 0 {
+			return document, &LlamaError{
+				Kind:    ErrForbidden,
+				Message: fmt.Sprintf("%s may only ingest documents without owner nor groups", identity),
+			}
+		}
+
+		return document, nil
+	}
+
+	if len(identity.Subject) == 0 {
+		return document, &LlamaError{
+			Kind:    ErrForbidden,
+			Message: "tokens without a subject may not ingest documents",
+		}
+	}
+
+	if len(document.Owner) == 0 {
+		document.Owner = identity.Subject
+	}
+
+	if document.Owner != identity.Subject {
+		return document, &LlamaError{
+			Kind:    ErrForbidden,
+			Message: fmt.Sprintf("%s may not ingest documents of '%s'", identity, document.Owner),
+		}
+	}
+
+	for _, group := range document.Groups {
+		if !slices.Contains(identity.Groups, group) {
+			return document, &LlamaError{
+				Kind:    ErrForbidden,
+				Message: fmt.Sprintf("%s is not a member of group '%s'", identity, group),
+			}
+		}
+	}
+
+	return document, nil
+}
+
+// ensureCollection creates collection, for vectors of size dimensions, unless it exists
+func (e *GoRagEngine) ensureCollection(ctx context.Context, collection string, size int) error {
+	exists, err := e.QdrantClient.CollectionExists(ctx, collection)
+	if err != nil {
+		return fmt.Errorf("qdrant: %w", err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	log.Printf("[GoRagEngine::ensureCollection] creating collection '%s' (%d dimensions)\n", collection, size)
+
+	err = e.QdrantClient.CreateCollection(ctx, &qdrant.CreateCollection{
+		CollectionName: collection,
+		VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
+			Size:     uint64(size),
+			Distance: qdrant.Distance_Cosine,
+		}),
+	})
+	if err != nil {
+		return fmt.Errorf("qdrant: %w", err)
+	}
+
+	return nil
+}
+
+// getChunkId derives the point id of a chunk from its document and the
+// scope (tenant and owner) it belongs to, so that ingesting a document
+// again overwrites its points
+func getChunkId(scope string, document string, index int) string {
+	key := fmt.Sprintf("%s#%d", document, index)
+	if len(scope) > 0 {
+		key = scope + "/" + key
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	// A version 5 like UUID, from the first 16 bytes of the hash
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// splitDocument splits text in chunks of up to size characters, keeping
+// paragraphs together when they fit
+func splitDocument(text string, size int) (chunks []string) {
+	var chunk strings.Builder
+
+	flush := func() {
+		if chunk.Len() > 0 {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+		}
+	}
+
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if len(paragraph) == 0 {
+			continue
+		}
+
+		for _, part := range splitParagraph(paragraph, size) {
+			if chunk.Len() > 0 && len([]rune(chunk.String()))+2+len([]rune(part)) > size {
+				flush()
+			}
+
+			if chunk.Len() > 0 {
+				chunk.WriteString("\n\n")
+			}
+			chunk.WriteString(part)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// splitParagraph cuts a paragraph longer than size characters, at spaces when it can
+func splitParagraph(paragraph string, size int) (parts []string) {
+	runes := []rune(paragraph)
+
+	for len(runes) > size {
+		cut := size
+		for i := size; i > size/2; i-- {
+			if runes[i] == ' ' || runes[i] == '\n' {
+				cut = i
+				break
+			}
+		}
+
+		parts = append(parts, strings.TrimSpace(string(runes[:cut])))
+		runes = []rune(strings.TrimSpace(string(runes[cut:])))
+	}
+
+	if len(runes) > 0 {
+		parts = append(parts, string(runes))
+	}
+
+	return parts
+}
+
+func (e *GoRagEngine) handleIngest(resp http.ResponseWriter, req *http.Request) {
+	var ir EngineIngestRequest
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		e.sendBadRequest("could not read request data", resp)
+		return
+	}
+
+	if err = json.Unmarshal(data, &ir); err != nil {
+		e.sendBadRequest(err.Error(), resp)
+		return
+	}
+
+	result, err := e.ingest(req.Context(), ir)
+	if err != nil {
+		log.Printf("[handleIngest] ingest error: %s\n", err.Error())
+		e.sendUpstreamError(err, resp)
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,157 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDocumentFilterTenant(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity EngineIdentity
+		tenant   string
+		empty    bool
+	}{
+		{"subject", EngineIdentity{Subject: "alice", Tenant: "acme"}, "acme", false},
+		{"api key", EngineIdentity{KeyId: "k1"}, "", true},
+		{"open api", EngineIdentity{}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := getDocumentFilter(test.identity, EngineDocument{Name: "guide"})
+
+			tenant, empty := getTenantOf(t, filter.Must)
+			if tenant != test.tenant || empty != test.empty {
+				t.Fatalf("got tenant '%s' (empty %v), want '%s' (empty %v)", tenant, empty, test.tenant, test.empty)
+			}
+		})
+	}
+}
+
+func TestDocumentAclWithoutSubject(t *testing.T) {
+	rs := newTestRsaKey(t, "rs", "")
+	v := newTestJwtValidator(t, rs)
+
+	identity, err := v.Validate(context.Background(), rs.sign(t, "RS256", newTestClaims(map[string]any{"sub": nil})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = getDocumentAcl(identity, EngineDocument{Name: "guide"}); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("got %v, want a forbidden error", err)
+	}
+}
+
+func TestDocumentAcl(t *testing.T) {
+	alice := EngineIdentity{Subject: "alice", Tenant: "acme", Groups: []string{"staff"}}
+
+	tests := []struct {
+		name     string
+		identity EngineIdentity
+		document EngineDocument
+		owner    string
+		allowed  bool
+	}{
+		{"own document", alice, EngineDocument{Name: "guide"}, "alice", true},
+		{"own group", alice, EngineDocument{Name: "guide", Groups: []string{"staff"}}, "alice", true},
+		{"other owner", alice, EngineDocument{Name: "guide", Owner: "bob"}, "", false},
+		{"other group", alice, EngineDocument{Name: "guide", Groups: []string{"admin"}}, "", false},
+		{"api key", EngineIdentity{KeyId: "k1"}, EngineDocument{Name: "guide"}, "", true},
+		{"api key, owner", EngineIdentity{KeyId: "k1"}, EngineDocument{Name: "guide", Owner: "bob"}, "", false},
+		{"api key, groups", EngineIdentity{KeyId: "k1"}, EngineDocument{Name: "guide", Groups: []string{"staff"}}, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := getDocumentAcl(test.identity, test.document)
+			if !test.allowed {
+				if !errors.Is(err, ErrForbidden) {
+					t.Fatalf("got %v, want a forbidden error", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if document.Owner != test.owner {
+				t.Fatalf("got owner '%s', want '%s'", document.Owner, test.owner)
+			}
+		})
+	}
+}
+
+// Whatever an API key ingests, it finds back
+func TestIngestApiKeySearch(t *testing.T) {
+	e, _, q := newTestEngine(t)
+
+	ctx := WithIdentity(context.Background(), EngineIdentity{KeyId: "k1"})
+
+	ir := EngineIngestRequest{Documents: []EngineDocument{{Name: "guide", Text: "qdrant stores the vectors of gorag"}}}
+	if _, err := e.Ingest(ctx, ir); err != nil {
+		t.Fatal(err)
+	}
+
+	if points := q.points(testCollection); len(points) != 1 {
+		t.Fatalf("got %d points, want 1", len(points))
+	}
+
+	sr, err := e.Search(ctx, EngineSearchRequest{Query: "qdrant stores the vectors"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sr.Sources) != 1 || sr.Sources[0].Document != "guide" {
+		t.Fatalf("got sources %+v, want the guide", sr.Sources)
+	}
+
+	owned := EngineIngestRequest{Documents: []EngineDocument{{Name: "notes", Text: "private notes", Owner: "alice"}}}
+	if _, err = e.Ingest(ctx, owned); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("got %v, want a forbidden error", err)
+	}
+}
+
+// Ingesting a document again replaces its chunks, unless storing the new
+// ones fails, which keeps the previous ones
+func TestIngestReplacesChunks(t *testing.T) {
+	e, _, q := newTestEngine(t)
+
+	ingest := func(chunks ...string) error {
+		_, err := e.Ingest(context.Background(), EngineIngestRequest{
+			Documents: []EngineDocument{{Name: "guide", Chunks: chunks}},
+		})
+		return err
+	}
+
+	getSources := func() (sources []string) {
+		for _, point := range q.points(testCollection) {
+			sources = append(sources, point.Payload["source"].GetStringValue())
+		}
+		return sources
+	}
+
+	if err := ingest("one", "two", "three"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ingest("uno", "dos"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sources := getSources(); !slices.Equal(sources, []string{"uno", "dos"}) {
+		t.Fatalf("got chunks %v, want [uno dos]", sources)
+	}
+
+	q.failUpsert = true
+	if err := ingest("un"); err == nil {
+		t.Fatalf("ingested while qdrant fails")
+	}
+
+	if sources := getSources(); !slices.Equal(sources, []string{"uno", "dos"}) {
+		t.Fatalf("got chunks %v, want [uno dos]", sources)
+	}
+}
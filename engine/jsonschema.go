@@ -0,0 +1,208 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+)
+
+// jsonSchema: a decoded JSON Schema. Only a subset of the keywords is
+// checked server side (type, enum, const, properties, required,
+// additionalProperties, items, min/max for numbers, strings and arrays,
+// pattern); the others are left to the grammar llama.cpp derives from it.
+type jsonSchema map[string]any
+
+// parseJsonSchema decodes raw, which must be a JSON object
+func parseJsonSchema(raw json.RawMessage) (schema jsonSchema, err error) {
+	if err = json.Unmarshal(raw, &schema); err != nil || schema == nil {
+		return nil, fmt.Errorf("'json_schema' must be a JSON object")
+	}
+
+	return schema, nil
+}
+
+// ValidateJson parses data and checks it against the schema
+func (s jsonSchema) ValidateJson(data string) (value any, err error) {
+	if err = json.Unmarshal([]byte(data), &value); err != nil {
+		return nil, fmt.Errorf("answer is not valid JSON: %w", err)
+	}
+
+	if err = s.validate(value, "$"); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (s jsonSchema) validate(value any, path string) error {
+	if types := s.getTypes(); len(types) > 0 {
+		if !slices.ContainsFunc(types, func(t string) bool { return isJsonType(value, t) }) {
+			return fmt.Errorf("%s: expected %v", path, types)
+		}
+	}
+
+	if enum, found := s["enum"].([]any); found {
+		if !slices.ContainsFunc(enum, func(v any) bool { return reflect.DeepEqual(v, value) }) {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+
+	if c, found := s["const"]; found && !reflect.DeepEqual(c, value) {
+		return fmt.Errorf("%s: value differs from const", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return s.validateObject(v, path)
+	case []any:
+		return s.validateArray(v, path)
+	case string:
+		return s.validateString(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	}
+
+	return nil
+}
+
+func (s jsonSchema) validateObject(v map[string]any, path string) error {
+	properties, _ := s["properties"].(map[string]any)
+
+	if required, found := s["required"].([]any); found {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, present := v[name]; !present {
+					return fmt.Errorf("%s: missing property '%s'", path, name)
+				}
+			}
+		}
+	}
+
+	for name, child := range v {
+		if schema, found := properties[name].(map[string]any); found {
+			if err := jsonSchema(schema).validate(child, path+"."+name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if additional, found := s["additionalProperties"]; found {
+			switch a := additional.(type) {
+			case bool:
+				if !a {
+					return fmt.Errorf("%s: unexpected property '%s'", path, name)
+				}
+			case map[string]any:
+				if err := jsonSchema(a).validate(child, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s jsonSchema) validateArray(v []any, path string) error {
+	if n, found := s.getNumber("minItems"); found && float64(len(v)) < n {
+		return fmt.Errorf("%s: expected at least %v items", path, n)
+	}
+
+	if n, found := s.getNumber("maxItems"); found && float64(len(v)) > n {
+		return fmt.Errorf("%s: expected at most %v items", path, n)
+	}
+
+	if items, found := s["items"].(map[string]any); found {
+		for i, item := range v {
+			if err := jsonSchema(items).validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s jsonSchema) validateString(v string, path string) error {
+	length := float64(len([]rune(v)))
+
+	if n, found := s.getNumber("minLength"); found && length < n {
+		return fmt.Errorf("%s: expected at least %v characters", path, n)
+	}
+
+	if n, found := s.getNumber("maxLength"); found && length > n {
+		return fmt.Errorf("%s: expected at most %v characters", path, n)
+	}
+
+	if pattern, found := s["pattern"].(string); found {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(v) {
+			return fmt.Errorf("%s: does not match '%s'", path, pattern)
+		}
+	}
+
+	return nil
+}
+
+func (s jsonSchema) validateNumber(v float64, path string) error {
+	if n, found := s.getNumber("minimum"); found && v < n {
+		return fmt.Errorf("%s: expected at least %v", path, n)
+	}
+
+	if n, found := s.getNumber("maximum"); found && v > n {
+		return fmt.Errorf("%s: expected at most %v", path, n)
+	}
+
+	if n, found := s.getNumber("exclusiveMinimum"); found && v <= n {
+		return fmt.Errorf("%s: expected more than %v", path, n)
+	}
+
+	if n, found := s.getNumber("exclusiveMaximum"); found && v >= n {
+		return fmt.Errorf("%s: expected less than %v", path, n)
+	}
+
+	return nil
+}
+
+// getTypes returns the "type" keyword, either a string or an array
+func (s jsonSchema) getTypes() (types []string) {
+	switch t := s["type"].(type) {
+	case string:
+		types = append(types, t)
+	case []any:
+		for _, v := range t {
+			if name, ok := v.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+
+	return types
+}
+
+func (s jsonSchema) getNumber(keyword string) (n float64, found bool) {
+	n, found = s[keyword].(float64)
+	return n, found
+}
+
+func isJsonType(value any, t string) bool {
+	switch v := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case float64:
+		return t == "number" || (t == "integer" && v == math.Trunc(v))
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testJsonSchema string = `{
+	"type": "object",
+	"required": ["name", "tags"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 2, "pattern": "^[a-z]+$"},
+		"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+		"kind": {"enum": ["user", "admin"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"note": {"type": ["string", "null"]}
+	}
+}`
+
+func TestJsonSchemaValidate(t *testing.T) {
+	schema, err := parseJsonSchema(json.RawMessage(testJsonSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"valid", `{"name":"alice","age":30,"kind":"admin","tags":["a"],"note":null}`, ""},
+		{"not json", `name: alice`, "not valid JSON"},
+		{"wrong type", `["alice"]`, "$: expected [object]"},
+		{"missing property", `{"name":"alice"}`, "missing property 'tags'"},
+		{"unexpected property", `{"name":"alice","tags":[],"email":"a@b"}`, "unexpected property 'email'"},
+		{"string too short", `{"name":"a","tags":[]}`, "$.name: expected at least 2 characters"},
+		{"pattern", `{"name":"Alice","tags":[]}`, "$.name: does not match"},
+		{"not an integer", `{"name":"alice","age":30.5,"tags":[]}`, "$.age: expected [integer]"},
+		{"below minimum", `{"name":"alice","age":-1,"tags":[]}`, "$.age: expected at least 0"},
+		{"exclusive maximum", `{"name":"alice","age":150,"tags":[]}`, "$.age: expected less than 150"},
+		{"not in enum", `{"name":"alice","kind":"root","tags":[]}`, "$.kind: value not in enum"},
+		{"too many items", `{"name":"alice","tags":["a","b","c"]}`, "$.tags: expected at most 2 items"},
+		{"wrong item", `{"name":"alice","tags":["a",1]}`, "$.tags[1]: expected [string]"},
+		{"type list", `{"name":"alice","tags":[],"note":1}`, "$.note: expected [string null]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := schema.ValidateJson(tt.data)
+			if len(tt.error) == 0 && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if len(tt.error) > 0 && (err == nil || !strings.Contains(err.Error(), tt.error)) {
+				t.Fatalf("got %v, want an error about %s", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestParseJsonSchema(t *testing.T) {
+	for _, raw := range []string{`"object"`, `null`, `[]`, `{"type":`} {
+		if _, err := parseJsonSchema(json.RawMessage(raw)); err == nil {
+			t.Fatalf("schema %s accepted", raw)
+		}
+	}
+}
+
+// Answers not streamed are checked against the schema of the request
+func TestCompletionJsonSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []string
+		status int
+	}{
+		{"valid answer", []string{`{"name":`, `"alice","tags":[]}`}, http.StatusOK},
+		{"invalid answer", []string{`{"name":"alice"}`}, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+
+			llama.stream = nil
+			for _, content := range tt.answer {
+				chunk, _ := json.Marshal(map[string]any{
+					"model":   "chat.gguf",
+					"choices": []any{map[string]any{"delta": map[string]any{"content": content}}},
+				})
+				llama.stream = append(llama.stream, string(chunk))
+			}
+
+			resp := postTestJson(e, "/api/v1/completion",
+				`{"prompt":"who am i","stream":false,"json_schema":`+testJsonSchema+`}`)
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if _, found := llama.lastCompletion()["json_schema"]; !found {
+				t.Fatalf("schema not sent upstream")
+			}
+
+			if tt.status != http.StatusOK {
+				var ej EngineResponseJson
+				if err := json.Unmarshal(resp.Body.Bytes(), &ej); err != nil || ej.Code != EngineErrorCodeInvalidOutput {
+					t.Fatalf("got %s, want an %s error", resp.Body, EngineErrorCodeInvalidOutput)
+				}
+				return
+			}
+
+			var ecr EngineCompletionResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &ecr); err != nil {
+				t.Fatal(err)
+			}
+
+			if string(ecr.Output) != strings.Join(tt.answer, "") {
+				t.Fatalf("got output %s", ecr.Output)
+			}
+		})
+	}
+}
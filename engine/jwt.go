@@ -0,0 +1,561 @@
+package gorag_engine
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Time a JWKS fetched from an URL is used before being fetched again
+	EngineDefaultJwksRefresh time.Duration = time.Hour
+	// Clock skew allowed on exp and nbf
+	EngineDefaultJwtLeeway time.Duration = 30 * time.Second
+
+	// An unknown kid fetches the JWKS again, at most this often
+	engineJwksRetry   time.Duration = time.Minute
+	engineJwksTimeout time.Duration = 10 * time.Second
+	// Failed fetches are retried after this delay, doubled on each failure
+	// up to engineJwksRetry
+	engineJwksBackoff time.Duration = time.Second
+)
+
+// EngineJwtClaims: the claims identities are read from. Claims hold a
+// string, or a list given as an array or a space separated string.
+type EngineJwtClaims struct {
+	Tenant      string `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	Collections string `json:"collections,omitempty" yaml:"collections,omitempty"`
+	Scope       string `json:"scope,omitempty" yaml:"scope,omitempty"`
+	Groups      string `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// EngineJwtOptions: how JWTs sent as bearer tokens are validated
+type EngineJwtOptions struct {
+	// Jwks: a JWKS file, or an http(s) URL to fetch it from
+	Jwks     string          `json:"jwks" yaml:"jwks"`
+	Issuer   string          `json:"issuer" yaml:"issuer"`
+	Audience string          `json:"audience" yaml:"audience"`
+	Claims   EngineJwtClaims `json:"claims" yaml:"claims"`
+	// DefaultScopes: the scopes of tokens without a scope claim
+	DefaultScopes []string      `json:"default_scopes,omitempty" yaml:"default-scopes,omitempty"`
+	Leeway        time.Duration `json:"leeway,omitempty" yaml:"leeway,omitempty"`
+	Refresh       time.Duration `json:"refresh,omitempty" yaml:"refresh,omitempty"`
+}
+
+func NewEngineJwtOptions() EngineJwtOptions {
+	return EngineJwtOptions{
+		Claims: EngineJwtClaims{
+			Tenant:      "tenant",
+			Collections: "collections",
+			Scope:       "scope",
+			Groups:      "groups",
+		},
+		DefaultScopes: []string{EngineScopeSearch, EngineScopeComplete},
+		Leeway:        EngineDefaultJwtLeeway,
+		Refresh:       EngineDefaultJwksRefresh,
+	}
+}
+
+// isJwksUrl tells whether the JWKS is fetched rather than read from a file
+func (o *EngineJwtOptions) isJwksUrl() bool {
+	return strings.HasPrefix(o.Jwks, "http://") || strings.HasPrefix(o.Jwks, "https://")
+}
+
+// Validate checks the options, and reads the JWKS when it is a file
+func (o *EngineJwtOptions) Validate() error {
+	switch {
+	case len(o.Jwks) == 0:
+		return fmt.Errorf("jwt: no jwks given")
+	case len(o.Issuer) == 0 || len(o.Audience) == 0:
+		return fmt.Errorf("jwt: issuer and audience are required")
+	case o.Leeway < 0 || o.Refresh < 0:
+		return fmt.Errorf("jwt: leeway and refresh must be positive")
+	}
+
+	for _, scope := range o.DefaultScopes {
+		if !slices.Contains(engineScopes, scope) {
+			return fmt.Errorf("jwt: unknown default scope '%s'", scope)
+		}
+	}
+
+	if o.isJwksUrl() {
+		return nil
+	}
+
+	_, err := loadJwksFile(o.Jwks)
+	return err
+}
+
+// engineJwk: a verification key of a JWKS
+type engineJwk struct {
+	alg string
+	kty string
+	crv string
+	key crypto.PublicKey
+}
+
+// engineJwtAlgorithm: the key type, curve and hash of a signature algorithm
+type engineJwtAlgorithm struct {
+	kty  string
+	crv  string
+	hash crypto.Hash
+}
+
+// engineJwtAlgorithms: the algorithms accepted, asymmetric ones only, so
+// that "none" and HMACs are never accepted
+var engineJwtAlgorithms = map[string]engineJwtAlgorithm{
+	"RS256": {kty: "RSA", hash: crypto.SHA256},
+	"RS384": {kty: "RSA", hash: crypto.SHA384},
+	"RS512": {kty: "RSA", hash: crypto.SHA512},
+	"PS256": {kty: "RSA", hash: crypto.SHA256},
+	"PS384": {kty: "RSA", hash: crypto.SHA384},
+	"PS512": {kty: "RSA", hash: crypto.SHA512},
+	"ES256": {kty: "EC", crv: "P-256", hash: crypto.SHA256},
+	"ES384": {kty: "EC", crv: "P-384", hash: crypto.SHA384},
+	"ES512": {kty: "EC", crv: "P-521", hash: crypto.SHA512},
+	"EdDSA": {kty: "OKP", crv: "Ed25519"},
+}
+
+// engineJwtValidator checks JWTs against the keys of a JWKS
+type engineJwtValidator struct {
+	options EngineJwtOptions
+	client  *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]engineJwk
+	fetched time.Time
+	// failures: fetches failed in a row, the next one waiting until retry
+	failures int
+	retry    time.Time
+	// refreshing is closed once the running fetch, if any, is done
+	refreshing chan struct{}
+}
+
+func newEngineJwtValidator(options EngineJwtOptions) *engineJwtValidator {
+	if options.Refresh == 0 {
+		options.Refresh = EngineDefaultJwksRefresh
+	}
+
+	v := &engineJwtValidator{
+		options: options,
+		client:  &http.Client{Timeout: engineJwksTimeout},
+	}
+
+	if !options.isJwksUrl() {
+		keys, err := loadJwksFile(options.Jwks)
+		if err != nil {
+			// Without keys, every token is rejected
+			log.Printf("[engineJwtValidator] %s\n", err.Error())
+		}
+		v.keys = keys
+	}
+
+	return v
+}
+
+func loadJwksFile(path string) (keys map[string]engineJwk, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	if keys, err = parseJwks(data); err != nil {
+		return nil, fmt.Errorf("jwks '%s': %w", path, err)
+	}
+
+	return keys, nil
+}
+
+// parseJwks reads the signature keys of a JWKS, by kid. Keys of other
+// uses, or of unsupported types, are skipped.
+func parseJwks(data []byte) (keys map[string]engineJwk, err error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys = make(map[string]engineJwk)
+	for _, jwk := range jwks.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				return nil, fmt.Errorf("key '%s': invalid RSA key", jwk.Kid)
+			}
+			key = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			size := (curve.Params().BitSize + 7) / 8
+			if errX != nil || errY != nil || len(x) != size || len(y) != size {
+				return nil, fmt.Errorf("key '%s': invalid EC key", jwk.Kid)
+			}
+
+			if key, err = ecdsa.ParseUncompressedPublicKey(curve, slices.Concat([]byte{4}, x, y)); err != nil {
+				return nil, fmt.Errorf("key '%s': %w", jwk.Kid, err)
+			}
+
+		case "OKP":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" {
+				continue
+			}
+			if errX != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key '%s': invalid Ed25519 key", jwk.Kid)
+			}
+			key = ed25519.PublicKey(x)
+
+		default:
+			continue
+		}
+
+		keys[jwk.Kid] = engineJwk{alg: jwk.Alg, kty: jwk.Kty, crv: jwk.Crv, key: key}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature keys")
+	}
+
+	return keys, nil
+}
+
+// fetchJwks gets the JWKS from its URL
+func (v *engineJwtValidator) fetchJwks(ctx context.Context) (keys map[string]engineJwk, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.options.Jwks, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: %s returned %s", v.options.Jwks, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJwks(data)
+}
+
+// getKey returns the key kid, or the only one when the token names none.
+// JWKS URLs are fetched again once stale, or for an unknown kid.
+func (v *engineJwtValidator) getKey(ctx context.Context, kid string) (jwk engineJwk, err error) {
+	jwk, found, due := v.lookup(kid)
+
+	if due {
+		v.refresh(ctx, !found)
+		jwk, found, _ = v.lookup(kid)
+	}
+
+	if !found {
+		return jwk, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+
+	return jwk, nil
+}
+
+// lookup returns the key kid, and whether the JWKS should be fetched
+// again, unless the last fetch failed too recently
+func (v *engineJwtValidator) lookup(kid string) (jwk engineJwk, found bool, due bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(kid) == 0 && len(v.keys) == 1 {
+		for _, jwk = range v.keys {
+			found = true
+		}
+	} else {
+		jwk, found = v.keys[kid]
+	}
+
+	if !v.options.isJwksUrl() || time.Now().Before(v.retry) {
+		return jwk, found, false
+	}
+
+	since := time.Since(v.fetched)
+
+	return jwk, found, v.keys == nil || since > v.options.Refresh || (!found && since > engineJwksRetry)
+}
+
+// refresh fetches the JWKS, outside of the lock, unless a fetch is already
+// running, which is waited for when wait is set. A failed fetch keeps the
+// last keys, and delays the next one.
+func (v *engineJwtValidator) refresh(ctx context.Context, wait bool) {
+	v.mu.Lock()
+	if done := v.refreshing; done != nil {
+		v.mu.Unlock()
+
+		if wait {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+		}
+		return
+	}
+
+	done := make(chan struct{})
+	v.refreshing = done
+	v.mu.Unlock()
+
+	// Requests waiting for the keys do not fail along with this one
+	keys, err := v.fetchJwks(context.WithoutCancel(ctx))
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err != nil {
+		v.failures++
+		v.retry = time.Now().Add(min(engineJwksBackoff<<min(v.failures-1, 16), engineJwksRetry))
+		log.Printf("[engineJwtValidator::refresh] %s, retrying in %s\n", err.Error(), time.Until(v.retry).Round(time.Second))
+	} else {
+		v.keys = keys
+		v.fetched = time.Now()
+		v.failures = 0
+		v.retry = time.Time{}
+	}
+
+	v.refreshing = nil
+	close(done)
+}
+
+// verifySignature checks the signature of the signed part of a token, the
+// key being of the type and curve of the algorithm
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	algorithm := engineJwtAlgorithms[alg]
+
+	if algorithm.kty == "OKP" {
+		if pub, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(pub, signed, signature) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature")
+	}
+
+	h := algorithm.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(pub, algorithm.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+		return rsa.VerifyPKCS1v15(pub, algorithm.hash, digest, signature)
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(pub, digest, r, s) {
+			return nil
+		}
+		return fmt.Errorf("invalid signature")
+	}
+
+	return fmt.Errorf("algorithm '%s' does not match the key", alg)
+}
+
+// Validate checks the signature, issuer, audience and lifetime of token,
+// then reads the identity of its claims
+func (v *engineJwtValidator) Validate(ctx context.Context, token string) (identity EngineIdentity, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return identity, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err = decodeJwtPart(parts[0], &header); err != nil {
+		return identity, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	algorithm, found := engineJwtAlgorithms[header.Alg]
+	if !found {
+		return identity, fmt.Errorf("unsupported algorithm '%s'", header.Alg)
+	}
+
+	jwk, err := v.getKey(ctx, header.Kid)
+	if err != nil {
+		return identity, err
+	}
+
+	// The key decides the algorithm: its alg when given, its type and curve
+	if (len(jwk.alg) > 0 && jwk.alg != header.Alg) || jwk.kty != algorithm.kty || jwk.crv != algorithm.crv {
+		return identity, fmt.Errorf("algorithm '%s' does not match the key", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return identity, fmt.Errorf("malformed token signature")
+	}
+
+	if err = verifySignature(header.Alg, jwk.key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return identity, err
+	}
+
+	var claims map[string]any
+	if err = decodeJwtPart(parts[1], &claims); err != nil {
+		return identity, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	if err = v.checkClaims(claims, time.Now()); err != nil {
+		return identity, err
+	}
+
+	// Every subject belongs to a tenant, retrieval being restricted to it
+	tenant := getClaimString(claims, v.options.Claims.Tenant)
+	if len(tenant) == 0 {
+		return identity, fmt.Errorf("token has no '%s' claim", v.options.Claims.Tenant)
+	}
+
+	identity = EngineIdentity{
+		Subject:     getClaimString(claims, "sub"),
+		Tenant:      tenant,
+		Collections: getClaimList(claims, v.options.Claims.Collections),
+		Groups:      getClaimList(claims, v.options.Claims.Groups),
+		Scopes:      v.options.DefaultScopes,
+	}
+
+	if _, found := claims[v.options.Claims.Scope]; found {
+		identity.Scopes = nil
+		for _, scope := range getClaimList(claims, v.options.Claims.Scope) {
+			if slices.Contains(engineScopes, scope) {
+				identity.Scopes = append(identity.Scopes, scope)
+			}
+		}
+	}
+
+	return identity, nil
+}
+
+// checkClaims checks iss, aud, exp and nbf at now
+func (v *engineJwtValidator) checkClaims(claims map[string]any, now time.Time) error {
+	if iss := getClaimString(claims, "iss"); iss != v.options.Issuer {
+		return fmt.Errorf("unexpected issuer '%s'", iss)
+	}
+
+	if !slices.Contains(getClaimList(claims, "aud"), v.options.Audience) {
+		return fmt.Errorf("token is not meant for audience '%s'", v.options.Audience)
+	}
+
+	exp, found := getClaimTime(claims, "exp")
+	if !found {
+		return fmt.Errorf("token has no expiry")
+	}
+
+	if now.After(exp.Add(v.options.Leeway)) {
+		return fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+
+	if nbf, found := getClaimTime(claims, "nbf"); found && now.Before(nbf.Add(-v.options.Leeway)) {
+		return fmt.Errorf("token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func decodeJwtPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func getClaimString(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// getClaimList reads a claim holding an array, or a space separated string
+func getClaimList(claims map[string]any, name string) (list []string) {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return list
+}
+
+func getClaimTime(claims map[string]any, name string) (t time.Time, found bool) {
+	seconds, found := claims[name].(float64)
+	if !found {
+		return t, false
+	}
+
+	return time.Unix(int64(seconds), 0), true
+}
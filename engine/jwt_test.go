@@ -0,0 +1,345 @@
+package gorag_engine
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testJwtIssuer   string = "https://issuer.test"
+	testJwtAudience string = "gorag"
+)
+
+// testJwtKey: a signing key, along with its JWK
+type testJwtKey struct {
+	kid string
+	jwk map[string]any
+	key crypto.Signer
+}
+
+func encodeJwtInt(n *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+}
+
+func newTestRsaKey(t *testing.T, kid string, alg string) testJwtKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk := map[string]any{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+
+	if len(alg) > 0 {
+		jwk["alg"] = alg
+	}
+
+	return testJwtKey{kid: kid, key: key, jwk: jwk}
+}
+
+func newTestEcKey(t *testing.T, kid string, curve elliptic.Curve, crv string) testJwtKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	return testJwtKey{kid: kid, key: key, jwk: map[string]any{
+		"kty": "EC",
+		"kid": kid,
+		"crv": crv,
+		"x":   encodeJwtInt(key.X, size),
+		"y":   encodeJwtInt(key.Y, size),
+	}}
+}
+
+func newTestEdKey(t *testing.T, kid string) testJwtKey {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testJwtKey{kid: kid, key: key, jwk: map[string]any{
+		"kty": "OKP",
+		"kid": kid,
+		"crv": "Ed25519",
+		"x":   base64.RawURLEncoding.EncodeToString(pub),
+	}}
+}
+
+// sign returns a token of claims signed by k, with the header alg
+func (k testJwtKey) sign(t *testing.T, alg string, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	algorithm := engineJwtAlgorithms[alg]
+	digest := []byte(signed)
+	var opts crypto.SignerOpts = crypto.Hash(0)
+
+	if algorithm.hash != 0 {
+		h := algorithm.hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+		opts = algorithm.hash
+	}
+
+	if strings.HasPrefix(alg, "PS") {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: algorithm.hash}
+	}
+
+	var signature []byte
+	var err error
+
+	if key, ok := k.key.(*ecdsa.PrivateKey); ok {
+		// JWS wants r || s, not ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	} else if signature, err = k.key.Sign(rand.Reader, digest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestJwtValidator writes a JWKS of keys, then returns a validator reading it
+func newTestJwtValidator(t *testing.T, keys ...testJwtKey) *engineJwtValidator {
+	var jwks struct {
+		Keys []map[string]any `json:"keys"`
+	}
+
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, key.jwk)
+	}
+
+	data, _ := json.Marshal(jwks)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	options := NewEngineJwtOptions()
+	options.Jwks = path
+	options.Issuer = testJwtIssuer
+	options.Audience = testJwtAudience
+
+	if err := options.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return newEngineJwtValidator(options)
+}
+
+func newTestClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":    testJwtIssuer,
+		"aud":    testJwtAudience,
+		"sub":    "alice",
+		"tenant": "acme",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+
+	return claims
+}
+
+func TestJwtValidateAlgorithms(t *testing.T) {
+	rs := newTestRsaKey(t, "rs", "")
+	es256 := newTestEcKey(t, "es256", elliptic.P256(), "P-256")
+	es384 := newTestEcKey(t, "es384", elliptic.P384(), "P-384")
+	ed := newTestEdKey(t, "ed")
+
+	v := newTestJwtValidator(t, rs, es256, es384, ed)
+
+	tests := []struct {
+		name  string
+		key   testJwtKey
+		alg   string
+		valid bool
+	}{
+		{"RS256", rs, "RS256", true},
+		{"RS512", rs, "RS512", true},
+		{"PS256", rs, "PS256", true},
+		{"ES256 on P-256", es256, "ES256", true},
+		{"ES384 on P-384", es384, "ES384", true},
+		{"EdDSA", ed, "EdDSA", true},
+		{"none", rs, "none", false},
+		{"HS256", rs, "HS256", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := v.Validate(context.Background(), test.key.sign(t, test.alg, newTestClaims(nil)))
+			if test.valid && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("accepted")
+			}
+		})
+	}
+}
+
+// A token must not pick a hash or curve other than the ones of its key
+func TestJwtValidateRejectsAlgorithmOfAnotherCurve(t *testing.T) {
+	es384 := newTestEcKey(t, "es384", elliptic.P384(), "P-384")
+	v := newTestJwtValidator(t, es384)
+
+	// Signed with the P-384 key, SHA-256 digest: a valid ECDSA signature
+	// that only ES256 on P-384 would verify
+	token := es384.sign(t, "ES256", newTestClaims(nil))
+	if _, err := v.Validate(context.Background(), token); err == nil {
+		t.Fatalf("ES256 accepted with a P-384 key")
+	}
+}
+
+func TestJwtValidateRejectsAlgorithmOfTheJwk(t *testing.T) {
+	rs := newTestRsaKey(t, "rs", "PS256")
+	v := newTestJwtValidator(t, rs)
+
+	if _, err := v.Validate(context.Background(), rs.sign(t, "PS256", newTestClaims(nil))); err != nil {
+		t.Fatalf("PS256 rejected: %s", err)
+	}
+
+	if _, err := v.Validate(context.Background(), rs.sign(t, "RS256", newTestClaims(nil))); err == nil {
+		t.Fatalf("RS256 accepted with a PS256 key")
+	}
+}
+
+func TestJwtValidateClaims(t *testing.T) {
+	rs := newTestRsaKey(t, "rs", "")
+	v := newTestJwtValidator(t, rs)
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		valid  bool
+	}{
+		{"valid", nil, true},
+		{"no tenant", map[string]any{"tenant": nil}, false},
+		{"empty tenant", map[string]any{"tenant": ""}, false},
+		{"other issuer", map[string]any{"iss": "https://other.test"}, false},
+		{"other audience", map[string]any{"aud": []string{"other"}}, false},
+		{"audience list", map[string]any{"aud": []string{"other", testJwtAudience}}, true},
+		{"no expiry", map[string]any{"exp": nil}, false},
+		{"expired", map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}, false},
+		{"expired within leeway", map[string]any{"exp": time.Now().Add(-10 * time.Second).Unix()}, true},
+		{"not yet valid", map[string]any{"nbf": time.Now().Add(time.Hour).Unix()}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := v.Validate(context.Background(), rs.sign(t, "RS256", newTestClaims(test.claims)))
+			if test.valid && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("accepted")
+			}
+		})
+	}
+}
+
+// A failing JWKS URL is fetched once for concurrent tokens, then not before
+// its backoff, and the last keys it served are kept
+func TestJwtFetchJwks(t *testing.T) {
+	rs := newTestRsaKey(t, "rs", "")
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{rs.jwk}})
+
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond)
+
+		if failing.Load() {
+			http.Error(resp, "down", http.StatusInternalServerError)
+			return
+		}
+		resp.Write(jwks)
+	}))
+	defer server.Close()
+
+	options := NewEngineJwtOptions()
+	options.Jwks = server.URL
+	options.Issuer = testJwtIssuer
+	options.Audience = testJwtAudience
+
+	v := newEngineJwtValidator(options)
+	token := rs.sign(t, "RS256", newTestClaims(nil))
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Validate(context.Background(), token); err == nil {
+				t.Error("accepted without keys")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := v.Validate(context.Background(), token); err == nil {
+		t.Fatalf("accepted without keys")
+	}
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("got %d fetches, want 1", n)
+	}
+
+	// Once the backoff is over, the keys are fetched
+	failing.Store(false)
+	v.retry = time.Time{}
+
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatalf("rejected: %s", err)
+	}
+
+	// Stale keys failing to refresh are still used
+	failing.Store(true)
+	v.fetched = time.Now().Add(-2 * options.Refresh)
+
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatalf("rejected: %s", err)
+	}
+
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("got %d fetches, want 3", n)
+	}
+}
@@ -3,11 +3,15 @@ package gorag_engine
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // Constants
@@ -15,21 +19,32 @@ const (
 	LlamaRoleUser      string = "user"
 	LlamaRoleSystem    string = "system"
 	LlamaRoleAssistant string = "assistant"
-
-	// Constants for llama request
-	LlamaDefaultTemperature float32 = 0.2
-	LlamaDefaultTopK        int     = 40
-	LlamaDefaultTopP        float32 = 0.9
-	LlamaDefaultNPredict    int     = 512
-	LlamaMirostatMode       int     = 1
-	GoRagMirostatTau        float32 = 5.0
-	GoRagMirostatEta        float32 = 0.5
-	GoRagMaxTokens                  = 2048
+	LlamaRoleTool      string = "tool"
+
+	// Constants for llama request. Sampling defaults are the ones of
+	// llama.cpp, unless stated otherwise.
+	LlamaDefaultTemperature   float32 = 0.2 // llama.cpp: 0.8
+	LlamaDefaultTopK          int     = 40
+	LlamaDefaultTopP          float32 = 0.9 // llama.cpp: 0.95
+	LlamaDefaultMinP          float32 = 0.05
+	LlamaDefaultTypicalP      float32 = 1.0 // disabled
+	LlamaDefaultRepeatPenalty float32 = 1.0 // disabled
+	LlamaDefaultRepeatLastN   int     = 64
+	LlamaDefaultSeed          int     = -1 // random
+	LlamaDefaultNPredict      int     = 512
+	LlamaDefaultNKeep         int     = -1 // keep the whole prompt
+	// Mirostat is opt-in: 0 disabled, 1 mirostat, 2 mirostat 2.0
+	LlamaMirostatMode int     = 0
+	GoRagMirostatTau  float32 = 5.0
+	GoRagMirostatEta  float32 = 0.5 // llama.cpp: 0.1
+	GoRagMaxTokens            = 2048
 
 	LlamaRagSystemPrompt string = "You are a very helpfull asssistant expert in answering " +
 		"questions in a RAG pipeline when provided contexts.\n" +
 		"Make sure to answer the question in the original language."
 
+	LlamaJsonSchemaPrompt string = "Answer only with a JSON value following this JSON schema:"
+
 	LlamaRagAssistantPrompt string = "Answer the user query using the provided context." +
 		"Use as much information from the context as possible." +
 		"If you cannot find an answer with the context, simply state that you don't know."
@@ -37,7 +52,8 @@ const (
 
 // JSON structures for API requests
 type llamaEmbedRequest struct {
-	Input string `json:"input"`
+	Model string   `json:"model,omitempty"`
+	Input []string `json:"input"`
 }
 
 type llamaEmbedResponse struct {
@@ -57,9 +73,35 @@ type llamaEmbedResponse struct {
 type llamaCompletionMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Tool calls made by the assistant, and the call a tool message answers
+	ToolCalls  []LlamaToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string          `json:"tool_call_id,omitempty"`
+}
+
+// LlamaTool: a function the model may call
+type LlamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+// LlamaToolCall: a function call emitted by the model. Arguments is a JSON
+// object, as a string.
+type LlamaToolCall struct {
+	Index    int    `json:"index"`
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 type llamaCompletionRequest struct {
+	Model       string                   `json:"model,omitempty"`
 	Messages    []llamaCompletionMessage `json:"messages"`
 	TopK        int                      `json:"top_k,omitempty"`
 	TopP        float32                  `json:"top_p,omitempty"`
@@ -69,26 +111,49 @@ type llamaCompletionRequest struct {
 	Stream      bool                     `json:"stream"`
 	Temperature float32                  `json:"temperature"`
 	MaxTokens   int                      `json:"max_tokens,omitempty"`
+	MinP        float32                  `json:"min_p"`
 	TypicalP    float32                  `json:"typical_p,omitempty"`
-	Mirostat    int                      `json:"mirostat,omitempty"`
+	Mirostat    int                      `json:"mirostat"`
 	MirostatTau float32                  `json:"mirostat_tau,omitempty"`
 	MirostatEta float32                  `json:"mirostat_eta,omitempty"`
+	// Penalties
+	RepeatPenalty    float32     `json:"repeat_penalty,omitempty"`
+	RepeatLastN      int         `json:"repeat_last_n,omitempty"`
+	PresencePenalty  float32     `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32     `json:"frequency_penalty,omitempty"`
+	Seed             int         `json:"seed"`
+	Stop             []string    `json:"stop,omitempty"`
+	Grammar          string      `json:"grammar,omitempty"`
+	Tools            []LlamaTool `json:"tools,omitempty"`
+	// JsonSchema is turned into a grammar by llama.cpp
+	JsonSchema json.RawMessage `json:"json_schema,omitempty"`
+	// Only meaningful when Stream is true
+	StreamOptions *llamaStreamOptions `json:"stream_options,omitempty"`
+}
+
+type llamaStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 func NewCompletionRequest() *llamaCompletionRequest {
 	return &llamaCompletionRequest{
-		Messages:    make([]llamaCompletionMessage, 0),
-		Stream:      true,
-		N_keep:      -1,
-		Temperature: LlamaDefaultTemperature,
-		TopK:        LlamaDefaultTopK,
-		TopP:        LlamaDefaultTopP,
-		N_predict:   LlamaDefaultNPredict,
-		CachePrompt: true,
-		MaxTokens:   GoRagMaxTokens,
-		Mirostat:    LlamaMirostatMode,
-		MirostatTau: GoRagMirostatTau,
-		MirostatEta: GoRagMirostatEta,
+		Messages:      make([]llamaCompletionMessage, 0),
+		Stream:        true,
+		N_keep:        LlamaDefaultNKeep,
+		Temperature:   LlamaDefaultTemperature,
+		TopK:          LlamaDefaultTopK,
+		TopP:          LlamaDefaultTopP,
+		MinP:          LlamaDefaultMinP,
+		TypicalP:      LlamaDefaultTypicalP,
+		N_predict:     LlamaDefaultNPredict,
+		CachePrompt:   true,
+		MaxTokens:     GoRagMaxTokens,
+		Mirostat:      LlamaMirostatMode,
+		MirostatTau:   GoRagMirostatTau,
+		MirostatEta:   GoRagMirostatEta,
+		RepeatPenalty: LlamaDefaultRepeatPenalty,
+		RepeatLastN:   LlamaDefaultRepeatLastN,
+		Seed:          LlamaDefaultSeed,
 	}
 }
 
@@ -124,8 +189,14 @@ func (l *llamaCompletionRequest) WithNPredict(n_predict int) *llamaCompletionReq
 	return l
 }
 
+func (l *llamaCompletionRequest) WithModel(model string) *llamaCompletionRequest {
+	l.Model = model
+
+	return l
+}
+
 func (l *llamaCompletionRequest) WithStream(stream bool) *llamaCompletionRequest {
-	l.Stream = true
+	l.Stream = stream
 
 	return l
 }
@@ -158,6 +229,93 @@ func (l *llamaCompletionRequest) WithMaxTokens(max int) *llamaCompletionRequest
 	return l
 }
 
+func (l *llamaCompletionRequest) WithMinP(minp float32) *llamaCompletionRequest {
+	if minp >= 0 && minp <= 1 {
+		l.MinP = minp
+	}
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithTypicalP(typicalp float32) *llamaCompletionRequest {
+	if typicalp > 0 && typicalp <= 1 {
+		l.TypicalP = typicalp
+	}
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithNKeep(n_keep int) *llamaCompletionRequest {
+	if n_keep >= -1 {
+		l.N_keep = n_keep
+	}
+
+	return l
+}
+
+// WithMirostat enables mirostat (1 or 2) with its target entropy and learning rate
+func (l *llamaCompletionRequest) WithMirostat(mode int, tau float32, eta float32) *llamaCompletionRequest {
+	l.Mirostat = mode
+	if tau > 0 {
+		l.MirostatTau = tau
+	}
+
+	if eta > 0 {
+		l.MirostatEta = eta
+	}
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithRepeatPenalty(penalty float32, last_n int) *llamaCompletionRequest {
+	if penalty > 0 {
+		l.RepeatPenalty = penalty
+	}
+
+	if last_n >= -1 {
+		l.RepeatLastN = last_n
+	}
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithPenalties(presence float32, frequency float32) *llamaCompletionRequest {
+	l.PresencePenalty = presence
+	l.FrequencyPenalty = frequency
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithSeed(seed int) *llamaCompletionRequest {
+	l.Seed = seed
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithStop(stop []string) *llamaCompletionRequest {
+	l.Stop = stop
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithGrammar(grammar string) *llamaCompletionRequest {
+	l.Grammar = grammar
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithTools(tools []LlamaTool) *llamaCompletionRequest {
+	l.Tools = tools
+
+	return l
+}
+
+func (l *llamaCompletionRequest) WithJsonSchema(schema json.RawMessage) *llamaCompletionRequest {
+	l.JsonSchema = schema
+
+	return l
+}
+
 //
 //
 //
@@ -167,21 +325,89 @@ type llamaEmbeddings struct {
 	Embeddings [][]float32 `json:"embeddings"`
 }
 
-type LlamaCompletionCallback func(data string) error
+// LlamaCompletionCallback receives every chunk decoded from the upstream stream
+type LlamaCompletionCallback func(chunk *LlamaCompletionStream) error
+
+type LlamaCompletionError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// LlamaCompletionDelta: the part of the answer carried by a chunk
+type LlamaCompletionDelta struct {
+	Content   string          `json:"content"`
+	ToolCalls []LlamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type LlamaCompletionStreamChoice struct {
+	FinishReason string               `json:"finish_reason"`
+	Index        int                  `json:"index"`
+	Delta        LlamaCompletionDelta `json:"delta"`
+}
 
 type LlamaCompletionStream struct {
-	Choices []struct {
-		FinishReason string `json:"finish_reason"`
-		Index        int    `json:"index"`
-		Delta        struct {
-			Content string `json:"content"`
-		} `json:"delta"`
+	Choices           []LlamaCompletionStreamChoice `json:"choices"`
+	Created           int64                         `json:"created"`
+	Id                string                        `json:"id"`
+	Model             string                        `json:"model"`
+	SystemFingerprint string                        `json:"system_fingerprint,omitempty"`
+	Object            string                        `json:"object"`
+	Usage             *LlamaCompletionUsage         `json:"usage,omitempty"`
+	Error             *LlamaCompletionError         `json:"error,omitempty"`
+}
+
+// Content returns the text delta carried by the chunk
+func (s *LlamaCompletionStream) Content() string {
+	var content string
+
+	for _, choice := range s.Choices {
+		content += choice.Delta.Content
+	}
+
+	return content
+}
+
+// ToolCalls returns the (partial) tool calls carried by the chunk
+func (s *LlamaCompletionStream) ToolCalls() (calls []LlamaToolCall) {
+	for _, choice := range s.Choices {
+		calls = append(calls, choice.Delta.ToolCalls...)
 	}
-	Created           int64  `json:"created"`
-	Id                string `json:"id"`
-	Model             string `json:"model"`
-	SystemFingerprint string `json:"system_fingerprint"`
-	Object            string `json:"object"`
+
+	return calls
+}
+
+// FinishReason returns the finish reason of the chunk, if any
+func (s *LlamaCompletionStream) FinishReason() string {
+	for _, choice := range s.Choices {
+		if len(choice.FinishReason) > 0 {
+			return choice.FinishReason
+		}
+	}
+
+	return ""
+}
+
+type LlamaCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// LlamaCompletionResponse: the upstream answer when stream is false
+type LlamaCompletionChoice struct {
+	FinishReason string                 `json:"finish_reason"`
+	Index        int                    `json:"index"`
+	Message      llamaCompletionMessage `json:"message"`
+}
+
+type LlamaCompletionResponse struct {
+	Choices []LlamaCompletionChoice `json:"choices"`
+	Created int64                   `json:"created"`
+	Id      string                  `json:"id"`
+	Model   string                  `json:"model"`
+	Object  string                  `json:"object"`
+	Usage   LlamaCompletionUsage    `json:"usage"`
 }
 
 // LlamaTokenizeRequest
@@ -195,16 +421,68 @@ type llamaTokenizeResponse struct {
 
 // LlamaEngine: The main engine for Llama operations
 type LlamaEngine struct {
-	LlamaServer string
-	EmbedServer string
+	LlamaServers *LlamaUpstreamPool
+	EmbedServers *LlamaUpstreamPool
+	// ModelServers: servers of the registered models, by model name
+	ModelServers map[string]*LlamaUpstreamPool
+	Options      LlamaClientOptions
+	// privates
+	client *http.Client
+	// stopHealthChecks is set while health checks run
+	stopHealthChecks atomic.Pointer[context.CancelFunc]
 }
 
-// NewLlamaEngine
+// NewLlamaEngine: es and ls are comma separated lists of servers
 func NewLlamaEngine(es string, ls string) (e *LlamaEngine) {
+	options := NewLlamaClientOptions()
+
 	return &LlamaEngine{
-		EmbedServer: es,
-		LlamaServer: ls,
+		EmbedServers: NewLlamaUpstreamPool(es).configure(options),
+		LlamaServers: NewLlamaUpstreamPool(ls).configure(options),
+		ModelServers: make(map[string]*LlamaUpstreamPool),
+		Options:      options,
+		client:       newLlamaHttpClient(options),
+	}
+}
+
+// WithClientOptions replaces the timeouts, retry and upstream policies,
+// along with the shared http client they configure.
+func (l *LlamaEngine) WithClientOptions(options LlamaClientOptions) *LlamaEngine {
+	l.Options = options
+	l.client = newLlamaHttpClient(options)
+	l.LlamaServers.configure(options)
+	l.EmbedServers.configure(options)
+
+	for _, pool := range l.ModelServers {
+		pool.configure(options)
 	}
+
+	return l
+}
+
+func (l *LlamaEngine) WithLlamaServer(urls string) *LlamaEngine {
+	l.LlamaServers = NewLlamaUpstreamPool(urls).configure(l.Options)
+	return l
+}
+
+func (l *LlamaEngine) WithEmbedServer(urls string) *LlamaEngine {
+	l.EmbedServers = NewLlamaUpstreamPool(urls).configure(l.Options)
+	return l
+}
+
+// WithModelServer routes completions asking for model to urls
+func (l *LlamaEngine) WithModelServer(model string, urls string) *LlamaEngine {
+	l.ModelServers[model] = NewLlamaUpstreamPool(urls).configure(l.Options)
+	return l
+}
+
+// getLlamaServers returns the servers running model, or the default ones
+func (l *LlamaEngine) getLlamaServers(model string) *LlamaUpstreamPool {
+	if pool, found := l.ModelServers[model]; found {
+		return pool
+	}
+
+	return l.LlamaServers
 }
 
 func LlamaAppendRequestMessage(
@@ -218,152 +496,227 @@ func LlamaAppendRequestMessage(
 	})
 }
 
-// GetEmbeddings
-func (l *LlamaEngine) GetEmbeddings(input string) (embeds *llamaEmbeddings, err error) {
-	var llama_resp llamaEmbedResponse
-	var client = &http.Client{}
+// GetEmbeddings returns one embedding per input, in input order. Inputs are
+// sent in batches of EmbedBatchSize, up to EmbedConcurrency at once.
+func (l *LlamaEngine) GetEmbeddings(ctx context.Context, inputs []string) (embeds *llamaEmbeddings, err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
 
-	var json_request llamaEmbedRequest = llamaEmbedRequest{
-		Input: input,
+	batchSize := max(l.Options.EmbedBatchSize, 1)
+	slots := make(chan struct{}, max(l.Options.EmbedConcurrency, 1))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	embeds = &llamaEmbeddings{
+		Embeddings: make([][]float32, len(inputs)),
 	}
 
-	json_bytes, err := json.Marshal(json_request)
-	if err != nil {
-		return nil, err
+	for start := 0; start < len(inputs); start += batchSize {
+		end := min(start+batchSize, len(inputs))
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			model, batch, batchErr := l.getEmbeddingsBatch(ctx, inputs[start:end])
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if batchErr != nil {
+				if err == nil {
+					err = batchErr
+					cancel()
+				}
+				return
+			}
+
+			embeds.Model = model
+			copy(embeds.Embeddings[start:end], batch)
+		}()
 	}
 
-	payload := bytes.NewBuffer(json_bytes)
+	wg.Wait()
 
-	// Prepare the http.Request struct
-	url := fmt.Sprintf("%s/v1/embeddings", l.EmbedServer)
-	req, err := http.NewRequest(http.MethodPost, url, payload)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
+	return embeds, nil
+}
+
+// getEmbeddingsBatch makes a single embeddings call for inputs
+func (l *LlamaEngine) getEmbeddingsBatch(
+	ctx context.Context,
+	inputs []string) (model string, embeddings [][]float32, err error) {
 
-	resp, err := client.Do(req)
+	body, provider, err := l.postIdempotent(ctx, l.EmbedServers, func(p LlamaProvider) (string, []byte, error) {
+		return p.EmbedRequest(inputs)
+	}, l.Options.EmbedTimeout)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	model, embeddings, err = provider.DecodeEmbeddings(body, len(inputs))
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	resp.Body.Close()
 
-	if err = json.Unmarshal(body, &llama_resp); err != nil {
-		return nil, err
-	}
+	log.Printf("[LlamaEngine::getEmbeddingsBatch] got %d embeddings from '%s'\n", len(embeddings), model)
 
-	embeds = &llamaEmbeddings{}
-	embeds.Model = llama_resp.Model
+	return model, embeddings, nil
+}
 
-	if dataLen := len(llama_resp.Data); dataLen > 0 {
-		embeds.Embeddings = make([][]float32, dataLen)
+// GetCompletion asks llama for a single, non streamed answer
+func (l *LlamaEngine) GetCompletion(
+	ctx context.Context,
+	data *llamaCompletionRequest) (result *LlamaCompletionResponse, err error) {
 
-		for i, data := range llama_resp.Data {
-			embeds.Embeddings[i] = make([]float32, 0)
-			embeds.Embeddings[i] = append(embeds.Embeddings[i], data.Embedding...)
-		}
+	data.Stream = false
+	data.StreamOptions = nil
+
+	log.Println("LlamaEngine::GetCompletion:", data)
+
+	body, status, provider, err := l.post(ctx, l.getLlamaServers(data.Model), func(p LlamaProvider) (string, []byte, error) {
+		return p.CompletionRequest(data)
+	}, l.Options.CompletionTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("final embeds: %v\n", embeds)
+	if status != http.StatusOK {
+		return nil, newLlamaErrorFromBody(status, body)
+	}
 
-	return embeds, nil
+	result, err = provider.DecodeCompletion(body)
+	if err != nil {
+		log.Printf("[LlamaEngine::GetCompletion] invalid response: %s\n", string(body))
+		return nil, err
+	}
+
+	return result, nil
 }
 
+// GetCompletions asks llama for a streamed answer. The upstream provider
+// decodes every line into a LlamaCompletionStream handed to callback.
 func (l *LlamaEngine) GetCompletions(
+	ctx context.Context,
 	data *llamaCompletionRequest,
 	callback LlamaCompletionCallback) (err error) {
-	var client *http.Client = &http.Client{}
 
-	jsonBytes, err := json.Marshal(data)
+	ctx, cancel := withOptionalTimeout(ctx, l.Options.CompletionTimeout)
+	defer cancel()
+
+	data.Stream = true
+	data.StreamOptions = &llamaStreamOptions{IncludeUsage: true}
+
+	servers := l.getLlamaServers(data.Model)
+	upstream, err := servers.acquire()
 	if err != nil {
 		return err
 	}
 
-	payload := bytes.NewBuffer(jsonBytes)
+	// Only failures of the server itself count for its circuit breaker
+	var upstreamErr error
+	defer func() {
+		servers.release(ctx, upstream, upstreamErr)
+	}()
 
-	var uri string = fmt.Sprintf("%s/v1/chat/completions", l.LlamaServer)
-	req, err := http.NewRequest(http.MethodPost, uri, payload)
+	provider := upstream.Provider
+	path, jsonBytes, err := provider.CompletionRequest(data)
+	if err != nil {
+		return err
+	}
+
+	var uri string = fmt.Sprintf("%s%s", upstream.Url, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewBuffer(jsonBytes))
 
 	if err != nil {
 		return err
 	}
 
+	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "text/event-stream")
+	provider.Authorize(req)
 
-	resp, err := client.Do(req)
+	resp, err := l.client.Do(req)
 	if err != nil {
-		return err
+		upstreamErr = newLlamaUnavailableError(err)
+		return upstreamErr
 	}
 	defer resp.Body.Close()
 
 	log.Println("LlamaEngine::GetCompletions:", data)
 
-	err = nil
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("got non 200 code from endpoint: %s\n", resp.Status)
+
+		body, _ := io.ReadAll(resp.Body)
+		upstreamErr = newLlamaErrorFromBody(resp.StatusCode, body)
+		return upstreamErr
+	}
 
 	reader := bufio.NewReader(resp.Body)
 	for {
-		stream, err := reader.ReadString('\n')
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("got non 200 code from endpoint: %s\n", resp.Status)
-		}
+		line, readErr := reader.ReadString('\n')
 
-		if err != nil {
-			if err == io.EOF {
-				callback(stream)
-				log.Printf("EOF from response.")
-			} else {
-				log.Printf("resp read error: %s\n", err.Error())
-			}
-			break
+		chunk, done, decodeErr := provider.DecodeStreamLine(strings.TrimSpace(line))
+		if decodeErr != nil {
+			log.Printf("[LlamaEngine::GetCompletions] %s\n", decodeErr.Error())
+			return decodeErr
 		}
 
-		if err = callback(stream); err != nil {
-			log.Printf("GetCompletions: callback error: %s\n", err.Error())
-			break
+		if done {
+			return nil
 		}
-	}
-
-	return err
-}
-
-func (l *LlamaEngine) Tokenize(input string) (tokens []uint, err error) {
-	var uri string = fmt.Sprintf("%s/tokenize", l.LlamaServer)
-	var client *http.Client = &http.Client{}
-
-	data := llamaTokenizeRequest{
-		Content: input,
-	}
 
-	jsonBytes, err := json.Marshal(data)
-	if err != nil {
-		return nil, err
-	}
+		if chunk != nil {
+			if chunk.Error != nil {
+				upstreamErr = newLlamaError(0, chunk.Error)
+				return upstreamErr
+			}
 
-	payload := bytes.NewBuffer(jsonBytes)
+			if err = callback(chunk); err != nil {
+				log.Printf("GetCompletions: callback error: %s\n", err.Error())
+				return err
+			}
+		}
 
-	req, err := http.NewRequest(http.MethodPost, uri, payload)
-	if err != nil {
-		return nil, err
-	}
+		if readErr != nil {
+			if readErr == io.EOF {
+				log.Printf("EOF from response.")
+				return nil
+			}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+			log.Printf("resp read error: %s\n", readErr.Error())
+			upstreamErr = newLlamaUnavailableError(readErr)
+			return upstreamErr
+		}
 	}
-	defer resp.Body.Close()
-
-	log.Println("[LlamaEngine::Tokenize] ", data)
+}
 
-	err = nil
+// Tokenize is only offered by llama.cpp servers
+func (l *LlamaEngine) Tokenize(ctx context.Context, input string) (tokens []uint, err error) {
+	log.Println("[LlamaEngine::Tokenize] ", input)
 
-	tokensJson, err := io.ReadAll(resp.Body)
+	tokensJson, _, err := l.postIdempotent(ctx, l.LlamaServers, func(p LlamaProvider) (string, []byte, error) {
+		return p.TokenizeRequest(input)
+	}, l.Options.TokenizeTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,272 @@
+package gorag_engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Defaults for the llama http client
+const (
+	LlamaDefaultEmbedTimeout      time.Duration = 30 * time.Second
+	LlamaDefaultCompletionTimeout time.Duration = 5 * time.Minute
+	LlamaDefaultTokenizeTimeout   time.Duration = 10 * time.Second
+	LlamaDefaultMaxRetries        int           = 3
+	LlamaDefaultRetryBackoff      time.Duration = 250 * time.Millisecond
+	LlamaDefaultMaxIdleConns      int           = 32
+	LlamaDefaultBreakerFailures   int           = 3
+	LlamaDefaultBreakerCooldown   time.Duration = 30 * time.Second
+	LlamaDefaultHealthInterval    time.Duration = 10 * time.Second
+	LlamaDefaultEmbedBatchSize    int           = 32
+	LlamaDefaultEmbedConcurrency  int           = 4
+
+	llamaMaxRetryBackoff time.Duration = 10 * time.Second
+)
+
+// LlamaClientOptions: timeouts and retry policy used by LlamaEngine.
+// A zero timeout disables it.
+type LlamaClientOptions struct {
+	EmbedTimeout      time.Duration
+	CompletionTimeout time.Duration
+	TokenizeTimeout   time.Duration
+	// Retries only apply to idempotent calls (embeddings, tokenize)
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxIdleConns int
+	// Upstream pools: balancing, circuit breaker and health checks.
+	// A zero HealthInterval disables health checks.
+	Balance         string
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	HealthInterval  time.Duration
+	// Batch embeddings: inputs per upstream call and concurrent calls
+	EmbedBatchSize   int
+	EmbedConcurrency int
+}
+
+func NewLlamaClientOptions() LlamaClientOptions {
+	return LlamaClientOptions{
+		EmbedTimeout:      LlamaDefaultEmbedTimeout,
+		CompletionTimeout: LlamaDefaultCompletionTimeout,
+		TokenizeTimeout:   LlamaDefaultTokenizeTimeout,
+		MaxRetries:        LlamaDefaultMaxRetries,
+		RetryBackoff:      LlamaDefaultRetryBackoff,
+		MaxIdleConns:      LlamaDefaultMaxIdleConns,
+		Balance:           LlamaBalanceRoundRobin,
+		BreakerFailures:   LlamaDefaultBreakerFailures,
+		BreakerCooldown:   LlamaDefaultBreakerCooldown,
+		HealthInterval:    LlamaDefaultHealthInterval,
+		EmbedBatchSize:    LlamaDefaultEmbedBatchSize,
+		EmbedConcurrency:  LlamaDefaultEmbedConcurrency,
+	}
+}
+
+// newLlamaHttpClient builds the pooled client shared by every call of a LlamaEngine.
+// Timeouts are applied per operation through the request context instead of
+// http.Client.Timeout, so streamed completions are not cut by embed limits.
+func newLlamaHttpClient(options LlamaClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = options.MaxIdleConns
+	transport.MaxIdleConnsPerHost = options.MaxIdleConns
+
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// getRetryBackoff returns the jittered exponential delay before retry number attempt
+func getRetryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := base << attempt
+	if backoff <= 0 || backoff > llamaMaxRetryBackoff {
+		backoff = llamaMaxRetryBackoff
+	}
+
+	// "equal jitter": half fixed, half random
+	half := backoff / 2
+
+	return half + rand.N(half+1)
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// llamaRequestBuilder builds the request of an operation for the provider
+// of the upstream it is sent to
+type llamaRequestBuilder func(provider LlamaProvider) (path string, payload []byte, err error)
+
+// postIdempotent posts the built request to one of the pool's servers and
+// returns the body of a 200 answer, along with the provider to decode it.
+// Connection errors, timeouts and transient statuses are retried with a
+// jittered exponential backoff, possibly on another server, each attempt
+// bounded by timeout.
+func (l *LlamaEngine) postIdempotent(
+	ctx context.Context,
+	pool *LlamaUpstreamPool,
+	build llamaRequestBuilder,
+	timeout time.Duration) (body []byte, provider LlamaProvider, err error) {
+
+	for attempt := 0; ; attempt++ {
+		var status int
+
+		body, status, provider, err = l.post(ctx, pool, build, timeout)
+		if err == nil && status == http.StatusOK {
+			return body, provider, nil
+		}
+
+		if err == nil {
+			err = newLlamaErrorFromBody(status, body)
+			if !isRetryableStatus(status) {
+				return nil, nil, err
+			}
+		}
+
+		if ctx.Err() != nil || attempt >= l.Options.MaxRetries || errors.Is(err, ErrUnsupported) {
+			return nil, nil, err
+		}
+
+		backoff := getRetryBackoff(l.Options.RetryBackoff, attempt)
+		log.Printf("[LlamaEngine::postIdempotent] %s, retrying in %s\n", err.Error(), backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// post makes a single POST to one of the pool's servers, bounded by timeout
+func (l *LlamaEngine) post(
+	ctx context.Context,
+	pool *LlamaUpstreamPool,
+	build llamaRequestBuilder,
+	timeout time.Duration) (body []byte, status int, provider LlamaProvider, err error) {
+
+	upstream, err := pool.acquire()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	path, payload, err := build(upstream.Provider)
+	if err != nil {
+		// Not the server's fault
+		pool.release(ctx, upstream, nil)
+		return nil, 0, nil, err
+	}
+
+	body, status, err = l.postUpstream(ctx, upstream, path, payload, timeout)
+
+	if err == nil && status != http.StatusOK {
+		pool.release(ctx, upstream, newLlamaErrorFromBody(status, body))
+	} else {
+		pool.release(ctx, upstream, err)
+	}
+
+	return body, status, upstream.Provider, err
+}
+
+func (l *LlamaEngine) postUpstream(
+	ctx context.Context,
+	upstream *llamaUpstream,
+	path string,
+	payload []byte,
+	timeout time.Duration) (body []byte, status int, err error) {
+
+	ctx, cancel := withOptionalTimeout(ctx, timeout)
+	defer cancel()
+
+	uri := fmt.Sprintf("%s%s", upstream.Url, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	upstream.Provider.Authorize(req)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, newLlamaUnavailableError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, newLlamaUnavailableError(err)
+	}
+
+	return body, resp.StatusCode, nil
+}
+
+// StartHealthChecks probes every configured server on HealthInterval,
+// until Close is called.
+func (l *LlamaEngine) StartHealthChecks() {
+	if l.Options.HealthInterval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !l.stopHealthChecks.CompareAndSwap(nil, &cancel) {
+		// Already running
+		cancel()
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(l.Options.HealthInterval)
+		defer ticker.Stop()
+
+		timeout := min(l.Options.HealthInterval, LlamaDefaultTokenizeTimeout)
+
+		for {
+			l.LlamaServers.probe(ctx, l.client, timeout)
+			l.EmbedServers.probe(ctx, l.client, timeout)
+			for _, pool := range l.ModelServers {
+				pool.probe(ctx, l.client, timeout)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// healthChecking tells whether health checks run
+func (l *LlamaEngine) healthChecking() bool {
+	return l.stopHealthChecks.Load() != nil
+}
+
+// Close stops health checks and drops idle connections
+func (l *LlamaEngine) Close() {
+	if stop := l.stopHealthChecks.Swap(nil); stop != nil {
+		(*stop)()
+	}
+
+	l.client.CloseIdleConnections()
+}
@@ -0,0 +1,95 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPostIdempotentRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		calls    int32
+		kind     error
+	}{
+		{"success", []int{http.StatusOK}, 1, nil},
+		{"transient", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, 3, nil},
+		{"too many", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, 3, ErrUpstreamUnavailable},
+		{"bad request", []int{http.StatusBadRequest, http.StatusOK}, 1, ErrBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				status := test.statuses[min(int(calls.Add(1)-1), len(test.statuses)-1)]
+				resp.WriteHeader(status)
+				resp.Write([]byte(`{"model":"m","data":[{"index":0,"embedding":[1]}]}`))
+			}))
+			defer server.Close()
+
+			options := NewLlamaClientOptions()
+			options.HealthInterval = 0
+			options.MaxRetries = 2
+			options.RetryBackoff = time.Millisecond
+			options.BreakerFailures = 10
+
+			l := NewLlamaEngine(server.URL, server.URL).WithClientOptions(options)
+			defer l.Close()
+
+			_, err := l.GetEmbeddings(context.Background(), []string{"a"})
+			if test.kind == nil && err != nil {
+				t.Fatal(err)
+			}
+
+			if test.kind != nil && !errors.Is(err, test.kind) {
+				t.Fatalf("got %v, want %v", err, test.kind)
+			}
+
+			if calls.Load() != test.calls {
+				t.Fatalf("%d calls, want %d", calls.Load(), test.calls)
+			}
+		})
+	}
+}
+
+func TestGetRetryBackoff(t *testing.T) {
+	for attempt := range 64 {
+		backoff := getRetryBackoff(100*time.Millisecond, attempt)
+		if backoff <= 0 || backoff > llamaMaxRetryBackoff {
+			t.Fatalf("attempt %d: backoff %s", attempt, backoff)
+		}
+	}
+
+	if backoff := getRetryBackoff(100*time.Millisecond, 2); backoff < 200*time.Millisecond || backoff > 400*time.Millisecond {
+		t.Fatalf("third attempt waits %s", backoff)
+	}
+}
+
+func TestCompletionTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// Requests are only canceled once their body is read
+		io.Copy(io.Discard, req.Body)
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	options := NewLlamaClientOptions()
+	options.HealthInterval = 0
+	options.CompletionTimeout = 10 * time.Millisecond
+
+	l := NewLlamaEngine(server.URL, server.URL).WithClientOptions(options)
+	defer l.Close()
+
+	_, err := l.GetCompletion(context.Background(), NewCompletionRequest())
+	if !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,117 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetEmbeddingsBatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		inputs      int
+		batchSize   int
+		concurrency int
+		calls       int32
+		fail        string
+	}{
+		{"single batch", 3, 4, 2, 1, ""},
+		{"exact batches", 8, 4, 2, 2, ""},
+		{"last batch smaller", 10, 4, 2, 3, ""},
+		{"one at a time", 6, 2, 1, 3, ""},
+		{"failing batch", 10, 2, 2, 0, "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls, inflight, peak atomic.Int32
+
+			// Embeds input "n" as [n], answering in reverse order
+			server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				calls.Add(1)
+				current := inflight.Add(1)
+				defer inflight.Add(-1)
+
+				for previous := peak.Load(); current > previous; previous = peak.Load() {
+					if peak.CompareAndSwap(previous, current) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+
+				var er struct {
+					Input []string `json:"input"`
+				}
+				json.NewDecoder(req.Body).Decode(&er)
+
+				type embedding struct {
+					Index     int       `json:"index"`
+					Embedding []float32 `json:"embedding"`
+				}
+
+				var data []embedding
+				for i := len(er.Input) - 1; i >= 0; i-- {
+					if er.Input[i] == tt.fail {
+						http.Error(resp, "out of memory", http.StatusInternalServerError)
+						return
+					}
+
+					n, _ := strconv.Atoi(er.Input[i])
+					data = append(data, embedding{Index: i, Embedding: []float32{float32(n)}})
+				}
+
+				json.NewEncoder(resp).Encode(map[string]any{"model": "m", "data": data})
+			}))
+			defer server.Close()
+
+			options := NewLlamaClientOptions()
+			options.HealthInterval = 0
+			options.MaxRetries = 0
+			options.EmbedBatchSize = tt.batchSize
+			options.EmbedConcurrency = tt.concurrency
+
+			l := NewLlamaEngine(server.URL, server.URL).WithClientOptions(options)
+			defer l.Close()
+
+			inputs := make([]string, tt.inputs)
+			for i := range inputs {
+				inputs[i] = strconv.Itoa(i)
+			}
+
+			embeds, err := l.GetEmbeddings(context.Background(), inputs)
+			if peak.Load() > int32(tt.concurrency) {
+				t.Fatalf("%d batches at once, want at most %d", peak.Load(), tt.concurrency)
+			}
+
+			if len(tt.fail) > 0 {
+				if err == nil {
+					t.Fatalf("failing batch ignored")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if calls.Load() != tt.calls {
+				t.Fatalf("%d calls, want %d", calls.Load(), tt.calls)
+			}
+
+			if embeds.Model != "m" || len(embeds.Embeddings) != tt.inputs {
+				t.Fatalf("got %d embeddings of '%s'", len(embeds.Embeddings), embeds.Model)
+			}
+
+			for i, embedding := range embeds.Embeddings {
+				if len(embedding) != 1 || embedding[0] != float32(i) {
+					t.Fatalf("embedding %d is %v", i, embedding)
+				}
+			}
+		})
+	}
+}
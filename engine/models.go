@@ -0,0 +1,143 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// EngineModel: a generation model, the servers running it and its default
+// sampling parameters. Unset parameters fall back to the engine defaults.
+type EngineModel struct {
+	// Servers: comma separated, with the same syntax as the llama servers
+	Servers     string   `json:"servers" yaml:"servers"`
+	Temperature *float32 `json:"temperature,omitempty" yaml:"temperature,omitempty"`
+	TopK        int      `json:"top_k,omitempty" yaml:"top_k,omitempty"`
+	TopP        float32  `json:"top_p,omitempty" yaml:"top_p,omitempty"`
+	Predict     int      `json:"n_predict,omitempty" yaml:"n_predict,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty" yaml:"max_tokens,omitempty"`
+}
+
+// EngineModelRegistry: the generation models requests may pick from
+type EngineModelRegistry struct {
+	Models map[string]EngineModel `json:"models" yaml:"models"`
+	// Default is used when neither the request nor its collection tell a model
+	Default string `json:"default,omitempty" yaml:"default,omitempty"`
+	// Collections maps a collection to its default model
+	Collections map[string]string `json:"collections,omitempty" yaml:"collections,omitempty"`
+}
+
+// LoadEngineModelRegistry reads a registry from a json file
+func LoadEngineModelRegistry(path string) (registry *EngineModelRegistry, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	registry = &EngineModelRegistry{}
+	if err = json.Unmarshal(data, registry); err != nil {
+		return nil, fmt.Errorf("invalid model registry '%s': %w", path, err)
+	}
+
+	if err = registry.Validate(); err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+// Validate makes sure every model has servers and every reference exists
+func (r *EngineModelRegistry) Validate() error {
+	for name, model := range r.Models {
+		if len(model.Servers) == 0 {
+			return fmt.Errorf("model '%s' has no servers", name)
+		}
+	}
+
+	if _, found := r.Models[r.Default]; len(r.Default) > 0 && !found {
+		return fmt.Errorf("default model '%s' is not defined", r.Default)
+	}
+
+	for collection, name := range r.Collections {
+		if _, found := r.Models[name]; !found {
+			return fmt.Errorf("model '%s' of collection '%s' is not defined", name, collection)
+		}
+	}
+
+	return nil
+}
+
+// Names returns the registered models, sorted
+func (r *EngineModelRegistry) Names() []string {
+	names := make([]string, 0, len(r.Models))
+	for name := range r.Models {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Resolve picks the model of a request: the requested one, else the
+// default of collection, else the registry default. An empty name means
+// the global llama servers.
+func (r *EngineModelRegistry) Resolve(requested string, collection string) (name string, err error) {
+	if r == nil {
+		if len(requested) > 0 {
+			return "", fmt.Errorf("unknown model '%s'", requested)
+		}
+		return "", nil
+	}
+
+	if len(requested) > 0 {
+		if _, found := r.Models[requested]; !found {
+			return "", fmt.Errorf("unknown model '%s'", requested)
+		}
+		return requested, nil
+	}
+
+	if name, found := r.Collections[collection]; found {
+		return name, nil
+	}
+
+	return r.Default, nil
+}
+
+// NewCompletionRequest returns the engine defaults overridden by the ones of model
+func (r *EngineModelRegistry) NewCompletionRequest(name string) *EngineCompletionRequest {
+	er := NewEngineCompletionRequest()
+	er.Model = name
+
+	if r == nil {
+		return er
+	}
+
+	model, found := r.Models[name]
+	if !found {
+		return er
+	}
+
+	if model.Temperature != nil {
+		temperature := *model.Temperature
+		er.Temperature = &temperature
+	}
+
+	if model.TopK > 0 {
+		er.TopK = model.TopK
+	}
+
+	if model.TopP > 0 {
+		er.TopP = model.TopP
+	}
+
+	if model.Predict > 0 {
+		er.Predict = model.Predict
+	}
+
+	if model.MaxTokens > 0 {
+		er.MaxTokens = model.MaxTokens
+	}
+
+	return er
+}
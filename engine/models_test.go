@@ -0,0 +1,108 @@
+package gorag_engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestModelRegistry() *EngineModelRegistry {
+	temperature := float32(0.5)
+
+	return &EngineModelRegistry{
+		Models: map[string]EngineModel{
+			"general": {Servers: "http://general:8080"},
+			"code":    {Servers: "http://code:8080", Temperature: &temperature, TopK: 10, MaxTokens: 512},
+		},
+		Default:     "general",
+		Collections: map[string]string{"sources": "code"},
+	}
+}
+
+func TestModelRegistryResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		registry   *EngineModelRegistry
+		requested  string
+		collection string
+		want       string
+		valid      bool
+	}{
+		{"requested", newTestModelRegistry(), "general", "sources", "general", true},
+		{"collection default", newTestModelRegistry(), "", "sources", "code", true},
+		{"registry default", newTestModelRegistry(), "", "hr", "general", true},
+		{"unknown", newTestModelRegistry(), "gpt-4", "sources", "", false},
+		{"no default", &EngineModelRegistry{Models: map[string]EngineModel{"m": {Servers: "s"}}}, "", "hr", "", true},
+		{"no registry", nil, "", "sources", "", true},
+		{"no registry, requested", nil, "code", "sources", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := tt.registry.Resolve(tt.requested, tt.collection)
+			if tt.valid && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if !tt.valid && err == nil {
+				t.Fatalf("resolved to '%s'", name)
+			}
+
+			if name != tt.want {
+				t.Fatalf("got '%s', want '%s'", name, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelRegistryCompletionRequest(t *testing.T) {
+	registry := newTestModelRegistry()
+
+	er := registry.NewCompletionRequest("code")
+	if er.Model != "code" || *er.Temperature != 0.5 || er.TopK != 10 || er.MaxTokens != 512 {
+		t.Fatalf("model defaults not applied: %+v", er)
+	}
+
+	// Unset parameters are the ones of the engine
+	if er.TopP != LlamaDefaultTopP || er.Predict != LlamaDefaultNPredict {
+		t.Fatalf("engine defaults not applied: %+v", er)
+	}
+
+	er = registry.NewCompletionRequest("general")
+	if *er.Temperature != LlamaDefaultTemperature || er.TopK != LlamaDefaultTopK {
+		t.Fatalf("engine defaults not applied: %+v", er)
+	}
+}
+
+func TestModelRegistryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"valid", `{"models":{"m":{"servers":"http://m:8080"}},"default":"m","collections":{"c":"m"}}`, ""},
+		{"no servers", `{"models":{"m":{}}}`, "no servers"},
+		{"unknown default", `{"models":{"m":{"servers":"s"}},"default":"x"}`, "default model 'x'"},
+		{"unknown collection model", `{"models":{"m":{"servers":"s"}},"collections":{"c":"x"}}`, "collection 'c'"},
+		{"invalid json", `{"models":`, "invalid model registry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "models.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := LoadEngineModelRegistry(path)
+			if len(tt.error) == 0 && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if len(tt.error) > 0 && (err == nil || !strings.Contains(err.Error(), tt.error)) {
+				t.Fatalf("got %v, want an error about %s", err, tt.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// OpenAI compatible json specs
+type openaiChatRequest struct {
+	Model       string                   `json:"model"`
+	Messages    []llamaCompletionMessage `json:"messages"`
+	Stream      bool                     `json:"stream"`
+	Temperature *float32                 `json:"temperature,omitempty"`
+	TopP        *float32                 `json:"top_p,omitempty"`
+	MaxTokens   int                      `json:"max_tokens,omitempty"`
+	// ResponseFormat: only "json_schema" changes anything
+	ResponseFormat *openaiResponseFormat `json:"response_format,omitempty"`
+}
+
+type openaiEmbedRequest struct {
+	Model string         `json:"model"`
+	Input EmbedInputJson `json:"input"`
+}
+
+type openaiEmbedData struct {
+	Object    string    `json:"object"`
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type openaiEmbedResponse struct {
+	Object string            `json:"object"`
+	Data   []openaiEmbedData `json:"data"`
+	Model  string            `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+type openaiErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+}
+
+func (e *GoRagEngine) sendOpenAIError(status int, message string, resp http.ResponseWriter) {
+	var v openaiErrorResponse
+
+	v.Error.Message = message
+	v.Error.Type = "server_error"
+	v.Error.Code = status
+
+	if status < http.StatusInternalServerError {
+		v.Error.Type = "invalid_request_error"
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+
+	if b, err := json.Marshal(v); err == nil {
+		resp.Write(b)
+	}
+}
+
+// injectRagContext adds the retrieved context for the last user message to
+// the system prompt, creating one when the client did not send it, and
+// returns the collection searched, if any. Requests denied or invalid are
+// errors; other retrieval errors only skip the context.
+func (e *GoRagEngine) injectRagContext(
+	ctx context.Context,
+	messages []llamaCompletionMessage) (result []llamaCompletionMessage, collection string, err error) {
+	var query string
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == LlamaRoleUser {
+			query = messages[i].Content
+			break
+		}
+	}
+
+	if len(query) == 0 {
+		return messages, "", nil
+	}
+
+	var points []qdrantPoint
+
+	embeds, err := e.getEmbeddings(ctx, EmbedKindQuery, []string{query})
+	if err == nil {
+		collection = e.getCollectionFromModel(embeds.Model)
+		points, err = e.searchQdrantPoints(ctx, collection, embeds, e.threshold)
+	}
+
+	if errors.Is(err, ErrForbidden) || errors.Is(err, ErrBadRequest) {
+		return nil, "", err
+	}
+
+	if err != nil {
+		log.Printf("[injectRagContext] retrieval error: %s\n", err.Error())
+		return messages, collection, nil
+	}
+
+	if len(points) == 0 {
+		return messages, collection, nil
+	}
+
+	ragPrompt := fmt.Sprintf("%s\n\nContext: %s", e.prompts.Assistant, e.getContextFromPoints(points))
+
+	if len(messages) > 0 && messages[0].Role == LlamaRoleSystem {
+		messages[0].Content = fmt.Sprintf("%s\n\n%s", messages[0].Content, ragPrompt)
+		return messages, collection, nil
+	}
+
+	result = LlamaAppendRequestMessage(make([]llamaCompletionMessage, 0, len(messages)+1),
+		LlamaRoleSystem, fmt.Sprintf("%s\n\n%s", e.prompts.System, ragPrompt))
+
+	return append(result, messages...), collection, nil
+}
+
+func (e *GoRagEngine) handleOpenAIChat(resp http.ResponseWriter, req *http.Request) {
+	var ocr openaiChatRequest
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		e.sendOpenAIError(http.StatusBadRequest, "could not read request data", resp)
+		return
+	}
+
+	if err = json.Unmarshal(data, &ocr); err != nil {
+		e.sendOpenAIError(http.StatusBadRequest, err.Error(), resp)
+		return
+	}
+
+	if len(ocr.Messages) == 0 {
+		e.sendOpenAIError(http.StatusBadRequest, "'messages' must not be empty", resp)
+		return
+	}
+
+	messages, collection, err := e.injectRagContext(req.Context(), ocr.Messages)
+	if err != nil {
+		log.Printf("[handleOpenAIChat] retrieval error: %s\n", err.Error())
+		e.sendOpenAIError(getErrorHttpStatus(err), err.Error(), resp)
+		return
+	}
+
+	// As /api/completion does: the requested model, else the one of the
+	// collection, with its defaults
+	model, err := e.models.Resolve(ocr.Model, collection)
+	if err != nil {
+		e.sendOpenAIError(http.StatusBadRequest, err.Error(), resp)
+		return
+	}
+
+	defaults := e.models.NewCompletionRequest(model)
+
+	lcr := NewCompletionRequest().
+		WithMessages(messages).
+		WithModel(model).
+		WithStream(ocr.Stream).
+		WithTemperature(*defaults.Temperature).
+		WithTopK(defaults.TopK).
+		WithTopP(defaults.TopP).
+		WithNPredict(defaults.Predict).
+		WithMaxTokens(defaults.MaxTokens).
+		WithMaxTokens(ocr.MaxTokens)
+
+	if ocr.Temperature != nil {
+		lcr.WithTemperature(*ocr.Temperature)
+	}
+
+	if ocr.TopP != nil {
+		lcr.WithTopP(*ocr.TopP)
+	}
+
+	if ocr.ResponseFormat != nil && ocr.ResponseFormat.JsonSchema != nil {
+		lcr.WithJsonSchema(ocr.ResponseFormat.JsonSchema.Schema)
+	}
+
+	e.limits.Clamp(lcr)
+
+	log.Printf("[handleOpenAIChat] getting completion for model '%s': %+v\n", model, lcr)
+
+	if !ocr.Stream {
+		result, err := e.LlamaClient.GetCompletion(req.Context(), lcr)
+		if err != nil {
+			e.sendOpenAIError(getErrorHttpStatus(err), err.Error(), resp)
+			return
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			e.sendOpenAIError(http.StatusInternalServerError, err.Error(), resp)
+			return
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(b)
+		return
+	}
+
+	events, err := newEngineEventWriter(resp)
+	if err != nil {
+		e.sendOpenAIError(http.StatusInternalServerError, err.Error(), resp)
+		return
+	}
+
+	err = e.LlamaClient.GetCompletions(req.Context(), lcr, func(chunk *LlamaCompletionStream) error {
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+
+		return events.SendData(string(b))
+	})
+
+	if err != nil {
+		log.Printf("[handleOpenAIChat] completion error: %s\n", err.Error())
+
+		if !events.Started() {
+			e.sendOpenAIError(getErrorHttpStatus(err), err.Error(), resp)
+			return
+		}
+
+		// Headers are gone already, report the error in the stream itself
+		var v openaiErrorResponse
+		v.Error.Message = err.Error()
+		v.Error.Type = "server_error"
+		v.Error.Code = getErrorHttpStatus(err)
+
+		if b, err := json.Marshal(v); err == nil {
+			events.SendData(string(b))
+		}
+		return
+	}
+
+	events.SendData("[DONE]")
+}
+
+func (e *GoRagEngine) handleOpenAIEmbeddings(resp http.ResponseWriter, req *http.Request) {
+	var oer openaiEmbedRequest
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		e.sendOpenAIError(http.StatusBadRequest, "could not read request data", resp)
+		return
+	}
+
+	if err = json.Unmarshal(data, &oer); err != nil {
+		e.sendOpenAIError(http.StatusBadRequest, err.Error(), resp)
+		return
+	}
+
+	if !oer.Input.IsValid() {
+		e.sendOpenAIError(http.StatusBadRequest, "'input' must not be empty", resp)
+		return
+	}
+
+	// OpenAI clients are expected to prefix their inputs themselves
+	embeds, err := e.getEmbeddings(req.Context(), "", oer.Input)
+	if err != nil {
+		e.sendOpenAIError(getErrorHttpStatus(err), err.Error(), resp)
+		return
+	}
+
+	oresp := openaiEmbedResponse{
+		Object: "list",
+		Data:   make([]openaiEmbedData, len(embeds.Embeddings)),
+		// The model requested is not used, answer with the one that embedded
+		Model: embeds.Model,
+	}
+
+	for i, embed := range embeds.Embeddings {
+		oresp.Data[i] = openaiEmbedData{
+			Object:    "embedding",
+			Embedding: embed,
+			Index:     i,
+		}
+	}
+
+	b, err := json.Marshal(oresp)
+	if err != nil {
+		e.sendOpenAIError(http.StatusInternalServerError, err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	written, err := resp.Write(b)
+	if err != nil {
+		log.Printf("[handleOpenAIEmbeddings] error while writing response: %s\n", err.Error())
+		return
+	}
+
+	log.Printf("/v1/embeddings: sent %d bytes to client\n", written)
+}
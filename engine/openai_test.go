@@ -0,0 +1,231 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIChat(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		// system: what the system message sent upstream must contain
+		system []string
+	}{
+		{
+			name:   "context added",
+			body:   `{"messages":[{"role":"user","content":"gorag stores its vectors"}]}`,
+			status: http.StatusOK,
+			system: []string{"Context:", "gorag stores its vectors in qdrant"},
+		},
+		{
+			name: "system prompt kept",
+			body: `{"messages":[{"role":"system","content":"be brief"},` +
+				`{"role":"user","content":"gorag stores its vectors"}]}`,
+			status: http.StatusOK,
+			system: []string{"be brief", "Context:", "gorag stores its vectors in qdrant"},
+		},
+		{
+			name:   "nothing retrieved",
+			body:   `{"messages":[{"role":"user","content":"bake a cake"}]}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "no messages",
+			body:   `{"messages":[]}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+			ingestTestDocuments(t, e, map[string]string{"guide": "gorag stores its vectors in qdrant"})
+
+			resp := postTestJson(e, "/v1/chat/completions", tt.body)
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				var oer openaiErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &oer); err != nil || oer.Error.Code != tt.status {
+					t.Fatalf("got error %s, want an OpenAI error of code %d", resp.Body, tt.status)
+				}
+				return
+			}
+
+			var result struct {
+				Choices []struct {
+					Message llamaCompletionMessage `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(result.Choices) != 1 || result.Choices[0].Message.Content != "hello" {
+				t.Fatalf("got answer %s", resp.Body)
+			}
+
+			messages, _ := llama.lastCompletion()["messages"].([]any)
+			first, _ := messages[0].(map[string]any)
+
+			if tt.system == nil {
+				if first["role"] == LlamaRoleSystem {
+					t.Fatalf("system message added without context: %v", first)
+				}
+				return
+			}
+
+			if first["role"] != LlamaRoleSystem {
+				t.Fatalf("got first message %v, want the system one", first)
+			}
+
+			content, _ := first["content"].(string)
+			for _, want := range tt.system {
+				if !strings.Contains(content, want) {
+					t.Fatalf("system message '%s' lacks '%s'", content, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAIChatStream(t *testing.T) {
+	e, llama, _ := newTestEngine(t)
+
+	resp := postTestJson(e, "/v1/chat/completions", `{"stream":true,"messages":[{"role":"user","content":"hello"}]}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", resp.Code, resp.Body)
+	}
+
+	var data []string
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	if len(data) != len(llama.stream)+1 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("got data %q, want the %d chunks then [DONE]", data, len(llama.stream))
+	}
+
+	var content strings.Builder
+	for _, chunk := range data[:len(data)-1] {
+		var stream LlamaCompletionStream
+		if err := json.Unmarshal([]byte(chunk), &stream); err != nil {
+			t.Fatal(err)
+		}
+		content.WriteString(stream.Content())
+	}
+
+	if content.String() != "hello" {
+		t.Fatalf("got content '%s', want 'hello'", content.String())
+	}
+}
+
+func TestOpenAIChatModel(t *testing.T) {
+	tests := []struct {
+		name        string
+		model       string
+		status      int
+		want        string
+		temperature float64
+	}{
+		{"collection default", "", http.StatusOK, "big", float64(LlamaDefaultTemperature)},
+		{"requested", "small", http.StatusOK, "small", 0.5},
+		{"unknown", "gpt-4", http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+
+			temperature := float32(0.5)
+			e.WithModels(&EngineModelRegistry{
+				Models: map[string]EngineModel{
+					"small": {Servers: llama.url, Temperature: &temperature},
+					"big":   {Servers: llama.url},
+				},
+				Default:     "small",
+				Collections: map[string]string{testCollection: "big"},
+			})
+
+			resp := postTestJson(e, "/v1/chat/completions",
+				`{"model":"`+tt.model+`","messages":[{"role":"user","content":"hello"}]}`)
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				if payload := llama.lastCompletion(); payload != nil {
+					t.Fatalf("unknown model sent upstream: %v", payload)
+				}
+				return
+			}
+
+			payload := llama.lastCompletion()
+			if payload["model"] != tt.want {
+				t.Fatalf("got model %v, want %s", payload["model"], tt.want)
+			}
+
+			if got, _ := payload["temperature"].(float64); float32(got) != float32(tt.temperature) {
+				t.Fatalf("got temperature %v, want %v", payload["temperature"], tt.temperature)
+			}
+		})
+	}
+}
+
+func TestOpenAIEmbeddings(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		inputs []string
+	}{
+		{"string", `{"input":"hello world"}`, http.StatusOK, []string{"hello world"}},
+		{"list", `{"input":["hello","world"]}`, http.StatusOK, []string{"hello", "world"}},
+		{"other model", `{"model":"text-embedding-3-small","input":"hello"}`, http.StatusOK, []string{"hello"}},
+		{"no input", `{"model":"text-embedding-3-small"}`, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _, _ := newTestEngine(t)
+
+			resp := postTestJson(e, "/v1/embeddings", tt.body)
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var oresp openaiEmbedResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &oresp); err != nil {
+				t.Fatal(err)
+			}
+
+			// The model that embedded, whatever the one requested
+			if oresp.Model != testEmbedModel {
+				t.Fatalf("got model '%s', want '%s'", oresp.Model, testEmbedModel)
+			}
+
+			if len(oresp.Data) != len(tt.inputs) {
+				t.Fatalf("got %d embeddings, want %d", len(oresp.Data), len(tt.inputs))
+			}
+
+			for i, data := range oresp.Data {
+				if data.Index != i || !slices.Equal(data.Embedding, testEmbedding(tt.inputs[i])) {
+					t.Fatalf("embedding %d is not the one of '%s'", i, tt.inputs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package gorag_engine
+
+// EnginePrompts: the prompt templates of the engine. Empty ones fall back
+// to the built in prompts.
+type EnginePrompts struct {
+	// System: system prompt of RAG completions
+	System string `json:"system,omitempty" yaml:"system,omitempty"`
+	// Assistant: introduces the retrieved context
+	Assistant string `json:"assistant,omitempty" yaml:"assistant,omitempty"`
+	// Agent: system prompt of agent completions
+	Agent string `json:"agent,omitempty" yaml:"agent,omitempty"`
+	// JsonSchema: followed by the schema of json_schema completions
+	JsonSchema string `json:"json_schema,omitempty" yaml:"json_schema,omitempty"`
+}
+
+func NewEnginePrompts() EnginePrompts {
+	return EnginePrompts{
+		System:     LlamaRagSystemPrompt,
+		Assistant:  LlamaRagAssistantPrompt,
+		Agent:      LlamaAgentSystemPrompt,
+		JsonSchema: LlamaJsonSchemaPrompt,
+	}
+}
+
+// Merge returns the prompts of p, and the ones of defaults where p has none
+func (p EnginePrompts) Merge(defaults EnginePrompts) EnginePrompts {
+	if len(p.System) == 0 {
+		p.System = defaults.System
+	}
+
+	if len(p.Assistant) == 0 {
+		p.Assistant = defaults.Assistant
+	}
+
+	if len(p.Agent) == 0 {
+		p.Agent = defaults.Agent
+	}
+
+	if len(p.JsonSchema) == 0 {
+		p.JsonSchema = defaults.JsonSchema
+	}
+
+	return p
+}
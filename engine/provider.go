@@ -0,0 +1,537 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LLM backends, selected per server with a "<provider>+" url prefix
+// (e.g. "ollama+http://localhost:11434?model=llama3"). Servers without
+// a prefix are llama.cpp servers.
+const (
+	LlamaProviderLlamaCpp string = "llamacpp"
+	LlamaProviderOllama   string = "ollama"
+	LlamaProviderOpenAI   string = "openai"
+)
+
+// ErrUnsupported is returned for operations a provider does not offer
+var ErrUnsupported = errors.New("operation not supported by provider")
+
+// LlamaProvider translates gorag requests to and from a LLM backend API
+type LlamaProvider interface {
+	Name() string
+	// Model: the model named by the server specification, if any
+	Model() string
+	// HealthPath is probed with GET by health checks
+	HealthPath() string
+	// Authorize adds credentials to every request sent to the server
+	Authorize(req *http.Request)
+
+	CompletionRequest(data *llamaCompletionRequest) (path string, payload []byte, err error)
+	DecodeCompletion(body []byte) (result *LlamaCompletionResponse, err error)
+	// DecodeStreamLine decodes a line of a streamed answer; a nil chunk
+	// means the line carries nothing (comments, keep-alives)
+	DecodeStreamLine(line string) (chunk *LlamaCompletionStream, done bool, err error)
+
+	EmbedRequest(inputs []string) (path string, payload []byte, err error)
+	DecodeEmbeddings(body []byte, count int) (model string, embeddings [][]float32, err error)
+
+	TokenizeRequest(input string) (path string, payload []byte, err error)
+}
+
+// newLlamaProvider parses a server specification into its base url and provider
+func newLlamaProvider(spec string) (baseUrl string, provider LlamaProvider, err error) {
+	name := LlamaProviderLlamaCpp
+	if prefix, rest, found := strings.Cut(spec, "+"); found && !strings.Contains(prefix, "/") {
+		name, spec = prefix, rest
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Credentials and model are gorag settings, not part of the server url
+	apiKey := u.User.Username()
+	model := u.Query().Get("model")
+	u.User = nil
+	u.RawQuery = ""
+
+	baseUrl = strings.TrimRight(u.String(), "/")
+
+	// Only llama.cpp servers serve a model of their own
+	if (name == LlamaProviderOpenAI || name == LlamaProviderOllama) && len(model) == 0 {
+		return "", nil, fmt.Errorf("%s server '%s' needs a model, e.g. '%s+%s?model=NAME'", name, baseUrl, name, baseUrl)
+	}
+
+	switch name {
+	case LlamaProviderLlamaCpp:
+		return baseUrl, &llamaCppProvider{openaiProvider{model: model, apiKey: apiKey}}, nil
+	case LlamaProviderOpenAI:
+		return baseUrl, &openaiProvider{model: model, apiKey: apiKey}, nil
+	case LlamaProviderOllama:
+		return baseUrl, &ollamaProvider{model: model}, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown provider '%s' for server '%s'", name, baseUrl)
+}
+
+// ------------------------------------------------------------------------
+// OpenAI compatible servers
+// ------------------------------------------------------------------------
+
+type openaiProvider struct {
+	model  string
+	apiKey string
+}
+
+// openaiCompletionRequest only keeps the fields of the OpenAI API
+type openaiCompletionRequest struct {
+	Model       string                   `json:"model,omitempty"`
+	Messages    []llamaCompletionMessage `json:"messages"`
+	Stream      bool                     `json:"stream"`
+	Temperature float32                  `json:"temperature"`
+	TopP        float32                  `json:"top_p,omitempty"`
+	MaxTokens   int                      `json:"max_tokens,omitempty"`
+	Seed        *int                     `json:"seed,omitempty"`
+	Stop        []string                 `json:"stop,omitempty"`
+	// Penalties
+	PresencePenalty  float32               `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32               `json:"frequency_penalty,omitempty"`
+	ResponseFormat   *openaiResponseFormat `json:"response_format,omitempty"`
+	Tools            []LlamaTool           `json:"tools,omitempty"`
+	StreamOptions    *llamaStreamOptions   `json:"stream_options,omitempty"`
+}
+
+type openaiJsonSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict"`
+}
+
+// openaiResponseFormat asks for an answer following a JSON schema
+type openaiResponseFormat struct {
+	Type       string            `json:"type"`
+	JsonSchema *openaiJsonSchema `json:"json_schema,omitempty"`
+}
+
+func (p *openaiProvider) Name() string {
+	return LlamaProviderOpenAI
+}
+
+func (p *openaiProvider) Model() string {
+	return p.model
+}
+
+func (p *openaiProvider) HealthPath() string {
+	return "/v1/models"
+}
+
+func (p *openaiProvider) Authorize(req *http.Request) {
+	if len(p.apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+}
+
+func (p *openaiProvider) getModel(model string) string {
+	if len(p.model) > 0 {
+		return p.model
+	}
+
+	return model
+}
+
+func (p *openaiProvider) CompletionRequest(data *llamaCompletionRequest) (path string, payload []byte, err error) {
+	request := openaiCompletionRequest{
+		Model:            p.getModel(data.Model),
+		Messages:         data.Messages,
+		Stream:           data.Stream,
+		Temperature:      data.Temperature,
+		TopP:             data.TopP,
+		MaxTokens:        data.MaxTokens,
+		Stop:             data.Stop,
+		PresencePenalty:  data.PresencePenalty,
+		FrequencyPenalty: data.FrequencyPenalty,
+		Tools:            data.Tools,
+		StreamOptions:    data.StreamOptions,
+	}
+
+	if len(data.JsonSchema) > 0 {
+		request.ResponseFormat = &openaiResponseFormat{
+			Type: "json_schema",
+			JsonSchema: &openaiJsonSchema{
+				Name:   "answer",
+				Schema: data.JsonSchema,
+				Strict: true,
+			},
+		}
+	}
+
+	// llama.cpp uses -1 for a random seed, OpenAI leaves it out
+	if data.Seed >= 0 {
+		request.Seed = &data.Seed
+	}
+
+	payload, err = json.Marshal(request)
+
+	return "/v1/chat/completions", payload, err
+}
+
+func (p *openaiProvider) DecodeCompletion(body []byte) (result *LlamaCompletionResponse, err error) {
+	result = &LlamaCompletionResponse{}
+	if err = json.Unmarshal(body, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (p *openaiProvider) DecodeStreamLine(line string) (chunk *LlamaCompletionStream, done bool, err error) {
+	payload, found := strings.CutPrefix(line, "data:")
+	if !found {
+		return nil, false, nil
+	}
+
+	payload = strings.TrimSpace(payload)
+	if payload == "[DONE]" {
+		return nil, true, nil
+	}
+
+	chunk = &LlamaCompletionStream{}
+	if err = json.Unmarshal([]byte(payload), chunk); err != nil {
+		return nil, false, fmt.Errorf("invalid chunk '%s': %w", payload, err)
+	}
+
+	return chunk, false, nil
+}
+
+func (p *openaiProvider) EmbedRequest(inputs []string) (path string, payload []byte, err error) {
+	payload, err = json.Marshal(llamaEmbedRequest{
+		Model: p.model,
+		Input: inputs,
+	})
+
+	return "/v1/embeddings", payload, err
+}
+
+func (p *openaiProvider) DecodeEmbeddings(body []byte, count int) (model string, embeddings [][]float32, err error) {
+	var resp llamaEmbedResponse
+
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return "", nil, err
+	}
+
+	if len(resp.Data) != count {
+		return "", nil, fmt.Errorf("got %d embeddings for %d inputs", len(resp.Data), count)
+	}
+
+	embeddings = make([][]float32, count)
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= count {
+			return "", nil, fmt.Errorf("invalid embedding index %d", data.Index)
+		}
+
+		embeddings[data.Index] = data.Embedding
+	}
+
+	return resp.Model, embeddings, nil
+}
+
+func (p *openaiProvider) TokenizeRequest(input string) (path string, payload []byte, err error) {
+	return "", nil, ErrUnsupported
+}
+
+// ------------------------------------------------------------------------
+// llama.cpp: OpenAI compatible, plus its own sampling fields and /tokenize
+// ------------------------------------------------------------------------
+
+type llamaCppProvider struct {
+	openaiProvider
+}
+
+func (p *llamaCppProvider) Name() string {
+	return LlamaProviderLlamaCpp
+}
+
+func (p *llamaCppProvider) HealthPath() string {
+	return "/health"
+}
+
+func (p *llamaCppProvider) CompletionRequest(data *llamaCompletionRequest) (path string, payload []byte, err error) {
+	request := *data
+	request.Model = p.getModel(data.Model)
+
+	payload, err = json.Marshal(request)
+
+	return "/v1/chat/completions", payload, err
+}
+
+func (p *llamaCppProvider) TokenizeRequest(input string) (path string, payload []byte, err error) {
+	payload, err = json.Marshal(llamaTokenizeRequest{
+		Content: input,
+	})
+
+	return "/tokenize", payload, err
+}
+
+// ------------------------------------------------------------------------
+// Ollama native API
+// ------------------------------------------------------------------------
+
+type ollamaProvider struct {
+	model string
+}
+
+type ollamaOptions struct {
+	Temperature      float32  `json:"temperature"`
+	TopK             int      `json:"top_k,omitempty"`
+	TopP             float32  `json:"top_p,omitempty"`
+	MinP             float32  `json:"min_p,omitempty"`
+	TypicalP         float32  `json:"typical_p,omitempty"`
+	NumPredict       int      `json:"num_predict,omitempty"`
+	NumKeep          int      `json:"num_keep,omitempty"`
+	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
+	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
+	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Mirostat         int      `json:"mirostat,omitempty"`
+	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
+	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
+}
+
+// ollamaToolCall: unlike OpenAI, arguments are a JSON object
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Tools    []LlamaTool     `json:"tools,omitempty"`
+	// Format: a JSON schema the answer must follow
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options ollamaOptions   `json:"options"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (p *ollamaProvider) Name() string {
+	return LlamaProviderOllama
+}
+
+func (p *ollamaProvider) Model() string {
+	return p.model
+}
+
+func (p *ollamaProvider) HealthPath() string {
+	return "/api/version"
+}
+
+func (p *ollamaProvider) Authorize(req *http.Request) {
+}
+
+func (p *ollamaProvider) CompletionRequest(data *llamaCompletionRequest) (path string, payload []byte, err error) {
+	model := p.model
+	if len(model) == 0 {
+		model = data.Model
+	}
+
+	messages := make([]ollamaMessage, len(data.Messages))
+	for i, message := range data.Messages {
+		messages[i] = ollamaMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		}
+
+		for _, call := range message.ToolCalls {
+			var oc ollamaToolCall
+
+			oc.Function.Name = call.Function.Name
+			oc.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if !json.Valid(oc.Function.Arguments) {
+				oc.Function.Arguments = json.RawMessage("{}")
+			}
+
+			messages[i].ToolCalls = append(messages[i].ToolCalls, oc)
+		}
+	}
+
+	// Ollama picks a random seed when left out, like llama.cpp does with -1
+	var seed *int
+	if data.Seed >= 0 {
+		seed = &data.Seed
+	}
+
+	payload, err = json.Marshal(ollamaChatRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   data.Stream,
+		Tools:    data.Tools,
+		Format:   data.JsonSchema,
+		Options: ollamaOptions{
+			Temperature:      data.Temperature,
+			TopK:             data.TopK,
+			TopP:             data.TopP,
+			MinP:             data.MinP,
+			TypicalP:         data.TypicalP,
+			NumPredict:       data.N_predict,
+			NumKeep:          max(data.N_keep, 0),
+			RepeatPenalty:    data.RepeatPenalty,
+			RepeatLastN:      data.RepeatLastN,
+			PresencePenalty:  data.PresencePenalty,
+			FrequencyPenalty: data.FrequencyPenalty,
+			Seed:             seed,
+			Stop:             data.Stop,
+			Mirostat:         data.Mirostat,
+			MirostatTau:      data.MirostatTau,
+			MirostatEta:      data.MirostatEta,
+		},
+	})
+
+	return "/api/chat", payload, err
+}
+
+// getToolCalls converts ollama tool calls, which come whole, to the OpenAI format
+func (r *ollamaChatResponse) getToolCalls() (calls []LlamaToolCall) {
+	for i, oc := range r.Message.ToolCalls {
+		var call LlamaToolCall
+
+		call.Index = i
+		call.Id = fmt.Sprintf("call_%d", i)
+		call.Type = "function"
+		call.Function.Name = oc.Function.Name
+		call.Function.Arguments = string(oc.Function.Arguments)
+
+		calls = append(calls, call)
+	}
+
+	return calls
+}
+
+// toCompletionStream converts an ollama answer to the OpenAI chunk format
+func (r *ollamaChatResponse) toCompletionStream() *LlamaCompletionStream {
+	chunk := &LlamaCompletionStream{
+		Model:   r.Model,
+		Object:  "chat.completion.chunk",
+		Choices: make([]LlamaCompletionStreamChoice, 1),
+	}
+
+	chunk.Choices[0].Delta.Content = r.Message.Content
+	chunk.Choices[0].Delta.ToolCalls = r.getToolCalls()
+
+	if r.Done {
+		chunk.Choices[0].FinishReason = r.DoneReason
+		chunk.Usage = &LlamaCompletionUsage{
+			PromptTokens:     r.PromptEvalCount,
+			CompletionTokens: r.EvalCount,
+			TotalTokens:      r.PromptEvalCount + r.EvalCount,
+		}
+	}
+
+	return chunk
+}
+
+func (p *ollamaProvider) DecodeCompletion(body []byte) (result *LlamaCompletionResponse, err error) {
+	var resp ollamaChatResponse
+
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	result = &LlamaCompletionResponse{
+		Model:   resp.Model,
+		Object:  "chat.completion",
+		Choices: make([]LlamaCompletionChoice, 1),
+		Usage: LlamaCompletionUsage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		},
+	}
+
+	result.Choices[0].FinishReason = resp.DoneReason
+	result.Choices[0].Message = llamaCompletionMessage{
+		Role:      resp.Message.Role,
+		Content:   resp.Message.Content,
+		ToolCalls: resp.getToolCalls(),
+	}
+
+	return result, nil
+}
+
+// DecodeStreamLine: ollama streams one json object per line
+func (p *ollamaProvider) DecodeStreamLine(line string) (chunk *LlamaCompletionStream, done bool, err error) {
+	var resp ollamaChatResponse
+
+	if len(line) == 0 {
+		return nil, false, nil
+	}
+
+	if err = json.Unmarshal([]byte(line), &resp); err != nil {
+		return nil, false, fmt.Errorf("invalid chunk '%s': %w", line, err)
+	}
+
+	chunk = resp.toCompletionStream()
+	if len(resp.Error) > 0 {
+		chunk.Error = &LlamaCompletionError{Message: resp.Error}
+	}
+
+	return chunk, false, nil
+}
+
+func (p *ollamaProvider) EmbedRequest(inputs []string) (path string, payload []byte, err error) {
+	payload, err = json.Marshal(struct {
+		Model string   `json:"model"`
+		Input []string `json:"input"`
+	}{
+		Model: p.model,
+		Input: inputs,
+	})
+
+	return "/api/embed", payload, err
+}
+
+func (p *ollamaProvider) DecodeEmbeddings(body []byte, count int) (model string, embeddings [][]float32, err error) {
+	var resp struct {
+		Model      string      `json:"model"`
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return "", nil, err
+	}
+
+	if len(resp.Embeddings) != count {
+		return "", nil, fmt.Errorf("got %d embeddings for %d inputs", len(resp.Embeddings), count)
+	}
+
+	return resp.Model, resp.Embeddings, nil
+}
+
+func (p *ollamaProvider) TokenizeRequest(input string) (path string, payload []byte, err error) {
+	return "", nil, ErrUnsupported
+}
@@ -0,0 +1,262 @@
+package gorag_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testUpstream: a fake LLM server answering with canned bodies by path,
+// and keeping the last request it got
+type testUpstream struct {
+	bodies        map[string]string
+	path          string
+	payload       map[string]any
+	authorization string
+}
+
+func (u *testUpstream) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	data, _ := io.ReadAll(req.Body)
+
+	u.path = req.URL.Path
+	u.authorization = req.Header.Get("Authorization")
+	u.payload = nil
+	json.Unmarshal(data, &u.payload)
+
+	body, found := u.bodies[req.URL.Path]
+	if !found {
+		http.NotFound(resp, req)
+		return
+	}
+
+	resp.Write([]byte(body))
+}
+
+func newTestLlamaEngine(t *testing.T, spec string) *LlamaEngine {
+	options := NewLlamaClientOptions()
+	options.HealthInterval = 0
+	options.MaxRetries = 0
+
+	l := NewLlamaEngine(spec, spec).WithClientOptions(options)
+	t.Cleanup(l.Close)
+
+	return l
+}
+
+var testProviders = []struct {
+	name           string
+	prefix         string
+	completionPath string
+	completion     string
+	stream         string
+	embedPath      string
+	embeddings     string
+	authorization  string
+}{
+	{
+		name:           "llama.cpp",
+		prefix:         "",
+		completionPath: "/v1/chat/completions",
+		completion:     `{"model":"m","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hello"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+		stream: "data: {\"choices\":[{\"delta\":{\"content\":\"hel\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n" +
+			"data: [DONE]\n\n",
+		embedPath:     "/v1/embeddings",
+		embeddings:    `{"model":"m","data":[{"index":1,"embedding":[3,4]},{"index":0,"embedding":[1,2]}]}`,
+		authorization: "Bearer secret",
+	},
+	{
+		name:           "openai",
+		prefix:         "openai+",
+		completionPath: "/v1/chat/completions",
+		completion:     `{"model":"m","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hello"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`,
+		stream: ": keep-alive\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"hel\"}}]}\n\n" +
+			"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n" +
+			"data: [DONE]\n\n",
+		embedPath:     "/v1/embeddings",
+		embeddings:    `{"model":"m","data":[{"index":0,"embedding":[1,2]},{"index":1,"embedding":[3,4]}]}`,
+		authorization: "Bearer secret",
+	},
+	{
+		name:           "ollama",
+		prefix:         "ollama+",
+		completionPath: "/api/chat",
+		completion:     `{"model":"m","message":{"role":"assistant","content":"hello"},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":1}`,
+		stream: "{\"model\":\"m\",\"message\":{\"role\":\"assistant\",\"content\":\"hel\"},\"done\":false}\n" +
+			"{\"model\":\"m\",\"message\":{\"role\":\"assistant\",\"content\":\"lo\"},\"done\":true,\"done_reason\":\"stop\"}\n",
+		embedPath:     "/api/embed",
+		embeddings:    `{"model":"m","embeddings":[[1,2],[3,4]]}`,
+		authorization: "",
+	},
+}
+
+func TestProviderCompletion(t *testing.T) {
+	for _, test := range testProviders {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &testUpstream{bodies: map[string]string{test.completionPath: test.completion}}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+
+			spec := test.prefix + strings.Replace(server.URL, "://", "://secret@", 1) + "?model=m"
+			l := newTestLlamaEngine(t, spec)
+
+			data := NewCompletionRequest().WithMessages([]llamaCompletionMessage{{Role: "user", Content: "hi"}})
+			data.Seed = -1
+
+			result, err := l.GetCompletion(context.Background(), data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if upstream.path != test.completionPath || upstream.authorization != test.authorization {
+				t.Fatalf("got %s with '%s'", upstream.path, upstream.authorization)
+			}
+
+			if upstream.payload["model"] != "m" || upstream.payload["stream"] != false {
+				t.Fatalf("unexpected payload %v", upstream.payload)
+			}
+
+			// A random seed is left out, but by llama.cpp which wants -1
+			_, seeded := upstream.payload["seed"]
+			if options, ok := upstream.payload["options"].(map[string]any); ok {
+				_, seeded = options["seed"]
+			}
+			if seeded != (test.prefix == "") {
+				t.Fatalf("seed sent: %v", seeded)
+			}
+
+			if len(result.Choices) != 1 || result.Choices[0].Message.Content != "hello" ||
+				result.Choices[0].FinishReason != "stop" || result.Usage.TotalTokens != 4 {
+				t.Fatalf("unexpected result %+v", result)
+			}
+		})
+	}
+}
+
+func TestProviderStream(t *testing.T) {
+	for _, test := range testProviders {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &testUpstream{bodies: map[string]string{test.completionPath: test.stream}}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+
+			l := newTestLlamaEngine(t, test.prefix+server.URL+"?model=m")
+
+			var content, reason string
+			data := NewCompletionRequest().WithMessages([]llamaCompletionMessage{{Role: "user", Content: "hi"}})
+
+			err := l.GetCompletions(context.Background(), data, func(chunk *LlamaCompletionStream) error {
+				content += chunk.Content()
+				if len(chunk.FinishReason()) > 0 {
+					reason = chunk.FinishReason()
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if upstream.payload["stream"] != true {
+				t.Fatalf("completion not streamed: %v", upstream.payload)
+			}
+
+			if content != "hello" || reason != "stop" {
+				t.Fatalf("got '%s' (%s)", content, reason)
+			}
+		})
+	}
+}
+
+func TestProviderEmbeddings(t *testing.T) {
+	for _, test := range testProviders {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &testUpstream{bodies: map[string]string{test.embedPath: test.embeddings}}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+
+			l := newTestLlamaEngine(t, test.prefix+server.URL+"?model=m")
+
+			embeds, err := l.GetEmbeddings(context.Background(), []string{"a", "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if upstream.path != test.embedPath {
+				t.Fatalf("embeddings asked to %s", upstream.path)
+			}
+
+			if embeds.Model != "m" || len(embeds.Embeddings) != 2 ||
+				!slices.Equal(embeds.Embeddings[0], []float32{1, 2}) ||
+				!slices.Equal(embeds.Embeddings[1], []float32{3, 4}) {
+				t.Fatalf("unexpected embeddings %+v", embeds)
+			}
+		})
+	}
+}
+
+func TestProviderTokenize(t *testing.T) {
+	for _, test := range testProviders {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := &testUpstream{bodies: map[string]string{"/tokenize": `{"tokens":[1,2,3]}`}}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+
+			l := newTestLlamaEngine(t, test.prefix+server.URL+"?model=m")
+
+			tokens, err := l.Tokenize(context.Background(), "hello")
+			if test.prefix != "" {
+				if !errors.Is(err, ErrUnsupported) {
+					t.Fatalf("got %v, want ErrUnsupported", err)
+				}
+				return
+			}
+
+			if err != nil || len(tokens) != 3 {
+				t.Fatalf("got %v (%v)", tokens, err)
+			}
+		})
+	}
+}
+
+func TestNewLlamaProvider(t *testing.T) {
+	tests := []struct {
+		spec     string
+		baseUrl  string
+		provider string
+		valid    bool
+	}{
+		{"http://localhost:8080/", "http://localhost:8080", LlamaProviderLlamaCpp, true},
+		{"ollama+http://localhost:11434?model=llama3", "http://localhost:11434", LlamaProviderOllama, true},
+		{"openai+https://key@api.test/v1?model=gpt", "https://api.test/v1", LlamaProviderOpenAI, true},
+		{"ollama+http://localhost:11434", "", "", false},
+		{"openai+https://key@api.test/v1", "", "", false},
+		{"vllm+http://localhost:8000", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			baseUrl, provider, err := newLlamaProvider(test.spec)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("accepted")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if baseUrl != test.baseUrl || provider.Name() != test.provider {
+				t.Fatalf("got %s (%s)", baseUrl, provider.Name())
+			}
+		})
+	}
+}
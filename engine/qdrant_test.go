@@ -0,0 +1,292 @@
+package gorag_engine
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qdrant/go-client/qdrant"
+	"google.golang.org/grpc"
+)
+
+// testQdrant: an in memory qdrant, serving the few calls gorag makes over
+// gRPC, with the filter conditions gorag uses
+type testQdrant struct {
+	qdrant.UnimplementedPointsServer
+
+	mu          sync.Mutex
+	collections map[string]map[string]*qdrant.PointStruct
+	// failUpsert makes every upsert fail
+	failUpsert bool
+}
+
+// newTestQdrant starts a qdrant server, and returns it with a client
+func newTestQdrant(t *testing.T) (*testQdrant, *qdrant.Client) {
+	q := &testQdrant{collections: make(map[string]map[string]*qdrant.PointStruct)}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	qdrant.RegisterPointsServer(server, q)
+	qdrant.RegisterCollectionsServer(server, &testQdrantCollections{q: q})
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := qdrant.NewClient(&qdrant.Config{
+		Host:                   "127.0.0.1",
+		Port:                   listener.Addr().(*net.TCPAddr).Port,
+		PoolSize:               1,
+		SkipCompatibilityCheck: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q, client
+}
+
+// points returns the points of collection, sorted by document and chunk
+func (q *testQdrant) points(collection string) (points []*qdrant.PointStruct) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, point := range q.collections[collection] {
+		points = append(points, point)
+	}
+
+	slices.SortFunc(points, func(a, b *qdrant.PointStruct) int {
+		return cmp.Or(
+			cmp.Compare(a.Payload["document"].GetStringValue(), b.Payload["document"].GetStringValue()),
+			cmp.Compare(a.Payload["chunk"].GetIntegerValue(), b.Payload["chunk"].GetIntegerValue()))
+	})
+
+	return points
+}
+
+// testQdrantCollections: the collections service of a testQdrant, apart
+// since both services have a Get method
+type testQdrantCollections struct {
+	qdrant.UnimplementedCollectionsServer
+
+	q *testQdrant
+}
+
+func (c *testQdrantCollections) CollectionExists(ctx context.Context, req *qdrant.CollectionExistsRequest) (*qdrant.CollectionExistsResponse, error) {
+	q := c.q
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, found := q.collections[req.CollectionName]
+	return &qdrant.CollectionExistsResponse{Result: &qdrant.CollectionExists{Exists: found}}, nil
+}
+
+func (c *testQdrantCollections) Create(ctx context.Context, req *qdrant.CreateCollection) (*qdrant.CollectionOperationResponse, error) {
+	q := c.q
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.collections[req.CollectionName] = make(map[string]*qdrant.PointStruct)
+	return &qdrant.CollectionOperationResponse{Result: true}, nil
+}
+
+func (q *testQdrant) Upsert(ctx context.Context, req *qdrant.UpsertPoints) (*qdrant.PointsOperationResponse, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	points, found := q.collections[req.CollectionName]
+	if !found {
+		return nil, fmt.Errorf("collection '%s' not found", req.CollectionName)
+	}
+
+	if q.failUpsert {
+		return nil, fmt.Errorf("upsert failed")
+	}
+
+	for _, point := range req.Points {
+		points[getPointIdString(point.Id)] = point
+	}
+
+	return &qdrant.PointsOperationResponse{Result: &qdrant.UpdateResult{}}, nil
+}
+
+func (q *testQdrant) Delete(ctx context.Context, req *qdrant.DeletePoints) (*qdrant.PointsOperationResponse, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	points := q.collections[req.CollectionName]
+	for id, point := range points {
+		if filter := req.Points.GetFilter(); filter != nil && matchTestFilter(filter, point.Payload) {
+			delete(points, id)
+		}
+
+		for _, pid := range req.Points.GetPoints().GetIds() {
+			if getPointIdString(pid) == id {
+				delete(points, id)
+			}
+		}
+	}
+
+	return &qdrant.PointsOperationResponse{Result: &qdrant.UpdateResult{}}, nil
+}
+
+func (q *testQdrant) Query(ctx context.Context, req *qdrant.QueryPoints) (*qdrant.QueryResponse, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	points, found := q.collections[req.CollectionName]
+	if !found {
+		return nil, fmt.Errorf("collection '%s' not found", req.CollectionName)
+	}
+
+	query := req.Query.GetNearest().GetDense().GetData()
+
+	var result []*qdrant.ScoredPoint
+	for _, point := range points {
+		if req.Filter != nil && !matchTestFilter(req.Filter, point.Payload) {
+			continue
+		}
+
+		score := float32(getCosineSimilarity(query, point.Vectors.GetVector().GetDense().GetData()))
+		if req.ScoreThreshold != nil && score < *req.ScoreThreshold {
+			continue
+		}
+
+		result = append(result, &qdrant.ScoredPoint{Id: point.Id, Payload: point.Payload, Score: score})
+	}
+
+	slices.SortFunc(result, func(a, b *qdrant.ScoredPoint) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(getPointIdString(a.Id), getPointIdString(b.Id)))
+	})
+
+	if limit := int(req.GetLimit()); limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return &qdrant.QueryResponse{Result: result}, nil
+}
+
+func (q *testQdrant) Scroll(ctx context.Context, req *qdrant.ScrollPoints) (*qdrant.ScrollResponse, error) {
+	var result []*qdrant.RetrievedPoint
+
+	for _, point := range q.points(req.CollectionName) {
+		if req.Filter == nil || matchTestFilter(req.Filter, point.Payload) {
+			result = append(result, &qdrant.RetrievedPoint{Id: point.Id, Payload: point.Payload})
+		}
+	}
+
+	if limit := int(req.GetLimit()); limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+
+	return &qdrant.ScrollResponse{Result: result}, nil
+}
+
+func matchTestFilter(filter *qdrant.Filter, payload map[string]*qdrant.Value) bool {
+	for _, condition := range filter.Must {
+		if !matchTestCondition(condition, payload) {
+			return false
+		}
+	}
+
+	for _, condition := range filter.MustNot {
+		if matchTestCondition(condition, payload) {
+			return false
+		}
+	}
+
+	if len(filter.Should) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(filter.Should, func(condition *qdrant.Condition) bool {
+		return matchTestCondition(condition, payload)
+	})
+}
+
+// getTestValues returns a payload field as a list of values, lists flattened
+func getTestValues(value *qdrant.Value) []*qdrant.Value {
+	switch kind := value.GetKind().(type) {
+	case nil, *qdrant.Value_NullValue:
+		return nil
+	case *qdrant.Value_ListValue:
+		return kind.ListValue.Values
+	}
+
+	return []*qdrant.Value{value}
+}
+
+func matchTestCondition(condition *qdrant.Condition, payload map[string]*qdrant.Value) bool {
+	if filter := condition.GetFilter(); filter != nil {
+		return matchTestFilter(filter, payload)
+	}
+
+	if empty := condition.GetIsEmpty(); empty != nil {
+		return len(getTestValues(payload[empty.Key])) == 0
+	}
+
+	field := condition.GetField()
+	if field == nil {
+		panic(fmt.Sprintf("condition not supported: %v", condition))
+	}
+
+	values := getTestValues(payload[field.Key])
+
+	if r := field.Range; r != nil {
+		return slices.ContainsFunc(values, func(v *qdrant.Value) bool {
+			n := float64(v.GetIntegerValue())
+			return (r.Gte == nil || n >= *r.Gte) && (r.Gt == nil || n > *r.Gt) &&
+				(r.Lte == nil || n <= *r.Lte) && (r.Lt == nil || n < *r.Lt)
+		})
+	}
+
+	match := field.Match
+	return slices.ContainsFunc(values, func(v *qdrant.Value) bool {
+		switch m := match.GetMatchValue().(type) {
+		case *qdrant.Match_Keyword:
+			return v.GetStringValue() == m.Keyword
+		case *qdrant.Match_Keywords:
+			return slices.Contains(m.Keywords.Strings, v.GetStringValue())
+		case *qdrant.Match_Integer:
+			return v.GetIntegerValue() == m.Integer
+		}
+		panic(fmt.Sprintf("match not supported: %v", match))
+	})
+}
+
+// testEmbedding: a bag of words embedding, for texts sharing words to be close
+func testEmbedding(text string) []float32 {
+	embedding := make([]float32, 32)
+
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		var h uint32 = 2166136261
+		for _, c := range []byte(word) {
+			h = (h ^ uint32(c)) * 16777619
+		}
+		embedding[h%32]++
+	}
+
+	var norm float64
+	for _, v := range embedding {
+		norm += float64(v * v)
+	}
+
+	if norm > 0 {
+		for i := range embedding {
+			embedding[i] /= float32(math.Sqrt(norm))
+		}
+	}
+
+	return embedding
+}
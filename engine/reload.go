@@ -0,0 +1,200 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// EngineSettings: the settings of an engine that can be reloaded while it
+// serves, API keys included. The listen address, qdrant and the caches
+// need a restart.
+type EngineSettings struct {
+	LlamaServer   string
+	EmbedServer   string
+	ClientOptions LlamaClientOptions
+	Models        *EngineModelRegistry
+
+	QdrantLimit   int64
+	Threshold     float32
+	EmbedPrefixes EmbedPrefixes
+	Prompts       EnginePrompts
+	Limits        EngineSamplingLimits
+	AgentMaxSteps int
+	HttpTools     []EngineHttpTool
+	ApiKeys       []EngineApiKey
+	Jwt           *EngineJwtOptions
+}
+
+// EngineReloader reads the settings again, from wherever they came from
+type EngineReloader func() (settings EngineSettings, err error)
+
+// engineLive: state shared by an engine and the ones reloads swap in
+type engineLive struct {
+	engine   atomic.Pointer[GoRagEngine]
+	mu       sync.Mutex
+	reloader EngineReloader
+	// server and router are shared by every engine swapped in
+	server     atomic.Pointer[http.Server]
+	router     http.Handler
+	routerOnce sync.Once
+}
+
+// WithReloader sets where POST /admin/reload reads the new settings from
+func (e *GoRagEngine) WithReloader(reloader EngineReloader) *GoRagEngine {
+	e.live.reloader = reloader
+	return e
+}
+
+// WithThreshold sets the default similarity threshold of retrievals
+func (e *GoRagEngine) WithThreshold(threshold float32) *GoRagEngine {
+	e.threshold = threshold
+	return e
+}
+
+// current returns the engine serving new requests
+func (e *GoRagEngine) current() *GoRagEngine {
+	if current := e.live.engine.Load(); current != nil {
+		return current
+	}
+
+	return e
+}
+
+// handle serves each request with the engine current when it arrived, so
+// in-flight requests finish with the settings they started with
+func (e *GoRagEngine) handle(handler func(*GoRagEngine, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		current := e.current()
+		current.withRequestId(func(resp http.ResponseWriter, req *http.Request) {
+			handler(current, resp, req)
+		})(resp, req)
+	}
+}
+
+// Validate rejects settings the engine could not serve with
+func (s *EngineSettings) Validate() error {
+	switch {
+	case s.QdrantLimit < 0:
+		return fmt.Errorf("qdrant limit must be positive")
+	case s.Threshold < 0 || s.Threshold > 1:
+		return fmt.Errorf("threshold must be between 0 and 1")
+	case s.AgentMaxSteps < 0:
+		return fmt.Errorf("agent max steps must be positive")
+	case s.Limits.MaxTemperature > 0 && s.Limits.MinTemperature > s.Limits.MaxTemperature:
+		return fmt.Errorf("min temperature is higher than max temperature")
+	}
+
+	if len(NewLlamaUpstreamPool(s.LlamaServer).upstreams) == 0 {
+		return fmt.Errorf("no valid llama server in '%s'", s.LlamaServer)
+	}
+
+	if len(NewLlamaUpstreamPool(s.EmbedServer).upstreams) == 0 {
+		return fmt.Errorf("no valid embed server in '%s'", s.EmbedServer)
+	}
+
+	if s.Models != nil {
+		if err := s.Models.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := ValidateEngineHttpTools(s.HttpTools); err != nil {
+		return err
+	}
+
+	if err := ValidateEngineApiKeys(s.ApiKeys); err != nil {
+		return err
+	}
+
+	if s.Jwt != nil {
+		return s.Jwt.Validate()
+	}
+
+	return nil
+}
+
+// Reload validates settings, then swaps in an engine using them. Requests
+// already running keep the previous engine; invalid settings change nothing.
+func (e *GoRagEngine) Reload(settings EngineSettings) (err error) {
+	if err = settings.Validate(); err != nil {
+		return fmt.Errorf("reload rejected: %w", err)
+	}
+
+	e.live.mu.Lock()
+	defer e.live.mu.Unlock()
+
+	previous := e.current()
+	next := *previous
+
+	next.LlamaClient = NewLlamaEngine("", "")
+	next.WithLlamaClientOptions(settings.ClientOptions).
+		WithLlamaServer(settings.LlamaServer).
+		WithEmbedServer(settings.EmbedServer).
+		WithModels(settings.Models).
+		WithQdrantLimit(settings.QdrantLimit).
+		WithThreshold(settings.Threshold).
+		WithEmbedPrefixes(settings.EmbedPrefixes).
+		WithPrompts(settings.Prompts).
+		WithSamplingLimits(settings.Limits).
+		WithAgent(settings.AgentMaxSteps, settings.HttpTools).
+		WithApiKeys(settings.ApiKeys).
+		WithJwt(settings.Jwt)
+
+	// Custom embedders are kept, the default one follows the new servers
+	if _, ok := previous.Embedder.(*LlamaEmbedder); ok || previous.Embedder == nil {
+		next.Embedder = NewLlamaEmbedder(next.LlamaClient)
+	}
+
+	if previous.LlamaClient != nil && previous.LlamaClient.healthChecking() {
+		next.LlamaClient.StartHealthChecks()
+	}
+
+	e.live.engine.Store(&next)
+
+	// In-flight requests only lose idle connections
+	if previous.LlamaClient != nil {
+		previous.LlamaClient.Close()
+	}
+
+	log.Printf("[GoRagEngine::Reload] settings reloaded\n")
+
+	return nil
+}
+
+// reload runs the reloader, then Reload
+func (e *GoRagEngine) reload() (err error) {
+	if e.live.reloader == nil {
+		return fmt.Errorf("reload is not configured")
+	}
+
+	settings, err := e.live.reloader()
+	if err != nil {
+		return fmt.Errorf("reload rejected: %w", err)
+	}
+
+	return e.Reload(settings)
+}
+
+func (e *GoRagEngine) handleAdminReload(resp http.ResponseWriter, req *http.Request) {
+	if err := e.reload(); err != nil {
+		log.Printf("[handleAdminReload] %s\n", err.Error())
+		e.sendResponseErrorStatus(http.StatusUnprocessableEntity, EngineErrorCodeInvalidRequest, err.Error(), resp)
+		return
+	}
+
+	b, err := json.Marshal(EngineResponseJson{
+		Status:  "success",
+		Message: "settings reloaded",
+	})
+	if err != nil {
+		e.sendResponseError(err.Error(), resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(b)
+}
@@ -0,0 +1,79 @@
+package gorag_engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newReloadSettings(server string) EngineSettings {
+	settings := EngineSettings{
+		LlamaServer:   server,
+		EmbedServer:   server,
+		ClientOptions: NewLlamaClientOptions(),
+		Prompts:       NewEnginePrompts(),
+		Limits:        NewEngineSamplingLimits(),
+	}
+	settings.ClientOptions.HealthInterval = time.Millisecond
+
+	return settings
+}
+
+// Run with -race: reloads swap the llama client while Handler starts its
+// health checks
+func TestReloadWhileStartingHealthChecks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer upstream.Close()
+
+	settings := newReloadSettings(upstream.URL)
+
+	e := NewEngine().
+		WithLlamaClientOptions(settings.ClientOptions).
+		WithLlamaServer(settings.LlamaServer).
+		WithEmbedServer(settings.EmbedServer)
+	defer e.Finalize()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			e.Handler()
+		}()
+
+		go func() {
+			defer wg.Done()
+			if err := e.Reload(settings); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !e.current().LlamaClient.healthChecking() {
+		t.Fatalf("health checks stopped by a reload")
+	}
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	e := NewEngine().WithLlamaServer("http://127.0.0.1:1").WithEmbedServer("http://127.0.0.1:1")
+	defer e.Finalize()
+
+	before := e.current()
+
+	settings := newReloadSettings("http://127.0.0.1:1")
+	settings.Threshold = 2
+
+	if err := e.Reload(settings); err == nil {
+		t.Fatalf("reload accepted a threshold of 2")
+	}
+
+	if e.current() != before {
+		t.Fatalf("rejected reload swapped the engine")
+	}
+}
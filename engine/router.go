@@ -0,0 +1,128 @@
+package gorag_engine
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// EngineApiPrefix: the versioned root of the gorag API
+	EngineApiPrefix string = "/api/v1"
+
+	engineCorsAllowHeaders string = "authorization, content-type, " + EngineRequestIdHeader
+)
+
+type engineHandler func(*GoRagEngine, http.ResponseWriter, *http.Request)
+
+// engineRouter: a mux matching methods, which also answers preflights and
+// methods a path does not serve
+type engineRouter struct {
+	mux     *http.ServeMux
+	engine  *GoRagEngine
+	methods map[string][]string
+}
+
+func newEngineRouter(e *GoRagEngine) *engineRouter {
+	return &engineRouter{
+		mux:     http.NewServeMux(),
+		engine:  e,
+		methods: make(map[string][]string),
+	}
+}
+
+// route serves method on path with handler, to keys having scope
+func (r *engineRouter) route(method string, path string, scope string, handler engineHandler) {
+	r.mux.HandleFunc(method+" "+path, r.engine.handle(authorize(scope, handler)))
+
+	if _, found := r.methods[path]; !found {
+		// Without a method, the pattern gets whatever the others do not match
+		r.mux.HandleFunc(path, r.engine.handle(func(e *GoRagEngine, resp http.ResponseWriter, req *http.Request) {
+			e.handleOtherMethods(r.getAllow(path), resp, req)
+		}))
+	}
+
+	r.methods[path] = append(r.methods[path], method)
+}
+
+func (r *engineRouter) getAllow(path string) string {
+	methods := slices.Clone(r.methods[path])
+	if slices.Contains(methods, http.MethodGet) {
+		methods = append(methods, http.MethodHead)
+	}
+	methods = append(methods, http.MethodOptions)
+
+	return strings.Join(methods, ", ")
+}
+
+func (r *engineRouter) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if len(req.Header.Get("Origin")) > 0 {
+		resp.Header().Set("Access-Control-Allow-Origin", "*")
+		resp.Header().Set("Access-Control-Expose-Headers", EngineRequestIdHeader)
+	}
+
+	r.mux.ServeHTTP(resp, req)
+}
+
+// handleOtherMethods answers CORS preflights, and 405 to other methods
+func (e *GoRagEngine) handleOtherMethods(allow string, resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Allow", allow)
+
+	if req.Method == http.MethodOptions {
+		resp.Header().Set("Access-Control-Allow-Methods", allow)
+		resp.Header().Set("Access-Control-Allow-Headers", engineCorsAllowHeaders)
+		resp.Header().Set("Access-Control-Max-Age", "86400")
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	message := fmt.Sprintf("method %s not allowed, use %s", req.Method, allow)
+
+	// The OpenAI facade answers OpenAI errors
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		e.sendOpenAIError(http.StatusMethodNotAllowed, message, resp)
+		return
+	}
+
+	e.sendResponseErrorStatus(http.StatusMethodNotAllowed, EngineErrorCodeMethodNotAllowed, message, resp)
+}
+
+// newRouter routes the API, under EngineApiPrefix, and the OpenAI facade.
+// The unversioned paths of the first releases are kept as aliases.
+func (e *GoRagEngine) newRouter() http.Handler {
+	r := newEngineRouter(e)
+
+	for _, prefix := range []string{EngineApiPrefix, "/api"} {
+		r.route(http.MethodPost, prefix+"/embedding", EngineScopeSearch, (*GoRagEngine).handleEmbedding)
+		r.route(http.MethodPost, prefix+"/completion", EngineScopeComplete, (*GoRagEngine).handleCompletion)
+	}
+
+	r.route(http.MethodPost, EngineApiPrefix+"/search", EngineScopeSearch, (*GoRagEngine).handleSearch)
+	r.route(http.MethodPost, EngineApiPrefix+"/ingest", EngineScopeIngest, (*GoRagEngine).handleIngest)
+
+	// OpenAI compatible facade
+	r.route(http.MethodPost, "/v1/chat/completions", EngineScopeComplete, (*GoRagEngine).handleOpenAIChat)
+	r.route(http.MethodPost, "/v1/embeddings", EngineScopeSearch, (*GoRagEngine).handleOpenAIEmbeddings)
+
+	// Administration
+	for _, prefix := range []string{EngineApiPrefix + "/admin", "/admin"} {
+		r.route(http.MethodGet, prefix+"/upstreams", EngineScopeAdmin, (*GoRagEngine).handleAdminUpstreams)
+		r.route(http.MethodGet, prefix+"/embed-cache", EngineScopeAdmin, (*GoRagEngine).handleAdminEmbedCache)
+		r.route(http.MethodGet, prefix+"/answer-cache", EngineScopeAdmin, (*GoRagEngine).handleAdminAnswerCache)
+		r.route(http.MethodPost, prefix+"/answer-cache/invalidate", EngineScopeAdmin, (*GoRagEngine).handleAdminAnswerCacheInvalidate)
+		r.route(http.MethodPost, prefix+"/reload", EngineScopeAdmin, (*GoRagEngine).handleAdminReload)
+	}
+
+	return r
+}
+
+// ServeHTTP serves the gorag API, so that an engine can be mounted by
+// other programs without ListenAndServe
+func (e *GoRagEngine) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	e.live.routerOnce.Do(func() {
+		e.live.router = e.newRouter()
+	})
+
+	e.live.router.ServeHTTP(resp, req)
+}
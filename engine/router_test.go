@@ -0,0 +1,83 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterMethods(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		origin string
+		status int
+		allow  string
+		code   string
+	}{
+		{"post", http.MethodPost, "/api/v1/completion", "", http.StatusBadRequest, "", ""},
+		{"alias", http.MethodPost, "/api/completion", "", http.StatusBadRequest, "", ""},
+		{"get", http.MethodGet, "/api/v1/completion", "", http.StatusMethodNotAllowed, "POST, OPTIONS", EngineErrorCodeMethodNotAllowed},
+		{"put on alias", http.MethodPut, "/api/embedding", "", http.StatusMethodNotAllowed, "POST, OPTIONS", EngineErrorCodeMethodNotAllowed},
+		{"post on get", http.MethodPost, "/api/v1/admin/upstreams", "", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", EngineErrorCodeMethodNotAllowed},
+		{"head", http.MethodHead, "/api/v1/admin/upstreams", "", http.StatusOK, "", ""},
+		{"preflight", http.MethodOptions, "/api/v1/search", "https://app.test", http.StatusNoContent, "POST, OPTIONS", ""},
+		{"openai", http.MethodGet, "/v1/chat/completions", "", http.StatusMethodNotAllowed, "POST, OPTIONS", ""},
+		{"unknown path", http.MethodPost, "/api/v2/completion", "", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _, _ := newTestEngine(t)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{}`))
+			if len(tt.origin) > 0 {
+				req.Header.Set("Origin", tt.origin)
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			resp := httptest.NewRecorder()
+			e.ServeHTTP(resp, req)
+
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if allow := resp.Header().Get("Allow"); allow != tt.allow {
+				t.Fatalf("got Allow '%s', want '%s'", allow, tt.allow)
+			}
+
+			if len(tt.code) > 0 {
+				var ej EngineResponseJson
+				if err := json.Unmarshal(resp.Body.Bytes(), &ej); err != nil || ej.Code != tt.code {
+					t.Fatalf("got %s, want a %s error", resp.Body, tt.code)
+				}
+			}
+
+			// The OpenAI facade answers OpenAI errors
+			if strings.HasPrefix(tt.path, "/v1/") {
+				var oer openaiErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &oer); err != nil || oer.Error.Code != tt.status {
+					t.Fatalf("got %s, want an OpenAI error", resp.Body)
+				}
+			}
+
+			if len(tt.origin) > 0 {
+				if origin := resp.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+					t.Fatalf("got Access-Control-Allow-Origin '%s'", origin)
+				}
+
+				if methods := resp.Header().Get("Access-Control-Allow-Methods"); methods != tt.allow {
+					t.Fatalf("got Access-Control-Allow-Methods '%s', want '%s'", methods, tt.allow)
+				}
+
+				if headers := resp.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "authorization") {
+					t.Fatalf("got Access-Control-Allow-Headers '%s'", headers)
+				}
+			}
+		})
+	}
+}
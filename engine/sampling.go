@@ -0,0 +1,119 @@
+package gorag_engine
+
+import (
+	"fmt"
+)
+
+// Defaults for EngineSamplingLimits
+const (
+	EngineDefaultMinTemperature float32 = 0.0
+	EngineDefaultMaxTemperature float32 = 2.0
+	EngineDefaultMaxTopK        int     = 200
+	EngineDefaultMaxPredict     int     = 4096
+	EngineDefaultMaxTokens      int     = 8192
+
+	engineMaxStopSequences int = 16
+	engineMaxGrammarLength int = 64 * 1024
+)
+
+// EngineSamplingLimits: server side clamps applied to client sampling
+// parameters. A zero maximum disables the clamp.
+type EngineSamplingLimits struct {
+	MinTemperature float32
+	MaxTemperature float32
+	MaxTopK        int
+	MaxPredict     int
+	MaxTokens      int
+}
+
+func NewEngineSamplingLimits() EngineSamplingLimits {
+	return EngineSamplingLimits{
+		MinTemperature: EngineDefaultMinTemperature,
+		MaxTemperature: EngineDefaultMaxTemperature,
+		MaxTopK:        EngineDefaultMaxTopK,
+		MaxPredict:     EngineDefaultMaxPredict,
+		MaxTokens:      EngineDefaultMaxTokens,
+	}
+}
+
+// Validate rejects sampling parameters llama.cpp would not make sense of
+func (er *EngineCompletionRequest) Validate() error {
+	switch {
+	case er.Temperature != nil && *er.Temperature < 0:
+		return fmt.Errorf("'temperature' must be positive")
+	case er.TopK < 0:
+		return fmt.Errorf("'top_k' must be positive")
+	case er.TopP < 0 || er.TopP > 1:
+		return fmt.Errorf("'top_p' must be between 0 and 1")
+	case er.MinP < 0 || er.MinP > 1:
+		return fmt.Errorf("'min_p' must be between 0 and 1")
+	case er.TypicalP < 0 || er.TypicalP > 1:
+		return fmt.Errorf("'typical_p' must be between 0 and 1")
+	case er.RepeatPenalty < 0:
+		return fmt.Errorf("'repeat_penalty' must be positive")
+	case er.RepeatLastN < -1:
+		return fmt.Errorf("'repeat_last_n' must be -1 (context size) or more")
+	case er.PresencePenalty < -2 || er.PresencePenalty > 2:
+		return fmt.Errorf("'presence_penalty' must be between -2 and 2")
+	case er.FrequencyPenalty < -2 || er.FrequencyPenalty > 2:
+		return fmt.Errorf("'frequency_penalty' must be between -2 and 2")
+	case er.Mirostat < 0 || er.Mirostat > 2:
+		return fmt.Errorf("'mirostat' must be 0 (disabled), 1 or 2")
+	case er.MirostatTau < 0 || er.MirostatEta < 0:
+		return fmt.Errorf("'mirostat_tau' and 'mirostat_eta' must be positive")
+	case er.NKeep < -1:
+		return fmt.Errorf("'n_keep' must be -1 (whole prompt) or more")
+	case er.Predict < 0 || er.MaxTokens < 0:
+		return fmt.Errorf("'n_predict' and 'max_tokens' must be positive")
+	case len(er.Stop) > engineMaxStopSequences:
+		return fmt.Errorf("at most %d 'stop' sequences are allowed", engineMaxStopSequences)
+	case len(er.Grammar) > engineMaxGrammarLength:
+		return fmt.Errorf("'grammar' must not exceed %d bytes", engineMaxGrammarLength)
+	}
+
+	if er.Agent && (len(er.Grammar) > 0 || len(er.JsonSchema) > 0) {
+		return fmt.Errorf("'grammar' and 'json_schema' are not supported in agent mode")
+	}
+
+	if er.MaxSteps < 0 {
+		return fmt.Errorf("'max_steps' must be positive")
+	}
+
+	if len(er.JsonSchema) > 0 {
+		if len(er.Grammar) > 0 {
+			return fmt.Errorf("'grammar' and 'json_schema' are mutually exclusive")
+		}
+
+		if _, err := parseJsonSchema(er.JsonSchema); err != nil {
+			return err
+		}
+	}
+
+	for _, stop := range er.Stop {
+		if len(stop) == 0 {
+			return fmt.Errorf("'stop' sequences must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// Clamp brings the sampling parameters of a llama request within limits
+func (limits EngineSamplingLimits) Clamp(lcr *llamaCompletionRequest) {
+	lcr.Temperature = max(lcr.Temperature, limits.MinTemperature)
+	if limits.MaxTemperature > 0 {
+		lcr.Temperature = min(lcr.Temperature, limits.MaxTemperature)
+	}
+
+	if limits.MaxTopK > 0 {
+		lcr.TopK = min(lcr.TopK, limits.MaxTopK)
+	}
+
+	if limits.MaxPredict > 0 {
+		lcr.N_predict = min(lcr.N_predict, limits.MaxPredict)
+	}
+
+	if limits.MaxTokens > 0 {
+		lcr.MaxTokens = min(lcr.MaxTokens, limits.MaxTokens)
+	}
+}
@@ -0,0 +1,154 @@
+package gorag_engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompletionRequestValidate(t *testing.T) {
+	negative := float32(-0.1)
+
+	tests := []struct {
+		name   string
+		update func(er *EngineCompletionRequest)
+		error  string
+	}{
+		{"defaults", func(er *EngineCompletionRequest) {}, ""},
+		{"negative temperature", func(er *EngineCompletionRequest) { er.Temperature = &negative }, "temperature"},
+		{"negative top_k", func(er *EngineCompletionRequest) { er.TopK = -1 }, "top_k"},
+		{"top_p above 1", func(er *EngineCompletionRequest) { er.TopP = 1.5 }, "top_p"},
+		{"min_p below 0", func(er *EngineCompletionRequest) { er.MinP = -0.5 }, "min_p"},
+		{"typical_p above 1", func(er *EngineCompletionRequest) { er.TypicalP = 2 }, "typical_p"},
+		{"negative repeat_penalty", func(er *EngineCompletionRequest) { er.RepeatPenalty = -1 }, "repeat_penalty"},
+		{"repeat_last_n of context", func(er *EngineCompletionRequest) { er.RepeatLastN = -1 }, ""},
+		{"repeat_last_n below -1", func(er *EngineCompletionRequest) { er.RepeatLastN = -2 }, "repeat_last_n"},
+		{"presence_penalty above 2", func(er *EngineCompletionRequest) { er.PresencePenalty = 2.5 }, "presence_penalty"},
+		{"frequency_penalty below -2", func(er *EngineCompletionRequest) { er.FrequencyPenalty = -3 }, "frequency_penalty"},
+		{"mirostat 3", func(er *EngineCompletionRequest) { er.Mirostat = 3 }, "mirostat"},
+		{"negative mirostat_eta", func(er *EngineCompletionRequest) { er.MirostatEta = -1 }, "mirostat_eta"},
+		{"n_keep below -1", func(er *EngineCompletionRequest) { er.NKeep = -2 }, "n_keep"},
+		{"negative max_tokens", func(er *EngineCompletionRequest) { er.MaxTokens = -1 }, "max_tokens"},
+		{"too many stops", func(er *EngineCompletionRequest) { er.Stop = make([]string, engineMaxStopSequences+1) }, "stop"},
+		{"empty stop", func(er *EngineCompletionRequest) { er.Stop = []string{"\n", ""} }, "stop"},
+		{"grammar too long", func(er *EngineCompletionRequest) {
+			er.Grammar = strings.Repeat("a", engineMaxGrammarLength+1)
+		}, "grammar"},
+		{"grammar and json_schema", func(er *EngineCompletionRequest) {
+			er.Grammar = `root ::= "a"`
+			er.JsonSchema = json.RawMessage(`{"type":"string"}`)
+		}, "mutually exclusive"},
+		{"agent with json_schema", func(er *EngineCompletionRequest) {
+			er.Agent = true
+			er.JsonSchema = json.RawMessage(`{"type":"string"}`)
+		}, "agent mode"},
+		{"negative max_steps", func(er *EngineCompletionRequest) { er.MaxSteps = -1 }, "max_steps"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er := NewEngineCompletionRequest()
+			tt.update(er)
+
+			err := er.Validate()
+			if len(tt.error) == 0 && err != nil {
+				t.Fatalf("rejected: %s", err)
+			}
+
+			if len(tt.error) > 0 && (err == nil || !strings.Contains(err.Error(), tt.error)) {
+				t.Fatalf("got %v, want an error about %s", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestSamplingLimitsClamp(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits EngineSamplingLimits
+		in     llamaCompletionRequest
+		want   llamaCompletionRequest
+	}{
+		{
+			name:   "within limits",
+			limits: NewEngineSamplingLimits(),
+			in:     llamaCompletionRequest{Temperature: 0.7, TopK: 40, N_predict: 256, MaxTokens: 512},
+			want:   llamaCompletionRequest{Temperature: 0.7, TopK: 40, N_predict: 256, MaxTokens: 512},
+		},
+		{
+			name:   "above limits",
+			limits: NewEngineSamplingLimits(),
+			in:     llamaCompletionRequest{Temperature: 5, TopK: 1000, N_predict: 100000, MaxTokens: 100000},
+			want: llamaCompletionRequest{
+				Temperature: EngineDefaultMaxTemperature,
+				TopK:        EngineDefaultMaxTopK,
+				N_predict:   EngineDefaultMaxPredict,
+				MaxTokens:   EngineDefaultMaxTokens,
+			},
+		},
+		{
+			name:   "below minimum temperature",
+			limits: EngineSamplingLimits{MinTemperature: 0.1},
+			in:     llamaCompletionRequest{Temperature: 0},
+			want:   llamaCompletionRequest{Temperature: 0.1},
+		},
+		{
+			name:   "no maximum",
+			limits: EngineSamplingLimits{},
+			in:     llamaCompletionRequest{Temperature: 5, TopK: 1000, N_predict: 100000, MaxTokens: 100000},
+			want:   llamaCompletionRequest{Temperature: 5, TopK: 1000, N_predict: 100000, MaxTokens: 100000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lcr := tt.in
+			tt.limits.Clamp(&lcr)
+
+			if lcr.Temperature != tt.want.Temperature || lcr.TopK != tt.want.TopK ||
+				lcr.N_predict != tt.want.N_predict || lcr.MaxTokens != tt.want.MaxTokens {
+				t.Fatalf("got %+v, want %+v", lcr, tt.want)
+			}
+		})
+	}
+}
+
+// Requests are validated, then clamped, before reaching llama
+func TestCompletionSampling(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		field  string
+		want   float64
+	}{
+		{"temperature clamped", `{"prompt":"hello","temperature":5}`, http.StatusOK, "temperature", float64(EngineDefaultMaxTemperature)},
+		{"top_k clamped", `{"prompt":"hello","top_k":1000}`, http.StatusOK, "top_k", float64(EngineDefaultMaxTopK)},
+		{"seed 0 kept", `{"prompt":"hello","seed":0}`, http.StatusOK, "seed", 0},
+		{"seed defaults to random", `{"prompt":"hello"}`, http.StatusOK, "seed", float64(LlamaDefaultSeed)},
+		{"invalid top_p", `{"prompt":"hello","top_p":2}`, http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+
+			resp := postTestJson(e, "/api/v1/completion", tt.body)
+			if resp.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.Code, tt.status, resp.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				if payload := llama.lastCompletion(); payload != nil {
+					t.Fatalf("invalid request sent upstream: %v", payload)
+				}
+				return
+			}
+
+			if got := llama.lastCompletion()[tt.field]; got != tt.want {
+				t.Fatalf("got %s %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package gorag_engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// Built in tools
+const (
+	EngineToolSearch      string = "search_knowledge_base"
+	EngineToolGetDocument string = "get_document"
+
+	EngineDefaultToolTimeout time.Duration = 30 * time.Second
+
+	// Tool results fed back to the model are cut after this many bytes
+	engineToolResultLimit int = 16 * 1024
+	// Chunks of a document returned by get_document
+	engineDocumentChunkLimit uint32 = 64
+)
+
+// EngineHttpTool: a user tool, called by POSTing the JSON arguments emitted
+// by the model to Url. The response body is handed back to the model.
+type EngineHttpTool struct {
+	Name        string            `json:"name" yaml:"name"`
+	Description string            `json:"description" yaml:"description"`
+	Parameters  json.RawMessage   `json:"parameters,omitempty" yaml:"-"`
+	Url         string            `json:"url" yaml:"url"`
+	Headers     map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Timeout in seconds, EngineDefaultToolTimeout when not set
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// LoadEngineHttpTools reads a json array of tools from path
+func LoadEngineHttpTools(path string) (tools []EngineHttpTool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &tools); err != nil {
+		return nil, fmt.Errorf("invalid tools '%s': %w", path, err)
+	}
+
+	if err = ValidateEngineHttpTools(tools); err != nil {
+		return nil, err
+	}
+
+	return tools, nil
+}
+
+// ValidateEngineHttpTools checks names, urls and parameters of tools, and
+// gives the ones without parameters an empty object schema
+func ValidateEngineHttpTools(tools []EngineHttpTool) (err error) {
+	names := make(map[string]bool)
+	for i, tool := range tools {
+		switch {
+		case len(tool.Name) == 0 || len(tool.Url) == 0:
+			return fmt.Errorf("tool #%d needs a name and an url", i)
+		case tool.Name == EngineToolSearch || tool.Name == EngineToolGetDocument:
+			return fmt.Errorf("tool '%s' is a built in tool", tool.Name)
+		case names[tool.Name]:
+			return fmt.Errorf("tool '%s' is defined twice", tool.Name)
+		}
+		names[tool.Name] = true
+
+		if len(tool.Parameters) == 0 {
+			tools[i].Parameters = json.RawMessage(`{"type":"object","properties":{}}`)
+		} else if _, err = parseJsonSchema(tool.Parameters); err != nil {
+			return fmt.Errorf("tool '%s': invalid parameters: %w", tool.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func newLlamaTool(name string, description string, parameters string) LlamaTool {
+	var tool LlamaTool
+
+	tool.Type = "function"
+	tool.Function.Name = name
+	tool.Function.Description = description
+	tool.Function.Parameters = json.RawMessage(parameters)
+
+	return tool
+}
+
+// getTools returns the definitions of every tool offered to the model
+func (e *GoRagEngine) getTools() []LlamaTool {
+	tools := []LlamaTool{
+		newLlamaTool(EngineToolSearch,
+			"Search the knowledge base for passages relevant to a query. "+
+				"Returns passages with their document name and relevance score.",
+			`{"type":"object","properties":{`+
+				`"query":{"type":"string","description":"what to search for"},`+
+				`"limit":{"type":"integer","description":"maximum number of passages"}},`+
+				`"required":["query"]}`),
+		newLlamaTool(EngineToolGetDocument,
+			"Get the whole text of a document of the knowledge base, by the document name "+
+				"returned by "+EngineToolSearch+".",
+			`{"type":"object","properties":{`+
+				`"document":{"type":"string","description":"name of the document"}},`+
+				`"required":["document"]}`),
+	}
+
+	for _, tool := range e.httpTools {
+		tools = append(tools, newLlamaTool(tool.Name, tool.Description, string(tool.Parameters)))
+	}
+
+	return tools
+}
+
+// callTool runs a tool call of the model, its result cut after
+// engineToolResultLimit bytes. Sources found by searches are added to state.
+func (e *GoRagEngine) callTool(ctx context.Context, call LlamaToolCall, state *agentState) (result string, err error) {
+	result, err = e.runTool(ctx, call, state)
+
+	return truncateToolResult(result), err
+}
+
+// truncateToolResult cuts result after engineToolResultLimit bytes, on a
+// character boundary
+func truncateToolResult(result string) string {
+	if len(result) <= engineToolResultLimit {
+		return result
+	}
+
+	cut := engineToolResultLimit
+	for cut > 0 && !utf8.RuneStart(result[cut]) {
+		cut--
+	}
+
+	return result[:cut]
+}
+
+func (e *GoRagEngine) runTool(ctx context.Context, call LlamaToolCall, state *agentState) (result string, err error) {
+	var args map[string]any
+
+	arguments := call.Function.Arguments
+	if len(strings.TrimSpace(arguments)) == 0 {
+		arguments = "{}"
+	}
+
+	if err = json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("arguments are not a JSON object: %w", err)
+	}
+
+	log.Printf("[GoRagEngine::callTool] %s(%s)\n", call.Function.Name, arguments)
+
+	switch call.Function.Name {
+	case EngineToolSearch:
+		query, _ := args["query"].(string)
+		limit, _ := args["limit"].(float64)
+		return e.callSearchTool(ctx, query, int(limit), state)
+	case EngineToolGetDocument:
+		document, _ := args["document"].(string)
+		return e.callGetDocumentTool(ctx, document, state)
+	}
+
+	for _, tool := range e.httpTools {
+		if tool.Name == call.Function.Name {
+			return e.callHttpTool(ctx, tool, arguments)
+		}
+	}
+
+	return "", fmt.Errorf("unknown tool '%s'", call.Function.Name)
+}
+
+func (e *GoRagEngine) callSearchTool(
+	ctx context.Context,
+	query string,
+	limit int,
+	state *agentState) (result string, err error) {
+
+	if len(strings.TrimSpace(query)) == 0 {
+		return "", fmt.Errorf("'query' must not be empty")
+	}
+
+	embeds, err := e.getEmbeddings(ctx, EmbedKindQuery, []string{query})
+	if err != nil {
+		return "", err
+	}
+
+	points, err := e.searchQdrantPoints(ctx, state.collection, embeds, state.threshold)
+	if err != nil {
+		return "", err
+	}
+
+	if limit > 0 && len(points) > limit {
+		points = points[:limit]
+	}
+
+	state.addPoints(points)
+
+	passages := make([]map[string]any, len(points))
+	for i, point := range points {
+		passages[i] = map[string]any{
+			"id":       point.Id,
+			"document": point.Document,
+			"score":    point.Score,
+			"text":     point.Source,
+		}
+	}
+
+	b, err := json.Marshal(passages)
+	return string(b), err
+}
+
+func (e *GoRagEngine) callGetDocumentTool(
+	ctx context.Context,
+	document string,
+	state *agentState) (result string, err error) {
+
+	if len(document) == 0 {
+		return "", fmt.Errorf("'document' must not be empty")
+	}
+
+	access, err := getAccessFilter(ctx, state.collection)
+	if err != nil {
+		return "", err
+	}
+
+	limit := engineDocumentChunkLimit
+	points, err := e.QdrantClient.Scroll(ctx, &qdrant.ScrollPoints{
+		CollectionName: state.collection,
+		Filter: &qdrant.Filter{
+			Must: append(access, qdrant.NewMatch("document", document)),
+		},
+		Limit:       &limit,
+		WithPayload: qdrant.NewWithPayloadEnable(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(points) == 0 {
+		return "", fmt.Errorf("document '%s' not found", document)
+	}
+
+	chunks := make([]string, 0, len(points))
+	for _, point := range points {
+		if source := point.Payload["source"]; source != nil {
+			chunks = append(chunks, source.GetStringValue())
+		}
+	}
+
+	return strings.Join(chunks, "\n"), nil
+}
+
+func (e *GoRagEngine) callHttpTool(ctx context.Context, tool EngineHttpTool, arguments string) (result string, err error) {
+	timeout := EngineDefaultToolTimeout
+	if tool.Timeout > 0 {
+		timeout = time.Duration(tool.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tool.Url, bytes.NewBufferString(arguments))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range tool.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(engineToolResultLimit)))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("tool returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return string(body), nil
+}
+
+// getCollection returns the collection searched by the engine. It is named
+// after the embed model: when neither configured nor told by the embed
+// servers yet, query is embedded for them to tell it.
+func (e *GoRagEngine) getCollection(ctx context.Context, query string) (collection string, err error) {
+	var model string
+
+	if e.Embedder != nil {
+		model = e.Embedder.Model()
+	}
+
+	if len(model) == 0 {
+		embeds, err := e.getEmbeddings(ctx, EmbedKindQuery, []string{query})
+		if err != nil {
+			return "", err
+		}
+		model = embeds.Model
+	}
+
+	return e.getCollectionFromModel(model), nil
+}
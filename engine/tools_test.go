@@ -0,0 +1,85 @@
+package gorag_engine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestToolResultLimit(t *testing.T) {
+	e, _, _ := newTestEngine(t)
+
+	chunks := make([]string, 32)
+	for i := range chunks {
+		chunks[i] = fmt.Sprintf("%d %s", i, strings.Repeat("größe ", 200))
+	}
+
+	_, err := e.Ingest(context.Background(), EngineIngestRequest{
+		Documents: []EngineDocument{{Name: "manual", Chunks: chunks}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		tool      string
+		arguments string
+	}{
+		{"search", EngineToolSearch, `{"query":"größe"}`},
+		{"get document", EngineToolGetDocument, `{"document":"manual"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var call LlamaToolCall
+			call.Function.Name = tt.tool
+			call.Function.Arguments = tt.arguments
+
+			state := &agentState{collection: testCollection, seen: make(map[string]bool)}
+
+			result, err := e.callTool(context.Background(), call, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(result) == 0 || len(result) > engineToolResultLimit || !utf8.ValidString(result) {
+				t.Fatalf("got %d bytes (valid %v), want up to %d", len(result), utf8.ValidString(result), engineToolResultLimit)
+			}
+		})
+	}
+}
+
+func TestGetCollection(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		embedded [][]string
+	}{
+		{"configured model", "?model=" + testEmbedModel, nil},
+		{"model told by the server", "", [][]string{{"what is gorag"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, llama, _ := newTestEngine(t)
+			e.WithEmbedServer(llama.url + tt.spec)
+
+			collection, err := e.getCollection(context.Background(), "what is gorag")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if collection != testCollection {
+				t.Fatalf("got collection '%s', want '%s'", collection, testCollection)
+			}
+
+			if !reflect.DeepEqual(llama.embedded, tt.embedded) {
+				t.Fatalf("got embeddings of %v, want %v", llama.embedded, tt.embedded)
+			}
+		})
+	}
+}
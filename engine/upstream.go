@@ -0,0 +1,344 @@
+package gorag_engine
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies for LlamaUpstreamPool
+const (
+	LlamaBalanceRoundRobin    string = "round-robin"
+	LlamaBalanceLeastInFlight string = "least-inflight"
+)
+
+// Circuit breaker states
+const (
+	upstreamStateClosed   string = "closed"
+	upstreamStateOpen     string = "open"
+	upstreamStateHalfOpen string = "half-open"
+)
+
+// LlamaUpstreamStatus: a snapshot of an upstream, as shown by the admin endpoint
+type LlamaUpstreamStatus struct {
+	Url       string    `json:"url"`
+	Provider  string    `json:"provider"`
+	State     string    `json:"state"`
+	Healthy   bool      `json:"healthy"`
+	InFlight  int64     `json:"in_flight"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	LastProbe time.Time `json:"last_probe,omitzero"`
+}
+
+// llamaUpstream: a single llama server along with its breaker state
+type llamaUpstream struct {
+	Url      string
+	Provider LlamaProvider
+
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	state     string
+	healthy   bool
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	lastError string
+	lastProbe time.Time
+}
+
+// newLlamaUpstream accepts a server url, optionally prefixed by its provider
+func newLlamaUpstream(spec string) (u *llamaUpstream, err error) {
+	url, provider, err := newLlamaProvider(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &llamaUpstream{
+		Url:      url,
+		Provider: provider,
+		state:    upstreamStateClosed,
+		healthy:  true,
+	}, nil
+}
+
+// available tells whether the upstream may take a request right now and,
+// for an open breaker whose cooldown is over, lets a single trial through.
+func (u *llamaUpstream) available(cooldown time.Duration) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.healthy {
+		return false
+	}
+
+	switch u.state {
+	case upstreamStateOpen:
+		if time.Since(u.openedAt) < cooldown {
+			return false
+		}
+		u.state = upstreamStateHalfOpen
+		u.trial = false
+		fallthrough
+	case upstreamStateHalfOpen:
+		if u.trial {
+			return false
+		}
+		u.trial = true
+	}
+
+	return true
+}
+
+func (u *llamaUpstream) reportSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.state != upstreamStateClosed {
+		log.Printf("[llamaUpstream] %s: closing circuit breaker\n", u.Url)
+	}
+
+	u.state = upstreamStateClosed
+	u.failures = 0
+	u.trial = false
+}
+
+func (u *llamaUpstream) reportFailure(err error, threshold int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	u.lastError = err.Error()
+	u.trial = false
+
+	if u.state == upstreamStateHalfOpen || (u.state == upstreamStateClosed && u.failures >= threshold) {
+		log.Printf("[llamaUpstream] %s: opening circuit breaker after %d failures\n", u.Url, u.failures)
+		u.state = upstreamStateOpen
+		u.openedAt = time.Now()
+	}
+}
+
+// reportProbe only ejects or re-admits the upstream: servers may answer
+// their health endpoint while failing requests, so an open breaker is
+// left to its cooldown and to a successful request.
+func (u *llamaUpstream) reportProbe(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lastProbe = time.Now()
+
+	if err != nil {
+		if u.healthy {
+			log.Printf("[llamaUpstream] %s: ejected, health check failed: %s\n", u.Url, err.Error())
+		}
+		u.healthy = false
+		u.lastError = err.Error()
+		return
+	}
+
+	if !u.healthy {
+		log.Printf("[llamaUpstream] %s: healthy again, re-admitted\n", u.Url)
+	}
+
+	u.healthy = true
+}
+
+func (u *llamaUpstream) Status() LlamaUpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return LlamaUpstreamStatus{
+		Url:       u.Url,
+		Provider:  u.Provider.Name(),
+		State:     u.state,
+		Healthy:   u.healthy,
+		InFlight:  u.inFlight.Load(),
+		Failures:  u.failures,
+		LastError: u.lastError,
+		LastProbe: u.lastProbe,
+	}
+}
+
+// LlamaUpstreamPool: a set of interchangeable llama servers
+type LlamaUpstreamPool struct {
+	upstreams []*llamaUpstream
+	next      atomic.Uint64
+	// configured through LlamaClientOptions
+	balance   string
+	threshold int
+	cooldown  time.Duration
+}
+
+// NewLlamaUpstreamPool accepts a comma separated list of server urls.
+// Invalid entries are logged and skipped.
+func NewLlamaUpstreamPool(urls string) *LlamaUpstreamPool {
+	p := &LlamaUpstreamPool{
+		upstreams: make([]*llamaUpstream, 0),
+	}
+
+	for _, spec := range strings.Split(urls, ",") {
+		if spec = strings.TrimSpace(spec); len(spec) == 0 {
+			continue
+		}
+
+		u, err := newLlamaUpstream(spec)
+		if err != nil {
+			log.Printf("[LlamaUpstreamPool] ignoring server: %s\n", err.Error())
+			continue
+		}
+
+		p.upstreams = append(p.upstreams, u)
+	}
+
+	return p.configure(NewLlamaClientOptions())
+}
+
+func (p *LlamaUpstreamPool) configure(options LlamaClientOptions) *LlamaUpstreamPool {
+	p.balance = options.Balance
+	p.threshold = max(options.BreakerFailures, 1)
+	p.cooldown = options.BreakerCooldown
+
+	return p
+}
+
+// Urls returns the configured servers
+func (p *LlamaUpstreamPool) Urls() []string {
+	urls := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		urls[i] = u.Url
+	}
+
+	return urls
+}
+
+// Model returns the model named by the server specifications, if any
+func (p *LlamaUpstreamPool) Model() string {
+	for _, u := range p.upstreams {
+		if model := u.Provider.Model(); len(model) > 0 {
+			return model
+		}
+	}
+
+	return ""
+}
+
+func (p *LlamaUpstreamPool) Status() []LlamaUpstreamStatus {
+	status := make([]LlamaUpstreamStatus, len(p.upstreams))
+	for i, u := range p.upstreams {
+		status[i] = u.Status()
+	}
+
+	return status
+}
+
+// acquire picks an upstream following the balancing strategy. The caller
+// must hand it back through release once done with it.
+func (p *LlamaUpstreamPool) acquire() (u *llamaUpstream, err error) {
+	count := len(p.upstreams)
+	if count == 0 {
+		return nil, &LlamaError{Kind: ErrUpstreamUnavailable, Message: "no server configured"}
+	}
+
+	if p.balance == LlamaBalanceLeastInFlight {
+		candidates := slices.Clone(p.upstreams)
+		slices.SortStableFunc(candidates, func(a, b *llamaUpstream) int {
+			return cmp.Compare(a.inFlight.Load(), b.inFlight.Load())
+		})
+
+		for _, c := range candidates {
+			if c.available(p.cooldown) {
+				u = c
+				break
+			}
+		}
+	} else {
+		start := int(p.next.Add(1) - 1)
+		for i := 0; i < count; i++ {
+			if c := p.upstreams[(start+i)%count]; c.available(p.cooldown) {
+				u = c
+				break
+			}
+		}
+	}
+
+	if u == nil {
+		return nil, &LlamaError{Kind: ErrUpstreamUnavailable, Message: "no healthy server available"}
+	}
+
+	u.inFlight.Add(1)
+
+	return u, nil
+}
+
+// release hands u back to the pool, feeding the breaker with the outcome
+// of the request. Cancellations made by our own client are not failures.
+func (p *LlamaUpstreamPool) release(ctx context.Context, u *llamaUpstream, err error) {
+	u.inFlight.Add(-1)
+
+	if err == nil {
+		u.reportSuccess()
+		return
+	}
+
+	if ctx.Err() != nil && errors.Is(ctx.Err(), context.Canceled) {
+		u.mu.Lock()
+		u.trial = false
+		u.mu.Unlock()
+		return
+	}
+
+	var le *LlamaError
+	if errors.As(err, &le) && (le.Kind == ErrBadRequest || le.Kind == ErrContextTooLong) {
+		// The server did its job, the request was the problem
+		u.reportSuccess()
+		return
+	}
+
+	u.reportFailure(err, p.threshold)
+}
+
+// probe checks every upstream's health endpoint
+func (p *LlamaUpstreamPool) probe(ctx context.Context, client *http.Client, timeout time.Duration) {
+	for _, u := range p.upstreams {
+		pctx, cancel := withOptionalTimeout(ctx, timeout)
+
+		err := func() error {
+			uri := fmt.Sprintf("%s%s", u.Url, u.Provider.HealthPath())
+			req, err := http.NewRequestWithContext(pctx, http.MethodGet, uri, nil)
+			if err != nil {
+				return err
+			}
+
+			u.Provider.Authorize(req)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("health returned %s", resp.Status)
+			}
+
+			return nil
+		}()
+
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		u.reportProbe(err)
+	}
+}
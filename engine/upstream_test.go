@@ -0,0 +1,197 @@
+package gorag_engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Failing servers are skipped once their breaker opens
+func TestPostIdempotentFailover(t *testing.T) {
+	var failed atomic.Int32
+
+	down := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		failed.Add(1)
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{"model":"m","data":[{"index":0,"embedding":[1]}]}`))
+	}))
+	defer up.Close()
+
+	options := NewLlamaClientOptions()
+	options.HealthInterval = 0
+	options.MaxRetries = 1
+	options.RetryBackoff = time.Millisecond
+	options.BreakerFailures = 1
+	options.BreakerCooldown = time.Hour
+
+	l := NewLlamaEngine(down.URL+","+up.URL, up.URL).WithClientOptions(options)
+	defer l.Close()
+
+	for range 4 {
+		if _, err := l.GetEmbeddings(context.Background(), []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if failed.Load() != 1 {
+		t.Fatalf("failing server called %d times", failed.Load())
+	}
+}
+
+func newTestUpstreamPool(t *testing.T, balance string, urls string) *LlamaUpstreamPool {
+	options := NewLlamaClientOptions()
+	options.Balance = balance
+	options.BreakerFailures = 3
+	options.BreakerCooldown = time.Hour
+
+	p := NewLlamaUpstreamPool(urls).configure(options)
+	if len(p.upstreams) == 0 {
+		t.Fatalf("no upstream in '%s'", urls)
+	}
+
+	return p
+}
+
+// expire ends the cooldown of an open breaker
+func (u *llamaUpstream) expire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.openedAt = time.Now().Add(-2 * time.Hour)
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	p := newTestUpstreamPool(t, LlamaBalanceRoundRobin, "http://a")
+	u := p.upstreams[0]
+	failure := &LlamaError{Kind: ErrUpstreamUnavailable, Message: "down"}
+
+	steps := []struct {
+		name      string
+		do        func()
+		state     string
+		available bool
+	}{
+		{"closed", func() {}, upstreamStateClosed, true},
+		{"failures below threshold", func() {
+			u.reportFailure(failure, p.threshold)
+			u.reportFailure(failure, p.threshold)
+		}, upstreamStateClosed, true},
+		{"threshold reached", func() { u.reportFailure(failure, p.threshold) }, upstreamStateOpen, false},
+		{"healthy probe while open", func() { u.reportProbe(nil) }, upstreamStateOpen, false},
+		{"cooldown over", func() { u.expire() }, upstreamStateOpen, true},
+		{"trial in flight", func() {}, upstreamStateHalfOpen, false},
+		{"trial failed", func() { u.reportFailure(failure, p.threshold) }, upstreamStateOpen, false},
+		{"second cooldown over", func() { u.expire() }, upstreamStateOpen, true},
+		{"trial succeeded", func() { u.reportSuccess() }, upstreamStateClosed, true},
+		{"failed probe", func() { u.reportProbe(fmt.Errorf("refused")) }, upstreamStateClosed, false},
+		{"healthy probe", func() { u.reportProbe(nil) }, upstreamStateClosed, true},
+	}
+
+	for _, step := range steps {
+		step.do()
+
+		if state := u.Status().State; state != step.state {
+			t.Fatalf("%s: state %s, want %s", step.name, state, step.state)
+		}
+
+		if available := u.available(p.cooldown); available != step.available {
+			t.Fatalf("%s: available %v, want %v", step.name, available, step.available)
+		}
+	}
+
+	if status := u.Status(); status.Failures != 0 || !status.Healthy {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+// Requests rejected by the server do not count against it
+func TestUpstreamBreakerIgnoresBadRequests(t *testing.T) {
+	p := newTestUpstreamPool(t, LlamaBalanceRoundRobin, "http://a")
+
+	for range 5 {
+		u, err := p.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.release(context.Background(), u, &LlamaError{Kind: ErrBadRequest, StatusCode: http.StatusBadRequest})
+	}
+
+	if state := p.upstreams[0].Status().State; state != upstreamStateClosed {
+		t.Fatalf("breaker %s after bad requests", state)
+	}
+}
+
+func TestUpstreamPoolBalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		balance  string
+		inFlight []int64
+		open     []bool
+		want     []string
+	}{
+		{"round robin", LlamaBalanceRoundRobin, []int64{0, 0, 0}, []bool{false, false, false},
+			[]string{"http://a", "http://b", "http://c", "http://a"}},
+		{"round robin skips open", LlamaBalanceRoundRobin, []int64{0, 0, 0}, []bool{false, true, false},
+			[]string{"http://a", "http://c", "http://c", "http://a"}},
+		{"least in flight", LlamaBalanceLeastInFlight, []int64{3, 1, 2}, []bool{false, false, false},
+			[]string{"http://b", "http://b", "http://b", "http://c"}},
+		{"least in flight skips open", LlamaBalanceLeastInFlight, []int64{3, 1, 2}, []bool{false, true, false},
+			[]string{"http://c", "http://a", "http://a", "http://c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestUpstreamPool(t, test.balance, "http://a,http://b,http://c")
+
+			for i, u := range p.upstreams {
+				u.inFlight.Store(test.inFlight[i])
+				if test.open[i] {
+					for range p.threshold {
+						u.reportFailure(fmt.Errorf("down"), p.threshold)
+					}
+				}
+			}
+
+			// Every other upstream is released at once, the others stay in flight
+			var got []string
+			for i := range test.want {
+				u, err := p.acquire()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, u.Url)
+
+				if i%2 == 1 {
+					p.release(context.Background(), u, nil)
+				}
+			}
+
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("picked %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamPoolUnavailable(t *testing.T) {
+	p := newTestUpstreamPool(t, LlamaBalanceLeastInFlight, "http://a")
+	p.upstreams[0].reportProbe(fmt.Errorf("refused"))
+
+	if _, err := p.acquire(); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("got %v, want ErrUpstreamUnavailable", err)
+	}
+
+	if _, err := NewLlamaUpstreamPool("").acquire(); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("empty pool: got %v", err)
+	}
+}
@@ -2,15 +2,16 @@ module github.com/lapuglisi/gorag/v2
 
 go 1.25.7
 
-require github.com/qdrant/go-client v1.16.2
+require (
+	github.com/qdrant/go-client v1.16.2
+	google.golang.org/grpc v1.76.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/dianlight/gollama.cpp v0.1.0 // indirect
-	github.com/ebitengine/purego v0.9.1 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251111163417-95abcf5c77ba // indirect
-	google.golang.org/grpc v1.76.0 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
 )
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	gorag_engine "github.com/lapuglisi/gorag/v2/engine"
+)
+
+const keysUsage string = "usage: gorag keys <mint|revoke|list> [-file PATH] [flags]"
+
+// runKeysCommand runs 'gorag keys <command> [flags]', editing the key file
+// read by -keys-file. Running servers see the changes once reloaded.
+func runKeysCommand(args []string) (err error) {
+	if len(args) == 0 {
+		return fmt.Errorf(keysUsage)
+	}
+
+	var path, name, scopes string
+
+	flags := flag.NewFlagSet("gorag keys "+args[0], flag.ExitOnError)
+	flags.StringVar(&path, "file", os.Getenv(GoRagEnvKeysFile),
+		"JSON file of the API keys (env "+GoRagEnvKeysFile+")")
+
+	switch args[0] {
+	case "mint":
+		flags.StringVar(&name, "name", "", "Name of the key, e.g. the service using it")
+		flags.StringVar(&scopes, "scopes", "",
+			"Comma separated scopes: search, complete, ingest, admin")
+	case "revoke", "list":
+	default:
+		return fmt.Errorf(keysUsage)
+	}
+
+	flags.Parse(args[1:])
+
+	if len(path) == 0 {
+		return fmt.Errorf("no key file, use -file or %s", GoRagEnvKeysFile)
+	}
+
+	keys, err := gorag_engine.LoadEngineApiKeys(path)
+	if err != nil && (args[0] != "mint" || !errors.Is(err, fs.ErrNotExist)) {
+		return err
+	}
+
+	switch args[0] {
+	case "mint":
+		if len(scopes) == 0 {
+			return fmt.Errorf("usage: gorag keys mint [-file PATH] -scopes SCOPES [-name NAME]")
+		}
+
+		var list []string
+		for _, scope := range strings.Split(scopes, ",") {
+			list = append(list, strings.TrimSpace(scope))
+		}
+
+		key, secret, err := gorag_engine.NewEngineApiKey(name, list)
+		if err != nil {
+			return err
+		}
+
+		if err = gorag_engine.SaveEngineApiKeys(path, append(keys, key)); err != nil {
+			return err
+		}
+
+		// The key is only ever shown here
+		fmt.Fprintf(os.Stderr, "minted key '%s' (%s), reload gorag to use it\n", key.Id, strings.Join(key.Scopes, ", "))
+		fmt.Println(secret)
+
+	case "revoke":
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: gorag keys revoke [-file PATH] ID")
+		}
+
+		id := flags.Arg(0)
+		remaining := make([]gorag_engine.EngineApiKey, 0, len(keys))
+		for _, key := range keys {
+			if key.Id != id {
+				remaining = append(remaining, key)
+			}
+		}
+
+		if len(remaining) == len(keys) {
+			return fmt.Errorf("no key '%s' in '%s'", id, path)
+		}
+
+		if err = gorag_engine.SaveEngineApiKeys(path, remaining); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "revoked key '%s', reload gorag to apply\n", id)
+
+	case "list":
+		for _, key := range keys {
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.Id, strings.Join(key.Scopes, ","),
+				key.Created.Format("2006-01-02"), key.Name)
+		}
+	}
+
+	return nil
+}
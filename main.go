@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	gorag_engine "github.com/lapuglisi/gorag/v2/engine"
 )
@@ -22,39 +27,208 @@ const (
 	GoRagEnvLlamaServer string = "GORAG_ARG_LLAMA_SERVER"
 	GoRagEnvQdrantUri   string = "GORAG_ARG_QDRANT_URI"
 	GoRagEnvQdrantLimit string = "GORAG_ARG_QDRANT_LIMIT"
+	GoRagEnvThreshold   string = "GORAG_ARG_THRESHOLD"
+
+	GoRagEnvEmbedTimeout    string = "GORAG_ARG_EMBED_TIMEOUT"
+	GoRagEnvLlamaTimeout    string = "GORAG_ARG_LLAMA_TIMEOUT"
+	GoRagEnvTokenizeTimeout string = "GORAG_ARG_TOKENIZE_TIMEOUT"
+	GoRagEnvLlamaRetries    string = "GORAG_ARG_LLAMA_RETRIES"
+	GoRagEnvLlamaBackoff    string = "GORAG_ARG_LLAMA_BACKOFF"
+
+	GoRagEnvLlamaBalance    string = "GORAG_ARG_LLAMA_BALANCE"
+	GoRagEnvBreakerFailures string = "GORAG_ARG_BREAKER_FAILURES"
+	GoRagEnvBreakerCooldown string = "GORAG_ARG_BREAKER_COOLDOWN"
+	GoRagEnvHealthInterval  string = "GORAG_ARG_HEALTH_INTERVAL"
+
+	GoRagEnvEmbedCacheSize string = "GORAG_ARG_EMBED_CACHE_SIZE"
+	GoRagEnvEmbedCacheTTL  string = "GORAG_ARG_EMBED_CACHE_TTL"
+	GoRagEnvEmbedCacheFile string = "GORAG_ARG_EMBED_CACHE_FILE"
+
+	GoRagEnvAnswerCacheSize       string = "GORAG_ARG_ANSWER_CACHE_SIZE"
+	GoRagEnvAnswerCacheSimilarity string = "GORAG_ARG_ANSWER_CACHE_SIMILARITY"
+	GoRagEnvAnswerCacheTTL        string = "GORAG_ARG_ANSWER_CACHE_TTL"
+
+	GoRagEnvEmbedBatchSize   string = "GORAG_ARG_EMBED_BATCH_SIZE"
+	GoRagEnvEmbedConcurrency string = "GORAG_ARG_EMBED_CONCURRENCY"
+
+	GoRagEnvEmbedPrefix         string = "GORAG_ARG_EMBED_PREFIX"
+	GoRagEnvEmbedQueryPrefix    string = "GORAG_ARG_EMBED_QUERY_PREFIX"
+	GoRagEnvEmbedDocumentPrefix string = "GORAG_ARG_EMBED_DOCUMENT_PREFIX"
+
+	GoRagEnvModels string = "GORAG_ARG_MODELS"
+
+	GoRagEnvMinTemperature string = "GORAG_ARG_MIN_TEMPERATURE"
+	GoRagEnvMaxTemperature string = "GORAG_ARG_MAX_TEMPERATURE"
+	GoRagEnvMaxTopK        string = "GORAG_ARG_MAX_TOP_K"
+	GoRagEnvMaxPredict     string = "GORAG_ARG_MAX_PREDICT"
+	GoRagEnvMaxTokens      string = "GORAG_ARG_MAX_TOKENS"
+
+	GoRagEnvAgentMaxSteps string = "GORAG_ARG_AGENT_MAX_STEPS"
+	GoRagEnvTools         string = "GORAG_ARG_TOOLS"
+
+	GoRagEnvConfig string = "GORAG_ARG_CONFIG"
+
+	GoRagEnvDrainTimeout string = "GORAG_ARG_DRAIN_TIMEOUT"
+
+	GoRagEnvKeysFile    string = "GORAG_ARG_KEYS_FILE"
+	GoRagEnvJwks        string = "GORAG_ARG_JWKS"
+	GoRagEnvJwtIssuer   string = "GORAG_ARG_JWT_ISSUER"
+	GoRagEnvJwtAudience string = "GORAG_ARG_JWT_AUDIENCE"
 )
 
 type AppOptions struct {
-	HttpHost    string
-	HttpPort    string
-	QdrantUri   string
-	EmbedServer string
-	LlamaServer string
-	QdrantLimit int64
+	HttpHost    string  `yaml:"host"`
+	HttpPort    string  `yaml:"port"`
+	QdrantUri   string  `yaml:"qdrant"`
+	EmbedServer string  `yaml:"embed-server"`
+	LlamaServer string  `yaml:"llama"`
+	QdrantLimit int64   `yaml:"qdrant-limit"`
+	Threshold   float64 `yaml:"threshold"`
+
+	EmbedTimeout    time.Duration `yaml:"embed-timeout"`
+	LlamaTimeout    time.Duration `yaml:"llama-timeout"`
+	TokenizeTimeout time.Duration `yaml:"tokenize-timeout"`
+	LlamaRetries    int64         `yaml:"llama-retries"`
+	LlamaBackoff    time.Duration `yaml:"llama-backoff"`
+
+	LlamaBalance    string        `yaml:"llama-balance"`
+	BreakerFailures int64         `yaml:"breaker-failures"`
+	BreakerCooldown time.Duration `yaml:"breaker-cooldown"`
+	HealthInterval  time.Duration `yaml:"health-interval"`
+
+	EmbedCacheSize int64         `yaml:"embed-cache-size"`
+	EmbedCacheTTL  time.Duration `yaml:"embed-cache-ttl"`
+	EmbedCacheFile string        `yaml:"embed-cache-file"`
+
+	AnswerCacheSize       int64         `yaml:"answer-cache-size"`
+	AnswerCacheSimilarity float64       `yaml:"answer-cache-similarity"`
+	AnswerCacheTTL        time.Duration `yaml:"answer-cache-ttl"`
+
+	EmbedBatchSize   int64 `yaml:"embed-batch-size"`
+	EmbedConcurrency int64 `yaml:"embed-concurrency"`
+
+	EmbedPrefix         string `yaml:"embed-prefix"`
+	EmbedQueryPrefix    string `yaml:"embed-query-prefix"`
+	EmbedDocumentPrefix string `yaml:"embed-document-prefix"`
+
+	Models string `yaml:"models"`
+
+	MinTemperature float64 `yaml:"min-temperature"`
+	MaxTemperature float64 `yaml:"max-temperature"`
+	MaxTopK        int64   `yaml:"max-top-k"`
+	MaxPredict     int64   `yaml:"max-predict"`
+	MaxTokens      int64   `yaml:"max-tokens"`
+
+	AgentMaxSteps int64  `yaml:"agent-max-steps"`
+	Tools         string `yaml:"tools"`
+
+	DrainTimeout time.Duration `yaml:"drain-timeout"`
+
+	KeysFile    string `yaml:"keys-file"`
+	Jwks        string `yaml:"jwks"`
+	JwtIssuer   string `yaml:"jwt-issuer"`
+	JwtAudience string `yaml:"jwt-audience"`
+
+	// Only in the config file
+	ModelRegistry *gorag_engine.EngineModelRegistry `yaml:"model-registry,omitempty"`
+	HttpTools     []AppTool                         `yaml:"http-tools,omitempty"`
+	Prompts       gorag_engine.EnginePrompts        `yaml:"prompts,omitempty"`
+	ApiKeys       []gorag_engine.EngineApiKey       `yaml:"api-keys,omitempty"`
+	JwtClaims     gorag_engine.EngineJwtClaims      `yaml:"jwt-claims,omitempty"`
+	JwtScopes     []string                          `yaml:"jwt-default-scopes,omitempty"`
+
+	Config string `yaml:"-"`
 }
 
-func getEnvOrDefault(key string, value string) string {
-	var s string = os.Getenv(key)
-	if len(s) == 0 {
-		s = value
+// newAppOptions returns the defaults, the lowest layer of the settings
+func newAppOptions() AppOptions {
+	return AppOptions{
+		HttpHost:              HttpDefaultHost,
+		HttpPort:              HttpDefaultPort,
+		QdrantUri:             QdrantDefaultUri,
+		QdrantLimit:           QdrantDefaultLimit,
+		Threshold:             widenFloat(gorag_engine.QdrantDefaultThreshold),
+		EmbedTimeout:          gorag_engine.LlamaDefaultEmbedTimeout,
+		LlamaTimeout:          gorag_engine.LlamaDefaultCompletionTimeout,
+		TokenizeTimeout:       gorag_engine.LlamaDefaultTokenizeTimeout,
+		LlamaRetries:          int64(gorag_engine.LlamaDefaultMaxRetries),
+		LlamaBackoff:          gorag_engine.LlamaDefaultRetryBackoff,
+		LlamaBalance:          gorag_engine.LlamaBalanceRoundRobin,
+		BreakerFailures:       int64(gorag_engine.LlamaDefaultBreakerFailures),
+		BreakerCooldown:       gorag_engine.LlamaDefaultBreakerCooldown,
+		HealthInterval:        gorag_engine.LlamaDefaultHealthInterval,
+		EmbedCacheSize:        int64(gorag_engine.EmbedCacheDefaultSize),
+		EmbedCacheTTL:         gorag_engine.EmbedCacheDefaultTTL,
+		AnswerCacheSize:       int64(gorag_engine.AnswerCacheDefaultSize),
+		AnswerCacheSimilarity: gorag_engine.AnswerCacheDefaultSimilarity,
+		AnswerCacheTTL:        gorag_engine.AnswerCacheDefaultTTL,
+		EmbedBatchSize:        int64(gorag_engine.LlamaDefaultEmbedBatchSize),
+		EmbedConcurrency:      int64(gorag_engine.LlamaDefaultEmbedConcurrency),
+		EmbedPrefix:           gorag_engine.EmbedPrefixPresetNone,
+		MinTemperature:        widenFloat(gorag_engine.EngineDefaultMinTemperature),
+		MaxTemperature:        widenFloat(gorag_engine.EngineDefaultMaxTemperature),
+		MaxTopK:               int64(gorag_engine.EngineDefaultMaxTopK),
+		MaxPredict:            int64(gorag_engine.EngineDefaultMaxPredict),
+		MaxTokens:             int64(gorag_engine.EngineDefaultMaxTokens),
+		AgentMaxSteps:         int64(gorag_engine.EngineDefaultAgentSteps),
+		DrainTimeout:          gorag_engine.EngineDefaultDrainTimeout,
 	}
-
-	return s
 }
 
-func getEnvOrDefaultInt64(key string, value int64) int64 {
-
-	env := os.Getenv(key)
-	log.Printf("got %s for %s\n", env, key)
-	if s, err := strconv.ParseInt(env, 10, 64); err == nil {
-		return s
-	}
+// widenFloat converts f to float64 without float32 rounding noise, so that
+// 0.7 prints as 0.7
+func widenFloat(f float32) float64 {
+	wide, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return wide
+}
 
-	return value
+// appEnv: the env var setting each flag
+var appEnv = map[string]string{
+	"port":                    GoragEnvHttpPort,
+	"host":                    GoragEnvHttpHost,
+	"qdrant":                  GoRagEnvQdrantUri,
+	"embed-server":            GoRagEnvEmbedServer,
+	"llama":                   GoRagEnvLlamaServer,
+	"qdrant-limit":            GoRagEnvQdrantLimit,
+	"threshold":               GoRagEnvThreshold,
+	"embed-timeout":           GoRagEnvEmbedTimeout,
+	"llama-timeout":           GoRagEnvLlamaTimeout,
+	"tokenize-timeout":        GoRagEnvTokenizeTimeout,
+	"llama-retries":           GoRagEnvLlamaRetries,
+	"llama-backoff":           GoRagEnvLlamaBackoff,
+	"llama-balance":           GoRagEnvLlamaBalance,
+	"breaker-failures":        GoRagEnvBreakerFailures,
+	"breaker-cooldown":        GoRagEnvBreakerCooldown,
+	"health-interval":         GoRagEnvHealthInterval,
+	"embed-cache-size":        GoRagEnvEmbedCacheSize,
+	"embed-cache-ttl":         GoRagEnvEmbedCacheTTL,
+	"embed-cache-file":        GoRagEnvEmbedCacheFile,
+	"answer-cache-size":       GoRagEnvAnswerCacheSize,
+	"answer-cache-similarity": GoRagEnvAnswerCacheSimilarity,
+	"answer-cache-ttl":        GoRagEnvAnswerCacheTTL,
+	"embed-batch-size":        GoRagEnvEmbedBatchSize,
+	"embed-concurrency":       GoRagEnvEmbedConcurrency,
+	"embed-prefix":            GoRagEnvEmbedPrefix,
+	"embed-query-prefix":      GoRagEnvEmbedQueryPrefix,
+	"embed-document-prefix":   GoRagEnvEmbedDocumentPrefix,
+	"models":                  GoRagEnvModels,
+	"min-temperature":         GoRagEnvMinTemperature,
+	"max-temperature":         GoRagEnvMaxTemperature,
+	"max-top-k":               GoRagEnvMaxTopK,
+	"max-predict":             GoRagEnvMaxPredict,
+	"max-tokens":              GoRagEnvMaxTokens,
+	"agent-max-steps":         GoRagEnvAgentMaxSteps,
+	"tools":                   GoRagEnvTools,
+	"drain-timeout":           GoRagEnvDrainTimeout,
+	"keys-file":               GoRagEnvKeysFile,
+	"jwks":                    GoRagEnvJwks,
+	"jwt-issuer":              GoRagEnvJwtIssuer,
+	"jwt-audience":            GoRagEnvJwtAudience,
 }
 
-func setupEnvironment(opts *AppOptions) (err error) {
+func setupLogging() {
 	var cwd string
+	var err error
 
 	cwd, err = os.Getwd()
 	if err != nil {
@@ -69,33 +243,111 @@ func setupEnvironment(opts *AppOptions) (err error) {
 		fmt.Printf("warning: using stderr as log output.\n")
 		log.SetOutput(os.Stderr)
 	}
+}
 
-	// Setup config options
-	var callHelp bool = false
-	envHttpHost := getEnvOrDefault(GoragEnvHttpHost, HttpDefaultHost)
-	envHttpPort := getEnvOrDefault(GoragEnvHttpPort, HttpDefaultPort)
-	envEmbedServer := getEnvOrDefault(GoRagEnvEmbedServer, "")
-	envLlamaServer := getEnvOrDefault(GoRagEnvLlamaServer, "")
-	envQdrantUri := getEnvOrDefault(GoRagEnvQdrantUri, QdrantDefaultUri)
-	envQdrantLimit := getEnvOrDefaultInt64(GoRagEnvQdrantLimit, QdrantDefaultLimit)
-
-	flags := flag.NewFlagSet("gorag-server", flag.ExitOnError)
-
-	flags.StringVar(&(opts.HttpPort), "port", "",
+// defineFlags defines the flags setting opts, their defaults being the
+// values of opts
+func defineFlags(flags *flag.FlagSet, opts *AppOptions) {
+	flags.StringVar(&(opts.HttpPort), "port", opts.HttpPort,
 		"HTTP port to listen on (env "+GoragEnvHttpPort+")")
-	flags.StringVar(&(opts.HttpHost), "host", "",
+	flags.StringVar(&(opts.HttpHost), "host", opts.HttpHost,
 		"HTTP host to listen on (env "+GoragEnvHttpHost+")")
-	flags.StringVar(&(opts.QdrantUri), "qdrant", "",
+	flags.StringVar(&(opts.QdrantUri), "qdrant", opts.QdrantUri,
 		"Qdrant uri (env "+GoRagEnvQdrantUri+")")
-	flags.StringVar(&(opts.EmbedServer), "embed-server", "",
-		"Llama embedding server (env "+GoRagEnvEmbedServer+")")
-	flags.StringVar(&(opts.LlamaServer), "llama", "",
-		"Llama API server (env "+GoRagEnvLlamaServer+")")
-	flags.BoolVar(&callHelp, "help", false, "show usage/help (that's me)")
-	flags.Int64Var(&(opts.QdrantLimit), "qdrant-limit", 0,
+	flags.StringVar(&(opts.EmbedServer), "embed-server", opts.EmbedServer,
+		"Llama embedding servers, comma separated, optionally prefixed by their provider\n"+
+			"(ollama+, openai+), e.g. openai+https://KEY@host?model=NAME (env "+GoRagEnvEmbedServer+")")
+	flags.StringVar(&(opts.LlamaServer), "llama", opts.LlamaServer,
+		"Llama API servers, comma separated, optionally prefixed by their provider\n"+
+			"(ollama+, openai+), e.g. ollama+http://host:11434?model=NAME (env "+GoRagEnvLlamaServer+")")
+	flags.Int64Var(&(opts.QdrantLimit), "qdrant-limit", opts.QdrantLimit,
 		"Default limit to use when querying qdrant (env "+GoRagEnvQdrantLimit+")")
+	flags.Float64Var(&(opts.Threshold), "threshold", opts.Threshold,
+		"Default similarity threshold of retrievals (env "+GoRagEnvThreshold+")")
+	flags.DurationVar(&(opts.EmbedTimeout), "embed-timeout", opts.EmbedTimeout,
+		"Timeout for each embedding request (env "+GoRagEnvEmbedTimeout+")")
+	flags.DurationVar(&(opts.LlamaTimeout), "llama-timeout", opts.LlamaTimeout,
+		"Timeout for a whole completion (env "+GoRagEnvLlamaTimeout+")")
+	flags.DurationVar(&(opts.TokenizeTimeout), "tokenize-timeout", opts.TokenizeTimeout,
+		"Timeout for each tokenize request (env "+GoRagEnvTokenizeTimeout+")")
+	flags.Int64Var(&(opts.LlamaRetries), "llama-retries", opts.LlamaRetries,
+		"Retries for embedding and tokenize requests (env "+GoRagEnvLlamaRetries+")")
+	flags.DurationVar(&(opts.LlamaBackoff), "llama-backoff", opts.LlamaBackoff,
+		"Base backoff between retries (env "+GoRagEnvLlamaBackoff+")")
+	flags.StringVar(&(opts.LlamaBalance), "llama-balance", opts.LlamaBalance,
+		"Load balancing: round-robin or least-inflight (env "+GoRagEnvLlamaBalance+")")
+	flags.Int64Var(&(opts.BreakerFailures), "breaker-failures", opts.BreakerFailures,
+		"Failures before a server is ejected (env "+GoRagEnvBreakerFailures+")")
+	flags.DurationVar(&(opts.BreakerCooldown), "breaker-cooldown", opts.BreakerCooldown,
+		"Time before an ejected server is tried again (env "+GoRagEnvBreakerCooldown+")")
+	flags.DurationVar(&(opts.HealthInterval), "health-interval", opts.HealthInterval,
+		"Interval between server health checks (env "+GoRagEnvHealthInterval+")")
+	flags.Int64Var(&(opts.EmbedCacheSize), "embed-cache-size", opts.EmbedCacheSize,
+		"Embeddings kept in cache, 0 disables it (env "+GoRagEnvEmbedCacheSize+")")
+	flags.DurationVar(&(opts.EmbedCacheTTL), "embed-cache-ttl", opts.EmbedCacheTTL,
+		"Time an embedding stays in cache (env "+GoRagEnvEmbedCacheTTL+")")
+	flags.StringVar(&(opts.EmbedCacheFile), "embed-cache-file", opts.EmbedCacheFile,
+		"File used to persist the embedding cache (env "+GoRagEnvEmbedCacheFile+")")
+	flags.Int64Var(&(opts.AnswerCacheSize), "answer-cache-size", opts.AnswerCacheSize,
+		"Answers kept in the semantic cache, 0 disables it (env "+GoRagEnvAnswerCacheSize+")")
+	flags.Float64Var(&(opts.AnswerCacheSimilarity), "answer-cache-similarity", opts.AnswerCacheSimilarity,
+		"Minimum similarity for a prompt to reuse an answer (env "+GoRagEnvAnswerCacheSimilarity+")")
+	flags.DurationVar(&(opts.AnswerCacheTTL), "answer-cache-ttl", opts.AnswerCacheTTL,
+		"Time an answer stays in cache (env "+GoRagEnvAnswerCacheTTL+")")
+	flags.Int64Var(&(opts.EmbedBatchSize), "embed-batch-size", opts.EmbedBatchSize,
+		"Inputs sent in each embedding request (env "+GoRagEnvEmbedBatchSize+")")
+	flags.Int64Var(&(opts.EmbedConcurrency), "embed-concurrency", opts.EmbedConcurrency,
+		"Embedding requests running at once for a batch (env "+GoRagEnvEmbedConcurrency+")")
+	flags.StringVar(&(opts.EmbedPrefix), "embed-prefix", opts.EmbedPrefix,
+		"Query/document prefix preset: none, e5 or bge (env "+GoRagEnvEmbedPrefix+")")
+	flags.StringVar(&(opts.EmbedQueryPrefix), "embed-query-prefix", opts.EmbedQueryPrefix,
+		"Prefix of embedded queries, overrides the preset (env "+GoRagEnvEmbedQueryPrefix+")")
+	flags.StringVar(&(opts.EmbedDocumentPrefix), "embed-document-prefix", opts.EmbedDocumentPrefix,
+		"Prefix of embedded documents, overrides the preset (env "+GoRagEnvEmbedDocumentPrefix+")")
+	flags.StringVar(&(opts.Models), "models", opts.Models,
+		"JSON file of the model registry: models, default model and collection models (env "+GoRagEnvModels+")")
+	flags.Float64Var(&(opts.MinTemperature), "min-temperature", opts.MinTemperature,
+		"Lowest temperature clients may ask for (env "+GoRagEnvMinTemperature+")")
+	flags.Float64Var(&(opts.MaxTemperature), "max-temperature", opts.MaxTemperature,
+		"Highest temperature clients may ask for (env "+GoRagEnvMaxTemperature+")")
+	flags.Int64Var(&(opts.MaxTopK), "max-top-k", opts.MaxTopK,
+		"Highest top_k clients may ask for, -1 for no limit (env "+GoRagEnvMaxTopK+")")
+	flags.Int64Var(&(opts.MaxPredict), "max-predict", opts.MaxPredict,
+		"Highest n_predict clients may ask for, -1 for no limit (env "+GoRagEnvMaxPredict+")")
+	flags.Int64Var(&(opts.MaxTokens), "max-tokens", opts.MaxTokens,
+		"Highest max_tokens clients may ask for, -1 for no limit (env "+GoRagEnvMaxTokens+")")
+	flags.Int64Var(&(opts.AgentMaxSteps), "agent-max-steps", opts.AgentMaxSteps,
+		"Most tool calling rounds of an agent completion (env "+GoRagEnvAgentMaxSteps+")")
+	flags.StringVar(&(opts.Tools), "tools", opts.Tools,
+		"JSON file of the HTTP tools offered to agent completions (env "+GoRagEnvTools+")")
+	flags.DurationVar(&(opts.DrainTimeout), "drain-timeout", opts.DrainTimeout,
+		"Time in-flight requests get to finish on SIGTERM/SIGINT (env "+GoRagEnvDrainTimeout+")")
+	flags.StringVar(&(opts.KeysFile), "keys-file", opts.KeysFile,
+		"JSON file of the API keys, see 'gorag keys'; none leaves the API open (env "+GoRagEnvKeysFile+")")
+	flags.StringVar(&(opts.Jwks), "jwks", opts.Jwks,
+		"JWKS file, or http(s) URL, validating JWT bearer tokens (env "+GoRagEnvJwks+")")
+	flags.StringVar(&(opts.JwtIssuer), "jwt-issuer", opts.JwtIssuer,
+		"Issuer (iss) JWTs must come from (env "+GoRagEnvJwtIssuer+")")
+	flags.StringVar(&(opts.JwtAudience), "jwt-audience", opts.JwtAudience,
+		"Audience (aud) JWTs must be meant for (env "+GoRagEnvJwtAudience+")")
+}
 
-	flags.Parse(os.Args[1:])
+// setupEnvironment layers the settings: defaults, then the config file,
+// then env, then flags. Only values actually given override a lower layer,
+// zero ones included.
+func setupEnvironment(opts *AppOptions, args []string) (err error) {
+	var callHelp bool = false
+	var config string
+
+	// Flags are parsed aside, then only the ones given are applied
+	given := newAppOptions()
+	flags := flag.NewFlagSet("gorag-server", flag.ExitOnError)
+	flags.BoolVar(&callHelp, "help", false, "show usage/help (that's me)")
+	flags.StringVar(&config, "config", "",
+		"YAML (or JSON) configuration file, overridden by env and flags (env "+GoRagEnvConfig+")")
+	defineFlags(flags, &given)
+
+	flags.Parse(args)
 	if !flags.Parsed() {
 		flags.Usage()
 		return fmt.Errorf("could not parse arguments")
@@ -106,36 +358,76 @@ func setupEnvironment(opts *AppOptions) (err error) {
 		os.Exit(0)
 	}
 
-	// Poor man's approach. Kind of ridiculous
-	if len(opts.HttpHost) == 0 {
-		opts.HttpHost = envHttpHost
+	*opts = newAppOptions()
+	opts.Config = config
+	if len(opts.Config) == 0 {
+		opts.Config = os.Getenv(GoRagEnvConfig)
 	}
 
-	if len(opts.HttpPort) == 0 {
-		opts.HttpPort = envHttpPort
+	if len(opts.Config) > 0 {
+		if err = loadConfigFile(opts.Config, opts); err != nil {
+			return err
+		}
 	}
 
-	if len(opts.QdrantUri) == 0 {
-		opts.QdrantUri = envQdrantUri
-	}
+	// Values are parsed the way flags are, through a set bound to opts
+	layer := flag.NewFlagSet("gorag-server", flag.ContinueOnError)
+	layer.SetOutput(io.Discard)
+	defineFlags(layer, opts)
 
-	if len(opts.EmbedServer) == 0 {
-		opts.EmbedServer = envEmbedServer
-	}
+	layer.VisitAll(func(f *flag.Flag) {
+		value := os.Getenv(appEnv[f.Name])
+		if err != nil || len(value) == 0 {
+			return
+		}
 
-	if len(opts.LlamaServer) == 0 {
-		opts.LlamaServer = envLlamaServer
+		if err = layer.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("env %s: invalid value '%s': %w", appEnv[f.Name], value, err)
+		}
+	})
+
+	if err != nil {
+		return err
 	}
 
-	if opts.QdrantLimit == 0 {
-		opts.QdrantLimit = int64(envQdrantLimit)
+	flags.Visit(func(f *flag.Flag) {
+		if layer.Lookup(f.Name) != nil && err == nil {
+			err = layer.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if err != nil {
+		return err
 	}
 
+	opts.Prompts = opts.Prompts.Merge(gorag_engine.NewEnginePrompts())
+
 	// Now for consistency
 	if len(opts.LlamaServer) == 0 || len(opts.EmbedServer) == 0 {
 		return fmt.Errorf("either LlamaServer or EmbedServer was not defined")
 	}
 
+	if port, err := strconv.ParseUint(opts.HttpPort, 10, 16); err != nil || port == 0 {
+		return fmt.Errorf("invalid port '%s'", opts.HttpPort)
+	}
+
+	if opts.LlamaBalance != gorag_engine.LlamaBalanceRoundRobin &&
+		opts.LlamaBalance != gorag_engine.LlamaBalanceLeastInFlight {
+		return fmt.Errorf("invalid llama balance '%s'", opts.LlamaBalance)
+	}
+
+	if opts.MaxTemperature > 0 && opts.MinTemperature > opts.MaxTemperature {
+		return fmt.Errorf("min-temperature is higher than max-temperature")
+	}
+
+	if opts.AgentMaxSteps < 0 {
+		return fmt.Errorf("agent-max-steps must be positive")
+	}
+
+	if _, err = gorag_engine.GetEmbedPrefixes(opts.EmbedPrefix); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -143,24 +435,78 @@ func main() {
 	var options AppOptions
 	var err error
 
-	if err = setupEnvironment(&options); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err = runConfigCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err = runKeysCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	setupLogging()
+
+	if err = setupEnvironment(&options, os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
 	log.Println("gorag-server started")
+	log.Println("Config is .........", options.Config)
 	log.Println("HttpHost is .......", options.HttpHost)
 	log.Println("HttpPort is .......", options.HttpPort)
 	log.Println("QdrantUri is ......", options.QdrantUri)
 	log.Println("EmbedServer is ....", options.EmbedServer)
 	log.Println("LlamaServer is ....", options.LlamaServer)
 	log.Println("QdrantLimit is ....", options.QdrantLimit)
+	log.Println("Threshold is ......", options.Threshold)
+	log.Println("EmbedTimeout is ...", options.EmbedTimeout)
+	log.Println("LlamaTimeout is ...", options.LlamaTimeout)
+	log.Println("LlamaRetries is ...", options.LlamaRetries)
+
+	settings, err := options.getEngineSettings()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	ge := gorag_engine.NewEngine().
 		WithListenUrl(fmt.Sprintf("%s:%s", options.HttpHost, options.HttpPort)).
 		WithQdrantUrl(options.QdrantUri).
-		WithEmbedServer(options.EmbedServer).
-		WithLlamaServer(options.LlamaServer).
-		WithQdrantLimit(options.QdrantLimit)
+		WithEmbedServer(settings.EmbedServer).
+		WithLlamaServer(settings.LlamaServer).
+		WithQdrantLimit(settings.QdrantLimit).
+		WithThreshold(settings.Threshold).
+		WithLlamaClientOptions(settings.ClientOptions).
+		WithModels(settings.Models).
+		WithSamplingLimits(settings.Limits).
+		WithAgent(settings.AgentMaxSteps, settings.HttpTools).
+		WithApiKeys(settings.ApiKeys).
+		WithJwt(settings.Jwt).
+		WithPrompts(settings.Prompts).
+		WithEmbedPrefixes(settings.EmbedPrefixes).
+		WithEmbedCache(int(options.EmbedCacheSize), options.EmbedCacheTTL, options.EmbedCacheFile).
+		WithAnswerCache(int(options.AnswerCacheSize), options.AnswerCacheSimilarity, options.AnswerCacheTTL).
+		WithDrainTimeout(options.DrainTimeout).
+		WithReloader(reloadSettings)
+
+	// SIGHUP reloads the settings; requests in flight keep the previous ones
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if settings, err := reloadSettings(); err != nil {
+				log.Printf("[SIGHUP] reload rejected: %s\n", err.Error())
+			} else if err = ge.Reload(settings); err != nil {
+				log.Printf("[SIGHUP] %s\n", err.Error())
+			}
+		}
+	}()
 
 	// err = ge.Setup(eo)
 
@@ -170,7 +516,36 @@ func main() {
 		os.Exit(1)
 	}
 
-	defer ge.Finalize()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- ge.ListenAndServe()
+	}()
+
+	// SIGTERM/SIGINT drain in-flight requests; a second one cuts them
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err = <-serveErr:
+	case sig := <-stop:
+		log.Printf("[main] got %s, shutting down\n", sig)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-stop
+			log.Printf("[main] shutdown forced\n")
+			cancel()
+		}()
+
+		err = ge.Shutdown(ctx)
+		cancel()
+	}
+
+	ge.Finalize()
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Fatal(ge.ListenAndServe())
+	log.Println("gorag-server stopped")
 }